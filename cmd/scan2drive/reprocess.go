@@ -0,0 +1,95 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// reprocessCmd implements “scan2drive reprocess”, which asks a running
+// scan2drive to reprocess jobs of the default user via its HTTP API (see
+// package jobctl).
+func reprocessCmd(args []string) error {
+	fset := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: scan2drive reprocess [flags] [<job>...]\n\n")
+		fmt.Fprintf(fset.Output(), "Reprocesses the specified jobs, or all done jobs created between -from and -to.\n\n")
+		fset.PrintDefaults()
+	}
+	apiURL := fset.String("api_url",
+		"http://localhost:7120/api",
+		"URL of the HTTP API of the running scan2drive")
+	from := fset.String("from",
+		"",
+		"reprocess done jobs created on or after this date (e.g. 2024-01-01)")
+	to := fset.String("to",
+		"",
+		"reprocess done jobs created on or before this date (e.g. 2024-01-31)")
+	fset.Parse(args)
+	if fset.NArg() == 0 && *from == "" && *to == "" {
+		fset.Usage()
+		return fmt.Errorf("neither jobs nor -from/-to specified")
+	}
+	base := strings.TrimSuffix(*apiURL, "/")
+
+	for _, id := range fset.Args() {
+		if _, err := post(base + "/jobs/" + url.PathEscape(id) + "/reprocess"); err != nil {
+			return fmt.Errorf("job %s: %v", id, err)
+		}
+		fmt.Println(id)
+	}
+
+	if *from != "" || *to != "" {
+		v := url.Values{"from": {*from}, "to": {*to}}
+		b, err := post(base + "/reprocess?" + v.Encode())
+		if err != nil {
+			return err
+		}
+		var reply struct {
+			Jobs []string `json:"jobs"`
+		}
+		if err := json.Unmarshal(b, &reply); err != nil {
+			return err
+		}
+		for _, id := range reply.Jobs {
+			fmt.Println(id)
+		}
+		fmt.Fprintf(os.Stderr, "reprocessing %d jobs\n", len(reply.Jobs))
+	}
+	return nil
+}
+
+func post(u string) ([]byte, error) {
+	resp, err := http.Post(u, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status: got %v, want %v (body: %s)", resp.Status, want, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -31,11 +32,14 @@ import (
 
 	"github.com/stapelberg/scan2drive"
 	"github.com/stapelberg/scan2drive/internal/httpscaningest"
+	"github.com/stapelberg/scan2drive/internal/jobctl"
 	"github.com/stapelberg/scan2drive/internal/jobqueue"
-	"github.com/stapelberg/scan2drive/internal/legacyconvert"
 	"github.com/stapelberg/scan2drive/internal/mayqtt"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/pipeline"
+	"github.com/stapelberg/scan2drive/internal/retention"
 	"github.com/stapelberg/scan2drive/internal/scaningest"
-	"github.com/stapelberg/scan2drive/internal/sink/drivesink"
+	"github.com/stapelberg/scan2drive/internal/scheduler"
 	"github.com/stapelberg/scan2drive/internal/source/airscan"
 	"github.com/stapelberg/scan2drive/internal/source/fss500"
 	"github.com/stapelberg/scan2drive/internal/user"
@@ -46,23 +50,16 @@ import (
 
 	_ "image/jpeg"
 	_ "net/http/pprof"
-)
 
-func convert(ctx context.Context, j *jobqueue.Job) error {
-	tr, _ := trace.FromContext(ctx)
-	pdf, thumb, err := legacyconvert.ConvertLogic(tr, j.Pages())
-	if err != nil {
-		return err
-	}
-	tr.LazyPrintf("Converted. Writing scan.pdf (%d bytes)", len(pdf))
-	if err := j.AddDerivedFile("scan.pdf", pdf); err != nil {
-		return err
-	}
-	if err := j.AddDerivedFile("thumb.png", thumb); err != nil {
-		return err
-	}
-	return nil
-}
+	// sink implementations (registered in init):
+	_ "github.com/stapelberg/scan2drive/internal/sink/dirsink"
+	_ "github.com/stapelberg/scan2drive/internal/sink/drivesink"
+	_ "github.com/stapelberg/scan2drive/internal/sink/execsink"
+	_ "github.com/stapelberg/scan2drive/internal/sink/mailsink"
+	_ "github.com/stapelberg/scan2drive/internal/sink/paperlesssink"
+	_ "github.com/stapelberg/scan2drive/internal/sink/s3sink"
+	_ "github.com/stapelberg/scan2drive/internal/sink/webdavsink"
+)
 
 func processScan(ctx context.Context, u *user.Account, j *jobqueue.Job) (err error) {
 	tr := trace.New("ProcessScan", "job id "+j.Id())
@@ -78,63 +75,19 @@ func processScan(ctx context.Context, u *user.Account, j *jobqueue.Job) (err err
 	}()
 	tr.LazyPrintf("job markers: %+v", j.Markers)
 
-	// TODO(later): instead of this hard-coded conversion, perhaps allow
-	// configuring a processing graph of sorts?
-
-	// TODO(later): make the sinks pluggable, start with an external process
-	// sink
-
-	// Upload the originals in the background while converting (which takes the
-	// bulk of the time).
-	uploadOriginalsRes := make(chan error)
-	if !j.Markers.UploadedOriginals {
-		mayqtt.Publishf("processing %d pages", len(j.Pages()))
-		go func() {
-			uploadOriginalsRes <- drivesink.UploadOriginals(ctx, u, j)
-		}()
-	}
-
-	if !j.Markers.Converted {
-		// convert does binarize, rotate (make conditional!), g3 encoding, PDF
-		// writing, and PNG thumbnail creation.
-		if err := convert(ctx, j); err != nil {
-			// TODO: remove this duplication with the lines below:
-			if !j.Markers.UploadedOriginals {
-				if err := <-uploadOriginalsRes; err != nil {
-					return fmt.Errorf("Uploading originals: %v", err)
-				}
-				if err := j.CommitMarker("uploadoriginals"); err != nil {
-					return err
-				}
-				tr.LazyPrintf("job markers now: %+v", j.Markers)
-			}
-			return err
-		}
-		if err := j.CommitMarker("convert"); err != nil {
-			return err
-		}
-		tr.LazyPrintf("job markers now: %+v", j.Markers)
+	g, err := pipeline.ForJob(u, j)
+	if err != nil {
+		// Retrying will not help until the user fixes profiles.json.
+		return scheduler.Permanent(err)
 	}
-
-	if !j.Markers.UploadedOriginals {
-		if err := <-uploadOriginalsRes; err != nil {
-			return fmt.Errorf("Uploading originals: %v", err)
-		}
-		if err := j.CommitMarker("uploadoriginals"); err != nil {
-			return err
-		}
-		tr.LazyPrintf("job markers now: %+v", j.Markers)
+	tr.LazyPrintf("processing stages %q", g.Stages())
+	if err := g.Run(ctx, j); err != nil {
+		return err
 	}
+	tr.LazyPrintf("job markers now: %+v", j.Markers)
 
-	if !j.Markers.UploadedPDF {
-		mayqtt.Publishf("uploading PDF")
-		if err := drivesink.UploadPDF(ctx, u, j); err != nil {
-			return fmt.Errorf("Uploading PDF: %v", err)
-		}
-		if err := j.CommitMarker("uploadpdf"); err != nil {
-			return err
-		}
-		tr.LazyPrintf("job markers now: %+v", j.Markers)
+	if err := j.CommitMarker("done"); err != nil {
+		return err
 	}
 
 	mayqtt.Publishf("scanner ready")
@@ -152,10 +105,27 @@ func processScan(ctx context.Context, u *user.Account, j *jobqueue.Job) (err err
 	return nil
 }
 
+// withoutAPI returns a handler which serves h, except for the HTTP API under
+// /api/: the HTTP API does not authenticate its callers, so it is only served
+// on -http_listen_address, never on the HTTPS listener for the internet
+// (-tls_autocert_hosts).
+func withoutAPI(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := path.Clean(r.URL.Path); p == "/api" || strings.HasPrefix(p, "/api/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func dispatchScanRequest(ingester *scaningest.Ingester, finders []scan2drive.ScanSourceFinder, scanRequest *scan2drive.ScanRequest) error {
 	tr := trace.New("scan2drive", "DispatchScanRequest")
 	defer tr.Finish()
 
+	ingester.Profile = scanRequest.Profile
+	ingester.ManualDuplex = scanRequest.ManualDuplex
+
 	for _, finder := range finders {
 		srcs := finder.CurrentScanSources()
 		tr.LazyPrintf("finder discovered %d scan sources", len(srcs))
@@ -203,6 +173,18 @@ func logic() error {
 		"",
 		"If non-empty, a comma-separated list of users who are permitted to log in")
 
+	workers := flag.Int("workers",
+		2,
+		"Number of jobs to process concurrently. At most one job is converted at a time, but uploads of other jobs can overlap with it.")
+
+	maxAttempts := flag.Int("max_attempts",
+		scheduler.DefaultMaxAttempts,
+		"Number of failed attempts after which processing a job is given up until it is retried manually. Attempts are retried with exponential backoff.")
+
+	retentionInterval := flag.Duration("retention_interval",
+		1*time.Hour,
+		"How often to remove local copies of done jobs according to each user’s retention.json.")
+
 	tailscaleHostname := flag.String("tailscale_hostname", "scan2drive", "tailscale hostname")
 	tailscaleAllowedUser := flag.String("tailscale_allowed_user", "", "the name of a tailscale user to allow")
 
@@ -213,26 +195,20 @@ func logic() error {
 	log.Printf("scan2drive starting")
 
 	mqttScanRequests := make(chan *scan2drive.ScanRequest, 1)
+	mqttJobRequests := make(chan *scan2drive.JobRequest)
 	// makes mayqtt.Publishf() work as a side effect:
-	mayqtt.MQTT(mqttScanRequests)
-
-	// We have one sequential job queue runner, as the resources on the
-	// Raspberry Pi are constrained enough that multiple concurrent scan jobs
-	// are not a great idea.
-	type workJob struct {
-		user *user.Account
-		job  *jobqueue.Job
-	}
-	workJobs := make(chan workJob)
+	mayqtt.MQTT(mqttScanRequests, mqttJobRequests)
+
+	// Jobs are processed by a bounded number of workers, taking turns between
+	// users. Conversion is CPU-intensive and runs for one job at a time (see
+	// pipeline.CPUIntensive), but uploads of other jobs can overlap with it.
+	sched := scheduler.New(*workers, processScan)
+	sched.MaxAttempts = *maxAttempts
 	eg, ctx := errgroup.WithContext(context.Background())
 	eg.Go(func() error {
-		for workJob := range workJobs {
-			if err := processScan(ctx, workJob.user, workJob.job); err != nil {
-				log.Printf("job %v failed: %v", workJob.job.Id(), err)
-			}
-		}
-		return nil
+		return sched.Run(ctx)
 	})
+	jobs := &jobctl.Controller{Scheduler: sched}
 
 	lockedUsers := user.NewLocked()
 
@@ -242,35 +218,43 @@ func logic() error {
 			return nil
 		}
 		return &scaningest.Ingester{
-			IngestCallback: func(j *scaningest.Job) (string, error) {
-				// Persist the job into the reliable job queue (on persistent
-				// storage) and let the queue worker take it from here.
-
-				log.Printf("ingest(%d pages)", len(j.Pages))
-				job, err := user.Queue.AddJob(j.Pages)
+			// Pages are persisted into the reliable job queue (on persistent
+			// storage) as they arrive. Once the job is committed, the queue
+			// worker takes it from here.
+			Queue: user.Queue,
+			IngestCallback: func(job *jobqueue.Job) error {
+				log.Printf("enqueuing job %v (%d pages)", job.Id(), len(job.Pages()))
+				sched.Enqueue(user, job)
+				return nil
+			},
+			Thresholders: func(profile string) page.Thresholder {
+				th, err := pipeline.ScanThresholder(user, profile)
 				if err != nil {
-					return "", err
-				}
-				log.Printf("enqueuing job %v", job.Id())
-				workJobs <- workJob{
-					user: user,
-					job:  job,
+					// Processing the job will report the error.
+					log.Print(err)
+					return page.DefaultThresholder
 				}
-				log.Printf("job %v enqueued!", job.Id())
-				return job.Id(), nil
+				return th
 			},
 		}
 	}
 
-	ingesterForDefault := func() *scaningest.Ingester {
+	defaultUser := func() *user.Account {
 		users := lockedUsers.Users()
-		for uid, user := range users {
+		for _, user := range users {
 			if user.Default {
-				return ingesterFor(uid)
+				return user
 			}
 		}
-		for uid := range users {
-			return ingesterFor(uid)
+		for _, user := range users {
+			return user
+		}
+		return nil
+	}
+
+	ingesterForDefault := func() *scaningest.Ingester {
+		if user := defaultUser(); user != nil {
+			return ingesterFor(user.Sub)
 		}
 		return nil
 	}
@@ -318,6 +302,7 @@ func logic() error {
 		s := &http.Server{
 			Addr:      *httpsListenAddr,
 			TLSConfig: m.TLSConfig(),
+			Handler:   withoutAPI(http.DefaultServeMux),
 		}
 		for _, host := range hosts {
 			log.Printf("listening on https://%s", host)
@@ -385,39 +370,54 @@ func logic() error {
 		IngesterFor:      ingesterFor,
 		AllowedUsers:     allowedUsers,
 		ListenURLs:       listenURLs,
+		Jobs:             jobs,
 	})
 	if err != nil {
 		return err
 	}
 
+	// Also renames job directories of earlier versions of scan2drive before
+	// any job is processed.
 	if err := lockedUsers.UpdateFromDir(*stateDir, *scansDir, oauthConfig); err != nil {
 		return err
 	}
+	sweeper := &retention.Sweeper{
+		Users:    lockedUsers.Users,
+		Interval: *retentionInterval,
+	}
+	eg.Go(func() error {
+		return sweeper.Run(ctx)
+	})
 	go func() {
 		// start after a brief delay to not slow down startup
 		time.Sleep(5 * time.Second)
-		// Try to resume incomplete jobs:
+		// Try to resume incomplete jobs. Jobs which failed are retried once
+		// their backoff elapsed (see package scheduler), and jobs in state
+		// Failed are skipped until they are retried manually.
 		for {
 			users := lockedUsers.Users()
 			for _, user := range users {
-				// Read all scan jobs from disk:
-				scans, err := user.Queue.Scans()
+				// Only read the unfinished scan jobs from disk:
+				scans, _, err := user.Queue.List(0, 0)
 				if err != nil {
 					log.Print(err)
 					continue
 				}
-				for _, job := range scans {
-					if job.State() == jobqueue.Done {
+				for _, s := range scans {
+					if s.State == jobqueue.Done {
+						continue
+					}
+					job, err := user.Queue.JobById(s.Id)
+					if err != nil {
+						log.Print(err)
 						continue
 					}
-					log.Printf("enqueuing unfinished job %s", job.Id())
-					workJobs <- workJob{
-						user: user,
-						job:  job,
+					if sched.Enqueue(user, job) {
+						log.Printf("enqueued unfinished job %s", job.Id())
 					}
 				}
 			}
-			log.Printf("waiting 1 hour before retrying any unfinished jobs")
+			log.Printf("waiting 1 hour before looking for unfinished jobs again")
 			time.Sleep(1 * time.Hour)
 		}
 	}()
@@ -437,6 +437,18 @@ func logic() error {
 				}
 			}
 		}()
+		go func() {
+			for jobRequest := range mqttJobRequests {
+				user := lockedUsers.UserByName(jobRequest.User)
+				if user == nil {
+					log.Printf("user %q not found", jobRequest.User)
+					continue
+				}
+				if err := jobs.Do(ctx, user, jobRequest); err != nil {
+					log.Printf("%s job %q: %v", jobRequest.Action, jobRequest.Job, err)
+				}
+			}
+		}()
 	}
 
 	// - TODO(later): grpc scaningest API
@@ -445,6 +457,8 @@ func logic() error {
 	{
 		defaultIngester := ingesterForDefault()
 		serveMux := httpscaningest.ServeMux(defaultIngester)
+		serveMux.Handle("/jobs/", jobs.Handler(defaultUser))
+		serveMux.Handle("/reprocess", jobs.ReprocessHandler(defaultUser))
 		http.Handle("/api/", http.StripPrefix("/api", serveMux))
 	}
 
@@ -492,6 +506,12 @@ func logic() error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+		if err := reprocessCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	gokrazyInit()
 	if err := logic(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,141 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package atomicfile writes files atomically and durably: after a crash or
+// power loss, a file contains either its old or its new contents, but never
+// partial contents, and a file which was written successfully stays written.
+//
+// Files are written into a temporary file in the same directory, which is
+// synced to disk and then renamed over the destination. The directory is
+// synced after the rename, so that the new directory entry persists, too.
+package atomicfile
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempInfix is part of the names of temporary files, see IsTemp.
+const tempInfix = ".tmp-"
+
+// FaultHook is called (if non-nil) before each step of writing a file, with
+// the step (“write”, “sync”, “rename” or “syncdir”) and the name of the
+// destination file. If it returns an error, the write is aborted at that step
+// with the error. Tests use FaultHook to simulate failing disks.
+var FaultHook func(step, fn string) error
+
+func fault(step, fn string) error {
+	if FaultHook == nil {
+		return nil
+	}
+	return FaultHook(step, fn)
+}
+
+// IsTemp returns whether name is the name of a temporary file, which might be
+// left behind by a crash while writing a file.
+func IsTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempInfix)
+}
+
+// WriteFile is like os.WriteFile, but atomic and durable.
+func WriteFile(fn string, data []byte, perm os.FileMode) error {
+	return Write(fn, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Write calls write to produce the contents of fn, which replace the contents
+// of fn once write returns successfully. If write (or any other step) fails,
+// fn is left untouched.
+func Write(fn string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir, base := filepath.Split(fn)
+	if dir == "" {
+		dir = "."
+	}
+	if err := fault("write", fn); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+base+tempInfix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails after the rename, which is fine
+	bufw := bufio.NewWriter(f)
+	if err := write(bufw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := fault("sync", fn); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fault("rename", fn); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), fn); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// Rename is like os.Rename, but durable: the directories of oldpath and
+// newpath are synced after renaming.
+func Rename(oldpath, newpath string) error {
+	if err := fault("rename", newpath); err != nil {
+		return err
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if err := SyncDir(filepath.Dir(newpath)); err != nil {
+		return err
+	}
+	if filepath.Dir(oldpath) == filepath.Dir(newpath) {
+		return nil
+	}
+	return SyncDir(filepath.Dir(oldpath))
+}
+
+// SyncDir syncs the directory dir to disk, so that changes to its entries
+// (created, renamed or removed files) persist.
+func SyncDir(dir string) error {
+	if err := fault("syncdir", dir); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -684,6 +684,13 @@ type HardwareStatus struct {
 	skewAngle uint16
 }
 
+// SkewAngle returns the skew angle in degrees (clockwise, as seen from the
+// front side) of the last piece of paper, as measured by the scanner. The
+// scanner reports the angle in tenths of a degree, as a signed number.
+func (s HardwareStatus) SkewAngle() float64 {
+	return float64(int16(s.skewAngle)) / 10
+}
+
 func hardwareStatusFromBytes(b []byte) HardwareStatus {
 	return HardwareStatus{
 		top: (b[2]>>7)&1 == 1,
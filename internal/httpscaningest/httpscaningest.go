@@ -21,15 +21,20 @@
 //	jobid=$(curl -s -X CREATE http://localhost:7120/ingestjob | jq -r .job)
 //	curl --request POST --data-binary "@internal/neonjpeg/testdata/page2.jpg" http://localhost:7120/job/$jobid/addpage
 //	curl --request POST http://localhost:7120/job/$jobid/ingest
+//
+// To process the job with a specific processing profile, create it using
+// /ingestjob?profile=<name>.
 package httpscaningest
 
 import (
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stapelberg/scan2drive/internal/httperr"
@@ -52,8 +57,16 @@ func shiftPath(p string) (head, tail string) {
 	return p[1:i], p[i:]
 }
 
+// AbandonTimeout is the duration after which jobs which did not receive any
+// request are considered abandoned and discarded.
+var AbandonTimeout = 24 * time.Hour
+
 type jobHandler struct {
 	job *scaningest.Job
+
+	// done is called once the job was ingested (or failed to ingest), so
+	// that it is no longer served.
+	done func()
 }
 
 func (h *jobHandler) ServeHTTPError(w http.ResponseWriter, r *http.Request) error {
@@ -74,6 +87,7 @@ func (h *jobHandler) ServeHTTPError(w http.ResponseWriter, r *http.Request) erro
 		return h.job.AddPage(page.JPEGPageFromBytes(b))
 
 	case "ingest":
+		defer h.done()
 		jobId, err := h.job.Ingest()
 		_ = jobId
 		return err
@@ -83,18 +97,46 @@ func (h *jobHandler) ServeHTTPError(w http.ResponseWriter, r *http.Request) erro
 		fmt.Errorf("verb %q not found", verb))
 }
 
+type currentJob struct {
+	job      *scaningest.Job
+	lastUsed time.Time
+}
+
 func ServeMux(ingester *scaningest.Ingester) *http.ServeMux {
 	var (
 		// TODO: switch to an LRU cache so that we can bound the number of
 		// concurrent requests and turn a runaway job request loop into a
 		// non-event.
 		currentJobsMu sync.Mutex
-		currentJobs   = make(map[string]*scaningest.Job)
+		currentJobs   = make(map[string]*currentJob)
 	)
 	getJob := func(jobId string) *scaningest.Job {
 		currentJobsMu.Lock()
 		defer currentJobsMu.Unlock()
-		return currentJobs[jobId]
+		cj, ok := currentJobs[jobId]
+		if !ok {
+			return nil
+		}
+		cj.lastUsed = time.Now()
+		return cj.job
+	}
+	removeJob := func(jobId string) {
+		currentJobsMu.Lock()
+		defer currentJobsMu.Unlock()
+		delete(currentJobs, jobId)
+	}
+	// discardAbandoned must be called with currentJobsMu held.
+	discardAbandoned := func() {
+		for jobId, cj := range currentJobs {
+			if time.Since(cj.lastUsed) < AbandonTimeout {
+				continue
+			}
+			log.Printf("discarding job %s: no request within %v", jobId, AbandonTimeout)
+			if err := cj.job.Discard(); err != nil {
+				log.Printf("discarding job %s: %v", jobId, err)
+			}
+			delete(currentJobs, jobId)
+		}
 	}
 	serveMux := http.NewServeMux()
 
@@ -109,12 +151,17 @@ func ServeMux(ingester *scaningest.Ingester) *http.ServeMux {
 		if err != nil {
 			return err
 		}
+		job.Source = "http"
+		if profile := r.FormValue("profile"); profile != "" {
+			job.Profile = profile
+		}
 
 		jobId := uuid.NewString()
 
 		currentJobsMu.Lock()
 		defer currentJobsMu.Unlock()
-		currentJobs[jobId] = job
+		discardAbandoned()
+		currentJobs[jobId] = &currentJob{job: job, lastUsed: time.Now()}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"job":"%s"}`, jobId)
 		return nil
@@ -129,7 +176,10 @@ func ServeMux(ingester *scaningest.Ingester) *http.ServeMux {
 				http.StatusNotFound,
 				fmt.Errorf("job not found"))
 		}
-		hdl := jobHandler{job: job}
+		hdl := jobHandler{
+			job:  job,
+			done: func() { removeJob(jobId) },
+		}
 		httpHdl := httperr.Handle(hdl.ServeHTTPError)
 		httpHdl.ServeHTTP(w, r)
 		return nil
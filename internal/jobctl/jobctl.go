@@ -0,0 +1,376 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jobctl cancels, deletes, retries and reprocesses jobs on behalf of
+// the web interface, the HTTP API and MQTT.
+//
+// # Example Usage
+//
+// You can use the HTTP API with curl on the command line like so:
+//
+//	curl --request POST http://localhost:7120/api/jobs/$jobid/cancel
+//	curl --request POST http://localhost:7120/api/jobs/$jobid/retry
+//	curl --request POST http://localhost:7120/api/jobs/$jobid/reprocess
+//	curl --request POST 'http://localhost:7120/api/reprocess?from=2024-01-01&to=2024-01-31'
+//	curl --request POST 'http://localhost:7120/api/jobs/'$jobid'/rotate?page=2&rotation=180'
+//	curl --request POST 'http://localhost:7120/api/jobs/'$jobid'/rotate?page=2&rotation=auto'
+//	curl --request POST 'http://localhost:7120/api/jobs/'$jobid'/restore?page=2'
+//	curl --request DELETE http://localhost:7120/api/jobs/$jobid
+//	curl --request DELETE 'http://localhost:7120/api/jobs/'$jobid'?sinks=true'
+//
+// Jobs are deleted from the sinks (where supported, see
+// scan2drive.SinkDeleter) only when sinks=true is specified.
+package jobctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/httperr"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/scheduler"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Controller changes jobs of all users.
+type Controller struct {
+	Scheduler *scheduler.Scheduler
+}
+
+// Cancel interrupts processing the job (if any) and moves the job into state
+// jobqueue.Canceled, so that it is not processed until it is retried.
+func (c *Controller) Cancel(u *user.Account, jobId string) error {
+	jobId = u.Queue.Resolve(jobId)
+	// Interrupt processing first: the job would otherwise overwrite the
+	// cancellation when recording its progress.
+	c.Scheduler.Cancel(u, jobId)
+	_, err := u.Queue.Cancel(jobId)
+	return err
+}
+
+// Delete cancels the job and removes it from the queue. When fromSinks is true,
+// the job is removed from all sinks which support it, too.
+func (c *Controller) Delete(ctx context.Context, u *user.Account, jobId string, fromSinks bool) (err error) {
+	jobId = u.Queue.Resolve(jobId)
+	tr := trace.New("DeleteJob", "job id "+jobId)
+	defer tr.Finish()
+	ctx = trace.NewContext(ctx, tr)
+	defer func() {
+		tr.LazyPrintf("-> return err=%v", err)
+		if err != nil {
+			tr.SetError()
+		}
+	}()
+
+	c.Scheduler.Cancel(u, jobId)
+	job, err := u.Queue.Cancel(jobId)
+	if err != nil {
+		return err
+	}
+	if fromSinks {
+		tr.LazyPrintf("deleting job from sinks")
+		if err := sink.Delete(ctx, u, job); err != nil {
+			return err
+		}
+	}
+	return u.Queue.Delete(jobId)
+}
+
+// Retry resets the failed attempts of a Failed or Canceled job and schedules
+// processing the job.
+func (c *Controller) Retry(u *user.Account, jobId string) error {
+	jobId = u.Queue.Resolve(jobId)
+	job, err := u.Queue.JobById(jobId)
+	if err != nil {
+		return err
+	}
+	if err := job.Retry(); err != nil {
+		return err
+	}
+	c.Scheduler.Enqueue(u, job)
+	return nil
+}
+
+// Reprocess runs all processing stages of the job again, e.g. after conversion
+// improved. The PDF in Google Drive is updated in place (see package
+// drivesink).
+func (c *Controller) Reprocess(u *user.Account, jobId string) error {
+	jobId = u.Queue.Resolve(jobId)
+	c.Scheduler.Cancel(u, jobId)
+	job, err := u.Queue.JobById(jobId)
+	if err != nil {
+		return err
+	}
+	if err := job.Reprocess(); err != nil {
+		return err
+	}
+	log.Printf("reprocessing job %s", jobId)
+	c.Scheduler.Enqueue(u, job)
+	return nil
+}
+
+// RotatePage forces the rotation in degrees (clockwise: 0, 90, 180 or 270) of
+// the original page num (starting at 1) of the job, or detects the page’s
+// orientation again if rotation is nil, and reprocesses the job. Only
+// processing stages which orient pages (see package pipeline) rotate them.
+func (c *Controller) RotatePage(u *user.Account, jobId string, num int, rotation *int) error {
+	if rotation != nil {
+		if err := page.ValidRotation(*rotation); err != nil {
+			return err
+		}
+	}
+	return c.updatePage(u, jobId, num, func(rec *jobqueue.PageRecord) {
+		rec.ForcedRotation = rotation
+	})
+}
+
+// RestorePage marks the original page num (starting at 1) of the job, which
+// was skipped as blank, as not blank and reprocesses the job, so that the page
+// is included in the PDF.
+func (c *Controller) RestorePage(u *user.Account, jobId string, num int) error {
+	return c.updatePage(u, jobId, num, func(rec *jobqueue.PageRecord) {
+		rec.Restored = true
+	})
+}
+
+// updatePage changes the record of the original page num (starting at 1) of
+// the job with f and reprocesses the job.
+func (c *Controller) updatePage(u *user.Account, jobId string, num int, f func(*jobqueue.PageRecord)) error {
+	jobId = u.Queue.Resolve(jobId)
+	job, err := u.Queue.JobById(jobId)
+	if err != nil {
+		return err
+	}
+	// Pages are only loaded for unfinished jobs, but the page count is
+	// recorded for all jobs.
+	if num < 1 || num > job.Summary().Pages {
+		return fmt.Errorf("job %s has no page %d", jobId, num)
+	}
+	if job.OriginalsPruned() {
+		return fmt.Errorf("job %s: original pages were removed", jobId)
+	}
+	// Interrupt processing before changing the page record: the job would
+	// otherwise overwrite it when recording its progress.
+	c.Scheduler.Cancel(u, jobId)
+	job, err = u.Queue.JobById(jobId)
+	if err != nil {
+		return err
+	}
+	if err := job.UpdatePage(num, f); err != nil {
+		return err
+	}
+	return c.Reprocess(u, jobId)
+}
+
+// ParseRotation parses the rotation of a page as accepted by RotatePage:
+// “auto” (or the empty string) for detecting the orientation, or the number
+// of degrees.
+func ParseRotation(s string) (*int, error) {
+	if s == "" || s == "auto" {
+		return nil, nil
+	}
+	rotation, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := page.ValidRotation(rotation); err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+// ReprocessRange reprocesses all Done jobs which were created between from
+// (inclusive) and to (exclusive), and returns their ids. A zero from or to
+// leaves the range open. Jobs whose original pages were removed are skipped.
+func (c *Controller) ReprocessRange(u *user.Account, from, to time.Time) ([]string, error) {
+	scans, _, err := u.Queue.List(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for i := len(scans) - 1; i >= 0; i-- { // oldest first
+		s := scans[i]
+		if s.State != jobqueue.Done ||
+			s.OriginalsPruned ||
+			s.Created.Before(from) ||
+			(!to.IsZero() && !s.Created.Before(to)) {
+			continue
+		}
+		if err := c.Reprocess(u, s.Id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, s.Id)
+	}
+	return ids, nil
+}
+
+// ParseRange parses the dates from and to (e.g. 2024-01-31, in local time) of
+// an inclusive date range, as used by ReprocessRange. An empty from selects
+// all jobs up to and including to, an empty to all jobs since from. To prevent
+// accidentally reprocessing all jobs, from and to cannot both be empty.
+func ParseRange(from, to string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	if from == "" && to == "" {
+		return start, end, fmt.Errorf("no range specified")
+	}
+	if from != "" {
+		t, err := time.ParseInLocation(time.DateOnly, from, time.Local)
+		if err != nil {
+			return start, end, err
+		}
+		start = t
+	}
+	if to != "" {
+		t, err := time.ParseInLocation(time.DateOnly, to, time.Local)
+		if err != nil {
+			return start, end, err
+		}
+		end = t.AddDate(0, 0, 1)
+		if !start.Before(end) {
+			return start, end, fmt.Errorf("empty range %s to %s", from, to)
+		}
+	}
+	return start, end, nil
+}
+
+// Do carries out the request, as received via MQTT.
+func (c *Controller) Do(ctx context.Context, u *user.Account, req *scan2drive.JobRequest) error {
+	switch req.Action {
+	case "cancel":
+		return c.Cancel(u, req.Job)
+	case "delete":
+		return c.Delete(ctx, u, req.Job, req.Sinks)
+	case "retry":
+		return c.Retry(u, req.Job)
+	case "reprocess":
+		return c.Reprocess(u, req.Job)
+	case "rotate":
+		rotation, err := ParseRotation(req.Rotation)
+		if err != nil {
+			return err
+		}
+		return c.RotatePage(u, req.Job, req.Page, rotation)
+	case "restore":
+		return c.RestorePage(u, req.Job, req.Page)
+	}
+	return fmt.Errorf("unknown action %q", req.Action)
+}
+
+// Handler returns an HTTP handler for /jobs/<id>/cancel (POST),
+// /jobs/<id>/retry (POST), /jobs/<id>/reprocess (POST),
+// /jobs/<id>/rotate?page=<num>&rotation=<degrees> (POST),
+// /jobs/<id>/restore?page=<num> (POST) and /jobs/<id> (DELETE), which act on the jobs of the user returned by userFn.
+func (c *Controller) Handler(userFn func() *user.Account) http.Handler {
+	return httperr.Handle(func(w http.ResponseWriter, r *http.Request) error {
+		u := userFn()
+		if u == nil {
+			return httperr.Error(
+				http.StatusNotFound,
+				fmt.Errorf("no user found"))
+		}
+		jobId, verb, _ := strings.Cut(strings.TrimPrefix(path.Clean(r.URL.Path), "/jobs/"), "/")
+		want := "POST"
+		if verb == "" {
+			want = "DELETE"
+		}
+		if got := r.Method; got != want {
+			return httperr.Error(
+				http.StatusMethodNotAllowed,
+				fmt.Errorf("unexpected HTTP method: got %v, want %v", got, want))
+		}
+		if _, err := u.Queue.JobById(jobId); err != nil {
+			return httperr.Error(
+				http.StatusNotFound,
+				fmt.Errorf("job %q: %v", jobId, err))
+		}
+		var err error
+		switch verb {
+		case "":
+			err = c.Delete(r.Context(), u, jobId, r.FormValue("sinks") == "true")
+		case "cancel":
+			err = c.Cancel(u, jobId)
+		case "retry":
+			err = c.Retry(u, jobId)
+		case "reprocess":
+			err = c.Reprocess(u, jobId)
+		case "rotate":
+			num, perr := strconv.Atoi(r.FormValue("page"))
+			if perr != nil {
+				return httperr.Error(http.StatusBadRequest, fmt.Errorf("page: %v", perr))
+			}
+			rotation, perr := ParseRotation(r.FormValue("rotation"))
+			if perr != nil {
+				return httperr.Error(http.StatusBadRequest, fmt.Errorf("rotation: %v", perr))
+			}
+			err = c.RotatePage(u, jobId, num, rotation)
+		case "restore":
+			num, perr := strconv.Atoi(r.FormValue("page"))
+			if perr != nil {
+				return httperr.Error(http.StatusBadRequest, fmt.Errorf("page: %v", perr))
+			}
+			err = c.RestorePage(u, jobId, num)
+		default:
+			return httperr.Error(
+				http.StatusNotFound,
+				fmt.Errorf("verb %q not found", verb))
+		}
+		if os.IsNotExist(err) {
+			return httperr.Error(http.StatusNotFound, err)
+		}
+		return err
+	})
+}
+
+// ReprocessHandler returns an HTTP handler for /reprocess?from=<date>&to=<date>
+// (POST), which reprocesses the jobs of the user returned by userFn (see
+// ReprocessRange) and replies with the ids of the reprocessed jobs.
+func (c *Controller) ReprocessHandler(userFn func() *user.Account) http.Handler {
+	return httperr.Handle(func(w http.ResponseWriter, r *http.Request) error {
+		if got, want := r.Method, "POST"; got != want {
+			return httperr.Error(
+				http.StatusMethodNotAllowed,
+				fmt.Errorf("unexpected HTTP method: got %v, want %v", got, want))
+		}
+		u := userFn()
+		if u == nil {
+			return httperr.Error(
+				http.StatusNotFound,
+				fmt.Errorf("no user found"))
+		}
+		from, to, err := ParseRange(r.FormValue("from"), r.FormValue("to"))
+		if err != nil {
+			return httperr.Error(http.StatusBadRequest, err)
+		}
+		ids, err := c.ReprocessRange(u, from, to)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(struct {
+			Jobs []string `json:"jobs"`
+		}{ids})
+	})
+}
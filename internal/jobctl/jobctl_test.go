@@ -0,0 +1,400 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobctl_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobctl"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/scheduler"
+	"github.com/stapelberg/scan2drive/internal/sink/dirsink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// testJPEG returns a small, valid JPEG file.
+func testJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandler(t *testing.T) {
+	root := t.TempDir()
+	u := &user.Account{
+		Sub:   "a",
+		Queue: &jobqueue.Queue{Dir: t.TempDir(), User: "a"},
+		SinkConfigs: []scan2drive.SinkConfig{
+			{Type: "dir", Id: "nas", Config: json.RawMessage(`{"root": "` + root + `"}`)},
+		},
+	}
+	job, err := u.Queue.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG(t))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := dirsink.New("nas", dirsink.Config{Root: root, User: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	if err := s.Deliver(trace.NewContext(context.Background(), tr), job); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scheduler is not running, so that the job stays queued.
+	sched := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		return nil
+	})
+	sched.Enqueue(u, job)
+	ctl := &jobctl.Controller{Scheduler: sched}
+	srv := httptest.NewServer(http.StripPrefix("/api", ctl.Handler(func() *user.Account { return u })))
+	defer srv.Close()
+
+	do := func(method, path string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/api/jobs/" + job.Id() + "/cancel", http.StatusMethodNotAllowed},
+		{"POST", "/api/jobs/nope/cancel", http.StatusNotFound},
+		{"POST", "/api/jobs/" + job.Id() + "/nope", http.StatusNotFound},
+		{"POST", "/api/jobs/" + job.Id() + "/cancel", http.StatusOK},
+	} {
+		if got := do(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s: unexpected status: got %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+	if got, want := sched.Len(), 0; got != want {
+		t.Errorf("canceled job still scheduled: got %d jobs, want %d", got, want)
+	}
+	job, err = u.Queue.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Canceled; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+
+	if got, want := do("POST", "/api/jobs/"+job.Id()+"/retry"), http.StatusOK; got != want {
+		t.Errorf("retry: unexpected status: got %d, want %d", got, want)
+	}
+	if got, want := sched.Len(), 1; got != want {
+		t.Errorf("retried job not scheduled: got %d jobs, want %d", got, want)
+	}
+
+	if got, want := do("POST", "/api/jobs/"+job.Id()+"/rotate?page=1&rotation=45"), http.StatusBadRequest; got != want {
+		t.Errorf("rotate by 45 degrees: unexpected status: got %d, want %d", got, want)
+	}
+	if got, want := do("POST", "/api/jobs/"+job.Id()+"/rotate?page=1&rotation=180"), http.StatusOK; got != want {
+		t.Errorf("rotate: unexpected status: got %d, want %d", got, want)
+	}
+	job, err = u.Queue.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation := job.PageRecord(1).ForcedRotation; rotation == nil || *rotation != 180 {
+		t.Errorf("forced rotation not recorded: %v", rotation)
+	}
+
+	if got, want := do("POST", "/api/jobs/"+job.Id()+"/restore?page=9"), http.StatusInternalServerError; got != want {
+		t.Errorf("restore nonexistent page: unexpected status: got %d, want %d", got, want)
+	}
+	if got, want := do("POST", "/api/jobs/"+job.Id()+"/restore?page=1"), http.StatusOK; got != want {
+		t.Errorf("restore: unexpected status: got %d, want %d", got, want)
+	}
+	job, err = u.Queue.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.PageRecord(1).Restored {
+		t.Errorf("restored page not recorded")
+	}
+
+	pdf := filepath.Join(s.Dir(job), job.Id()+".pdf")
+	if got, want := do("DELETE", "/api/jobs/"+job.Id()+"?sinks=true"), http.StatusOK; got != want {
+		t.Errorf("delete: unexpected status: got %d, want %d", got, want)
+	}
+	if _, err := os.Stat(job.Dir()); !os.IsNotExist(err) {
+		t.Errorf("job directory not deleted: %v", err)
+	}
+	if _, err := os.Stat(pdf); !os.IsNotExist(err) {
+		t.Errorf("PDF not deleted from dir sink: %v", err)
+	}
+	if got, want := do("DELETE", "/api/jobs/"+job.Id()), http.StatusNotFound; got != want {
+		t.Errorf("second delete: unexpected status: got %d, want %d", got, want)
+	}
+}
+
+func TestReprocessRange(t *testing.T) {
+	u := &user.Account{
+		Sub:   "a",
+		Queue: &jobqueue.Queue{Dir: t.TempDir(), User: "a"},
+	}
+	for _, id := range []string{
+		"2024-01-31T23:59:59+01:00",
+		"2024-02-01T10:00:00+01:00",
+		"2024-02-29T23:00:00+01:00",
+		"2024-03-01T00:00:00+01:00",
+	} {
+		if err := os.MkdirAll(filepath.Join(u.Queue.Dir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(u.Queue.Dir, id, "page1.jpg"), testJPEG(t), 0600); err != nil {
+			t.Fatal(err)
+		}
+		job, err := u.Queue.JobById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, marker := range []string{"scan", "convert", "done"} {
+			if err := job.CommitMarker(marker); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sched := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		return nil
+	})
+	ctl := &jobctl.Controller{Scheduler: sched}
+	loc, err := time.LoadLocation("Etc/GMT-1") // UTC+1
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 2, 1, 0, 0, 0, 0, loc)
+	ids, err := ctl.ReprocessRange(u, from, from.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2024-02-01T10:00:00+01:00", "2024-02-29T23:00:00+01:00"}
+	if !slices.Equal(ids, want) {
+		t.Errorf("unexpected jobs reprocessed: got %q, want %q", ids, want)
+	}
+	if got, want := sched.Len(), 2; got != want {
+		t.Errorf("unexpected number of scheduled jobs: got %d, want %d", got, want)
+	}
+	for _, id := range want {
+		job, err := u.Queue.JobById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := job.State(), jobqueue.InProgress; got != want {
+			t.Errorf("job %s: unexpected state: got %v, want %v", id, got, want)
+		}
+	}
+}
+
+// doneJob returns a job with two pages which is Done.
+func doneJob(t *testing.T, u *user.Account) *jobqueue.Job {
+	const id = "2024-02-01T10:00:00+01:00"
+	if err := os.MkdirAll(filepath.Join(u.Queue.Dir, id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"page1.jpg", "page2.jpg"} {
+		if err := os.WriteFile(filepath.Join(u.Queue.Dir, id, fn), testJPEG(t), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job, err := u.Queue.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range []string{"scan", "convert", "done"} {
+		if err := job.CommitMarker(marker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job, err = u.Queue.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Done; got != want {
+		t.Fatalf("unexpected job state: got %v, want %v", got, want)
+	}
+	return job
+}
+
+func TestRotatePageDone(t *testing.T) {
+	u := &user.Account{
+		Sub:   "a",
+		Queue: &jobqueue.Queue{Dir: t.TempDir(), User: "a"},
+	}
+	job := doneJob(t, u)
+	sched := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		return nil
+	})
+	ctl := &jobctl.Controller{Scheduler: sched}
+
+	rotation := 90
+	if err := ctl.RotatePage(u, job.Id(), 2, &rotation); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.RotatePage(u, job.Id(), 3, &rotation); err == nil {
+		t.Errorf("RotatePage(page 3 of 2) unexpectedly succeeded")
+	}
+	job, err := u.Queue.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := job.PageRecord(2).ForcedRotation; got == nil || *got != rotation {
+		t.Errorf("forced rotation not recorded: %v", got)
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Errorf("rotated job not reprocessed: got state %v, want %v", got, want)
+	}
+	if got, want := sched.Len(), 1; got != want {
+		t.Errorf("rotated job not scheduled: got %d jobs, want %d", got, want)
+	}
+}
+
+func TestRestorePageDone(t *testing.T) {
+	u := &user.Account{
+		Sub:   "a",
+		Queue: &jobqueue.Queue{Dir: t.TempDir(), User: "a"},
+	}
+	job := doneJob(t, u)
+	// Conversion skipped page 2 as blank.
+	if err := job.UpdatePage(2, func(rec *jobqueue.PageRecord) {
+		rec.Skipped = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sched := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		return nil
+	})
+	ctl := &jobctl.Controller{Scheduler: sched}
+
+	if err := ctl.RestorePage(u, job.Id(), 2); err != nil {
+		t.Fatal(err)
+	}
+	job, err := u.Queue.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.PageRecord(2).Restored {
+		t.Errorf("restored page not recorded")
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Errorf("job not reprocessed: got state %v, want %v", got, want)
+	}
+	if got, want := sched.Len(), 1; got != want {
+		t.Errorf("job not scheduled: got %d jobs, want %d", got, want)
+	}
+}
+
+func TestReprocessAlias(t *testing.T) {
+	u := &user.Account{
+		Sub:   "a",
+		Queue: &jobqueue.Queue{Dir: t.TempDir(), User: "a"},
+	}
+	alias := doneJob(t, u).Id()
+	if err := u.Queue.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	job, err := u.Queue.JobById(alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Id() == alias {
+		t.Fatalf("job %s not migrated", alias)
+	}
+
+	// The first attempt to process the job runs until it is interrupted.
+	started := make(chan bool)
+	interrupted := make(chan bool, 1)
+	var attempts int
+	sched := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		if attempts++; attempts > 1 {
+			return nil
+		}
+		close(started)
+		<-ctx.Done()
+		interrupted <- true
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sched.Run(ctx)
+	ctl := &jobctl.Controller{Scheduler: sched}
+
+	if err := ctl.Reprocess(u, job.Id()); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// Reprocessing the job by its alias interrupts the running job.
+	if err := ctl.Reprocess(u, alias); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-interrupted:
+	default:
+		t.Errorf("processing the job was not interrupted")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	from, to, err := jobctl.ParseRange("2024-02-01", "2024-02-29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := from, time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("unexpected start: got %v, want %v", got, want)
+	}
+	if got, want := to, time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("unexpected end: got %v, want %v", got, want)
+	}
+	if _, _, err := jobctl.ParseRange("2024-03-01", "2024-02-01"); err == nil {
+		t.Errorf("ParseRange unexpectedly accepted an empty range")
+	}
+	if _, _, err := jobctl.ParseRange("", ""); err == nil {
+		t.Errorf("ParseRange unexpectedly accepted an unbounded range")
+	}
+	if _, _, err := jobctl.ParseRange("yesterday", ""); err == nil {
+		t.Errorf("ParseRange unexpectedly accepted an invalid date")
+	}
+}
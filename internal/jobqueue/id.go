@@ -0,0 +1,153 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+)
+
+// idLayout is the time layout of the timestamp with which job ids start. Ids
+// are in UTC so that they sort in creation order, and contain only characters
+// which are safe in file names on all file systems (e.g. no colons, which SMB
+// shares reject).
+const idLayout = "2006-01-02T15-04-05.000Z"
+
+// newId returns a new job id for a job created at t, e.g.
+// 2024-01-31T12-34-56.789Z-1a2b3c4d. The random suffix makes ids unique even
+// if jobs are created within the same millisecond, e.g. by two scanners.
+func newId(t time.Time) string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return t.UTC().Format(idLayout) + "-" + hex.EncodeToString(suffix[:])
+}
+
+// parseId returns the creation time of the job with the specified id, unless
+// the id was not returned by newId.
+func parseId(id string) (time.Time, bool) {
+	ts, suffix, ok := strings.Cut(id, "Z-")
+	if !ok || len(suffix) != 8 {
+		return time.Time{}, false
+	}
+	if _, err := hex.DecodeString(suffix); err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(idLayout, ts+"Z")
+	return t, err == nil
+}
+
+// Alias returns the id under which the job was known before Queue.Migrate
+// renamed it, or an empty string.
+func (j *Job) Alias() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.Alias
+}
+
+// DeliveryId returns the id under which the job is delivered to sinks: its
+// alias if it was migrated, so that delivering the job again overwrites (and
+// deleting it from sinks removes) the files delivered before the migration.
+func (j *Job) DeliveryId() string {
+	if alias := j.Alias(); alias != "" {
+		return alias
+	}
+	return j.id
+}
+
+// Resolve returns the id of the job which is known under the alias id (see
+// Queue.Migrate), or id itself.
+func (q *Queue) Resolve(id string) string {
+	if _, err := os.Stat(filepath.Join(q.Dir, id)); err == nil {
+		return id
+	}
+	idx := indexFor(q.Dir)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.load()
+	for _, s := range idx.jobs {
+		if s.Alias == id {
+			return s.Id
+		}
+	}
+	return id
+}
+
+// Migrate renames the directories of jobs which were created by scan2drive
+// versions before collision-free job ids (e.g. 2016-05-09T21:05:02+02:00) to
+// ids as returned by newId. The old ids remain valid as aliases, see Resolve.
+// Migrate must be called before jobs are processed.
+func (q *Queue) Migrate() error {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		old := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(old, ".") {
+			continue // not a job, e.g. the staging directory
+		}
+		if _, ok := parseId(old); ok {
+			continue
+		}
+		id, err := q.migrate(old)
+		if err != nil {
+			return fmt.Errorf("migrating job %s: %v", old, err)
+		}
+		log.Printf("migrated job %s to id %s", old, id)
+	}
+	return nil
+}
+
+func (q *Queue) migrate(old string) (string, error) {
+	job, err := q.JobById(old)
+	if err != nil {
+		return "", err
+	}
+	// Record the new id before renaming, so that the rename is completed
+	// with the same id should scan2drive crash in between.
+	m := job.Manifest()
+	id := m.Id
+	if m.Alias != old {
+		id = newId(m.Created)
+		if err := job.update(func(m *Manifest) {
+			m.Id = id
+			m.Alias = old
+		}); err != nil {
+			return "", err
+		}
+	}
+	if err := atomicfile.Rename(job.dir, filepath.Join(q.Dir, id)); err != nil {
+		return "", err
+	}
+	if err := indexFor(q.Dir).remove(old); err != nil {
+		return "", err
+	}
+	// Reading the job under its new id updates the index.
+	if _, err := q.JobById(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+func TestUniqueIds(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	var ids []string
+	for i := 0; i < 10; i++ {
+		job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("page"))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ContainsAny(job.Id(), `:+/\ `) {
+			t.Errorf("job id %q contains characters which are unsafe in file names", job.Id())
+		}
+		if ids = append(ids, job.Id()); len(ids) > 1 && ids[len(ids)-2][:24] > job.Id()[:24] {
+			t.Errorf("job id %q sorts before the id of the previous job %q", job.Id(), ids[len(ids)-2])
+		}
+	}
+	scans, err := q.Scans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(scans), len(ids); got != want {
+		t.Errorf("unexpected number of jobs: got %d, want %d (ids: %q)", got, want, ids)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	const old = "2016-05-09T21:05:02+02:00"
+	indexedJob(t, q, old, 2)
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("page"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, _, err := q.List(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(summaries), 2; got != want {
+		t.Fatalf("unexpected number of jobs: got %d, want %d", got, want)
+	}
+	if got, want := summaries[0].Id, job.Id(); got != want {
+		t.Errorf("job with new id migrated: got %q, want %q", got, want)
+	}
+	migrated := summaries[1]
+	if got, want := migrated.Alias, old; got != want {
+		t.Errorf("unexpected alias: got %q, want %q", got, want)
+	}
+	created, err := time.Parse(time.RFC3339, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(migrated.Id, "2016-05-09T19-05-02.000Z-") || !migrated.Created.Equal(created) {
+		t.Errorf("migrated job: unexpected id %q (created %v)", migrated.Id, migrated.Created)
+	}
+
+	// The old id remains valid, and the job is delivered under the old id.
+	job, err = q.JobById(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.Id(), migrated.Id; got != want {
+		t.Errorf("job by alias: got id %q, want %q", got, want)
+	}
+	if got, want := job.DeliveryId(), old; got != want {
+		t.Errorf("unexpected delivery id: got %q, want %q", got, want)
+	}
+	if got, want := len(job.Pages()), 2; got != want {
+		t.Errorf("unexpected number of pages: got %d, want %d", got, want)
+	}
+
+	// Migrating again does not change anything.
+	if err := q.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := q.List(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids(again), ids(summaries)) {
+		t.Errorf("ids changed when migrating again: got %q, want %q", ids(again), ids(summaries))
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	const old = "2016-05-09T21:05:02+02:00"
+	indexedJob(t, q, old, 1)
+	if err := q.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.JobById(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash after the new id was recorded, but before the job
+	// directory was renamed.
+	if err := os.Rename(job.Dir(), filepath.Join(q.Dir, old)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(job.Dir()); err != nil {
+		t.Errorf("job not migrated to the recorded id: %v", err)
+	}
+}
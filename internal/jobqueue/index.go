@@ -0,0 +1,393 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+)
+
+// indexVersion is the version of the index.json format. Indexes of a different
+// version are rebuilt from the job directories. Version 2 records when jobs of
+// earlier scan2drive versions were finished.
+const indexVersion = 2
+
+// indexName is the name of the file in the queue directory in which the
+// summaries of all jobs are persisted.
+const indexName = "index.json"
+
+// persistDelay is how long changes to the summaries of jobs which are not done
+// are collected before the index is persisted: processing a job changes its
+// summary with every stage (and page), and each time persisting the index
+// rewrites the summaries of all jobs. Summaries of jobs which are not done are
+// read from their job directories again when the index is loaded (see List),
+// so losing them in a crash is harmless.
+const persistDelay = 10 * time.Second
+
+// Summary is what listing the jobs of a queue shows about each job. Summaries
+// are kept in an index, so that listing does not need to read every job
+// directory.
+type Summary struct {
+	Id         string    `json:"id"`
+	Alias      string    `json:"alias,omitempty"`
+	State      State     `json:"state"`
+	Created    time.Time `json:"created"`
+	NewName    string    `json:"new_name,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Profile    string    `json:"profile,omitempty"`
+	Pages      int       `json:"pages,omitempty"`
+	PDFDriveId string    `json:"pdf_drive_id,omitempty"`
+
+	// Skipped contains the numbers of the pages which were skipped as blank
+	// (see PageRecord.Skipped), in ascending order.
+	Skipped []int `json:"skipped,omitempty"`
+
+	// Thumb is the name of the job’s thumbnail file in the job directory, or
+	// empty if the job has no thumbnail (yet).
+	Thumb string `json:"thumb,omitempty"`
+
+	// Converted and Done correspond to the job’s CompletionMarkers.
+	Converted bool `json:"converted,omitempty"`
+	Done      bool `json:"done,omitempty"`
+
+	Attempts    int       `json:"attempts,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	Finished    time.Time `json:"finished,omitzero"`
+
+	OriginalsPruned bool  `json:"originals_pruned,omitempty"`
+	FilesPruned     bool  `json:"files_pruned,omitempty"`
+	Reclaimed       int64 `json:"reclaimed,omitempty"`
+}
+
+// Waiting returns whether the job waits for its next attempt after a failed
+// attempt, see Job.Waiting.
+func (s Summary) Waiting() bool {
+	return s.State == InProgress && s.NextAttempt.After(time.Now())
+}
+
+// Summary returns the summary of the job, as stored in the queue’s index.
+func (j *Job) Summary() Summary {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.summary()
+}
+
+func (j *Job) summary() Summary {
+	s := Summary{
+		Id:              j.id,
+		Alias:           j.manifest.Alias,
+		State:           j.state,
+		Created:         j.manifest.Created,
+		NewName:         j.NewName,
+		Source:          j.Source,
+		Profile:         j.Profile,
+		Pages:           j.manifest.Pages,
+		PDFDriveId:      j.PDFDriveId,
+		Converted:       j.Markers.Converted,
+		Done:            j.Markers.Done,
+		Attempts:        j.manifest.Attempts,
+		LastError:       j.manifest.lastError(),
+		NextAttempt:     j.manifest.NextAttempt,
+		OriginalsPruned: !j.manifest.OriginalsPruned.IsZero(),
+		FilesPruned:     !j.manifest.FilesPruned.IsZero(),
+		Reclaimed:       j.manifest.Reclaimed,
+	}
+	s.Finished = j.manifest.finished()
+	for num, rec := range j.manifest.PageRecords {
+		if rec.Skipped {
+			s.Skipped = append(s.Skipped, num)
+		}
+	}
+	sort.Ints(s.Skipped)
+	if s.Converted && !s.FilesPruned {
+		s.Thumb = "thumb.png"
+	}
+	return s
+}
+
+// index contains the summaries of all jobs of a queue by id.
+type index struct {
+	mu  sync.Mutex
+	dir string
+
+	// loaded is set once the index was read from disk.
+	loaded bool
+
+	// refreshed is set once the summaries of jobs which were not done when
+	// the index was read were refreshed from their job directories: they
+	// might have changed after the index was last persisted, e.g. right before
+	// a crash.
+	refreshed bool
+
+	jobs map[string]Summary
+
+	// timer persists the index once persistDelay elapsed, if changes are
+	// pending.
+	timer *time.Timer
+}
+
+// indexFile is the format of the index.json file.
+type indexFile struct {
+	Version int       `json:"version"`
+	Jobs    []Summary `json:"jobs"`
+}
+
+// indexes contains the index of each queue by directory: Queues (and Jobs)
+// are created afresh whenever they are needed, but must share the index.
+var indexes = struct {
+	sync.Mutex
+	byDir map[string]*index
+}{byDir: make(map[string]*index)}
+
+func indexFor(dir string) *index {
+	indexes.Lock()
+	defer indexes.Unlock()
+	idx, ok := indexes.byDir[dir]
+	if !ok {
+		idx = &index{
+			dir:  dir,
+			jobs: make(map[string]Summary),
+		}
+		indexes.byDir[dir] = idx
+	}
+	return idx
+}
+
+// load reads the persisted index unless it was read already. A missing or
+// unreadable index is rebuilt by Queue.List.
+func (idx *index) load() {
+	if idx.loaded {
+		return
+	}
+	idx.loaded = true
+	b, err := os.ReadFile(filepath.Join(idx.dir, indexName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("reading job index: %v", err)
+		}
+		return
+	}
+	var f indexFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		log.Printf("%s: %v, rebuilding", filepath.Join(idx.dir, indexName), err)
+		return
+	}
+	if f.Version != indexVersion {
+		return // rebuilt from the job directories
+	}
+	for _, s := range f.Jobs {
+		if _, ok := idx.jobs[s.Id]; ok {
+			continue // updated since the index was persisted
+		}
+		idx.jobs[s.Id] = s
+	}
+}
+
+// persistLater persists the index after persistDelay, unless that is pending
+// already.
+func (idx *index) persistLater() {
+	if idx.timer != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(persistDelay, func() {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		if idx.timer != t {
+			return // persisted in the meantime
+		}
+		if err := idx.persist(); err != nil {
+			log.Printf("updating job index: %v", err)
+		}
+	})
+	idx.timer = t
+}
+
+// persist atomically and durably replaces the persisted index.
+func (idx *index) persist() error {
+	if idx.timer != nil {
+		idx.timer.Stop()
+		idx.timer = nil
+	}
+	f := indexFile{
+		Version: indexVersion,
+		Jobs:    make([]Summary, 0, len(idx.jobs)),
+	}
+	for _, s := range idx.jobs {
+		f.Jobs = append(f.Jobs, s)
+	}
+	sort.Slice(f.Jobs, func(i, k int) bool { return f.Jobs[i].Id < f.Jobs[k].Id })
+	b, err := json.Marshal(&f)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(idx.dir, indexName), b, 0600)
+}
+
+// put stores the summary of a job in the index. If the summary changed, the
+// index is persisted: right away if the job is (or was) done, otherwise after
+// persistDelay.
+func (idx *index) put(s Summary) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.load()
+	old, ok := idx.jobs[s.Id]
+	if ok && equalSummaries(old, s) {
+		return nil
+	}
+	idx.jobs[s.Id] = s
+	if s.State != Done && (!ok || old.State != Done) {
+		idx.persistLater()
+		return nil
+	}
+	return idx.persist()
+}
+
+// remove removes the summary of a job from the index. The index is persisted
+// after persistDelay: jobs whose directory is missing are dropped when the
+// index is loaded (see List).
+func (idx *index) remove(id string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.load()
+	if _, ok := idx.jobs[id]; !ok {
+		return nil
+	}
+	delete(idx.jobs, id)
+	idx.persistLater()
+	return nil
+}
+
+// equalSummaries compares the serialized summaries, which (unlike comparing
+// with ==) ignores the monotonic clock readings and locations of time.Time.
+func equalSummaries(a, b Summary) bool {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// index updates the job’s summary in the index of its queue. Errors are only
+// logged: the job directory is authoritative, and the index is rebuilt from it
+// where needed.
+func (j *Job) index() {
+	if err := indexFor(filepath.Dir(j.dir)).put(j.summary()); err != nil {
+		log.Printf("job %s: updating index: %v", j.id, err)
+	}
+}
+
+// List returns the summaries of at most limit jobs (all jobs if limit is 0),
+// newest first, starting at offset, and the total number of jobs. Only the
+// queue directory itself is read: job directories are read only if their job
+// is missing from the index, e.g. when listing a queue for the first time.
+func (q *Queue) List(offset, limit int) ([]Summary, int, error) {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue // not a job, e.g. the staging directory
+		}
+		present[entry.Name()] = true
+	}
+
+	idx := indexFor(q.Dir)
+	idx.mu.Lock()
+	idx.load()
+	var (
+		missing []string
+		removed bool
+	)
+	for id, s := range idx.jobs {
+		if !present[id] {
+			// The job directory was removed behind scan2drive’s back.
+			delete(idx.jobs, id)
+			removed = true
+		} else if !idx.refreshed && s.State != Done {
+			missing = append(missing, id)
+		}
+	}
+	idx.refreshed = true
+	for id := range present {
+		if _, ok := idx.jobs[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	idx.mu.Unlock()
+
+	// Reading the jobs updates the index (see Job.index).
+	for _, id := range missing {
+		if _, err := q.JobById(id); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	idx.mu.Lock()
+	if removed || len(missing) > 0 {
+		// Persist the rebuilt summaries in one go.
+		if err := idx.persist(); err != nil {
+			log.Printf("updating job index: %v", err)
+		}
+	}
+	summaries := make([]Summary, 0, len(present))
+	for id := range present {
+		if s, ok := idx.jobs[id]; ok {
+			summaries = append(summaries, s)
+		}
+	}
+	idx.mu.Unlock()
+	sort.Slice(summaries, func(i, k int) bool { return summaries[i].Id > summaries[k].Id })
+
+	total := len(summaries)
+	if offset > total {
+		offset = total
+	}
+	summaries = summaries[offset:]
+	if limit > 0 && limit < len(summaries) {
+		summaries = summaries[:limit]
+	}
+	return summaries, total, nil
+}
+
+// Reclaimed returns the number of bytes which were removed by pruning all jobs
+// of the queue, as of the last List call.
+func (q *Queue) Reclaimed() int64 {
+	idx := indexFor(q.Dir)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.load()
+	var total int64
+	for _, s := range idx.jobs {
+		total += s.Reclaimed
+	}
+	return total
+}
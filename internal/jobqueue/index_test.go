@@ -0,0 +1,200 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+)
+
+// indexedJob creates a job directory named id containing pages.
+func indexedJob(t *testing.T, q *jobqueue.Queue, id string, pages int) *jobqueue.Job {
+	dir := filepath.Join(q.Dir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= pages; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("page%d.jpg", i))
+		if err := os.WriteFile(fn, testJPEG("page"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job, err := q.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitMarker("scan"); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func ids(summaries []jobqueue.Summary) []string {
+	var ids []string
+	for _, s := range summaries {
+		ids = append(ids, s.Id)
+	}
+	return ids
+}
+
+func TestList(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	indexedJob(t, q, "2024-01-01T10:00:00Z", 1)
+	second := indexedJob(t, q, "2024-01-02T10:00:00Z", 2)
+	indexedJob(t, q, "2024-01-03T10:00:00Z", 3)
+
+	// Jobs are listed newest first.
+	summaries, total, err := q.List(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := total, 3; got != want {
+		t.Errorf("unexpected total: got %d, want %d", got, want)
+	}
+	if got, want := ids(summaries), []string{"2024-01-03T10:00:00Z", "2024-01-02T10:00:00Z"}; !slices.Equal(got, want) {
+		t.Errorf("unexpected first page: got %q, want %q", got, want)
+	}
+	summaries, _, err = q.List(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(summaries), []string{"2024-01-01T10:00:00Z"}; !slices.Equal(got, want) {
+		t.Errorf("unexpected second page: got %q, want %q", got, want)
+	}
+
+	// Updating a job updates its summary.
+	if err := second.AddDerivedFile("scan.pdf", []byte(testPDF)); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.CommitMarker("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.WritePDFDriveID("drive-id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.CommitMarker("done"); err != nil {
+		t.Fatal(err)
+	}
+	summaries, _, err = q.List(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := jobqueue.Summary{
+		Id:         second.Id(),
+		State:      jobqueue.Done,
+		Pages:      2,
+		PDFDriveId: "drive-id",
+		Thumb:      "thumb.png",
+		Converted:  true,
+		Done:       true,
+	}
+	got := summaries[0]
+	if got.Created.IsZero() || got.Finished.IsZero() {
+		t.Errorf("summary lacks creation or finishing time: %+v", got)
+	}
+	got.Created, got.Finished = want.Created, want.Finished
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected summary: got %+v, want %+v", got, want)
+	}
+
+	// Listing does not read the job directories of indexed jobs.
+	if err := os.WriteFile(filepath.Join(second.Dir(), "job.json"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := q.List(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs whose directory was removed are dropped from the index, and jobs
+	// whose directory was added are added.
+	if err := os.RemoveAll(second.Dir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete("2024-01-03T10:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	indexedJob(t, q, "2024-01-04T10:00:00Z", 1)
+	if err := os.Remove(filepath.Join(q.Dir, "index.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(q.Dir, "2024-01-05T10:00:00Z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	summaries, total, err = q.List(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(summaries), []string{"2024-01-05T10:00:00Z", "2024-01-04T10:00:00Z", "2024-01-01T10:00:00Z"}; !slices.Equal(got, want) || total != len(want) {
+		t.Errorf("unexpected jobs: got %q (total %d), want %q", got, total, want)
+	}
+	if got, want := summaries[0].State, jobqueue.Canceled; got != want {
+		t.Errorf("job without scan marker: unexpected state: got %v, want %v", got, want)
+	}
+	// The index is persisted again.
+	if _, err := os.Stat(filepath.Join(q.Dir, "index.json")); err != nil {
+		t.Errorf("index not persisted: %v", err)
+	}
+}
+
+func TestIndexPersistence(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job := indexedJob(t, q, "2024-01-01T10:00:00Z", 1)
+	if _, _, err := q.List(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	indexFile := filepath.Join(q.Dir, "index.json")
+	persisted, err := os.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Progress of jobs which are not done is not persisted right away, but
+	// listed nevertheless.
+	if err := job.StageStarted("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.StageFailed("convert", fmt.Errorf("out of memory")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(indexFile); err != nil || string(b) != string(persisted) {
+		t.Errorf("index persisted for progress of a job which is not done (err: %v)", err)
+	}
+	summaries, _, err := q.List(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summaries[0].LastError; got == "" {
+		t.Errorf("last error of job not listed")
+	}
+
+	// Finishing a job persists the index.
+	if err := job.CommitMarker("done"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"done":true`) {
+		t.Errorf("index not persisted for finished job: %s", b)
+	}
+}
@@ -21,13 +21,21 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
 	"github.com/stapelberg/scan2drive/internal/page"
 )
 
 type Queue struct {
 	Dir string
+
+	// User is the sub of the user to whom the queue belongs.
+	User string
 }
 
 type State int
@@ -40,42 +48,106 @@ func (s State) String() string {
 		return "InProgress"
 	case Done:
 		return "Done"
+	case Failed:
+		return "Failed"
 	default:
 		return "<unknown>"
 	}
 }
 
 const (
+	// Canceled jobs were either canceled by the user, or not completely
+	// ingested (e.g. because scan2drive crashed while scanning).
 	Canceled State = iota
 	InProgress
 	Done
+
+	// Failed jobs are not processed until they are retried manually (see
+	// Job.Retry).
+	Failed
 )
 
 type CompletionMarkers struct {
-	UploadedOriginals bool
-	Converted         bool
-	UploadedPDF       bool
-	Renamed           bool
+	// Converted is set once the PDF was written, i.e. once the stage which
+	// writes scan.pdf (see Manifest.PDFStage) completed.
+	Converted bool
+	Renamed   bool
+	Done      bool
+
+	// Sinks contains the ids of all sinks to which the job was delivered.
+	Sinks map[string]bool
+
+	// Stages contains the names of all completed processing stages.
+	Stages map[string]bool
 }
 
 type Job struct {
-	id         string
-	dir        string
-	state      State
-	curpage    int
-	pages      []*page.Any
+	// mu serializes updates of the job state, which processing stages might
+	// trigger concurrently.
+	mu sync.Mutex
+
+	id       string
+	dir      string
+	user     string
+	manifest Manifest
+
+	state   State
+	curpage int
+	pages   []*page.Any
+
+	// The following fields are derived from the manifest.
+
 	Markers    CompletionMarkers
 	NewName    string
 	PDFDriveId string
+
+	// Source is the id of the scan source which produced the job, if known.
+	Source string
+
+	// Profile is the name of the processing profile, empty for the default.
+	Profile string
+}
+
+// newJob returns a job with a new id (see newId), whose directory is created
+// by calling mkdir. Should a job of the same id exist already, mkdir must fail
+// with an error satisfying os.IsExist, and is retried with another id.
+func (q *Queue) newJob(mkdir func(dir string) error) (*Job, error) {
+	now := time.Now()
+	for attempt := 0; ; attempt++ {
+		id := newId(now)
+		job := &Job{
+			id:   id,
+			dir:  filepath.Join(q.Dir, id),
+			user: q.User,
+			manifest: Manifest{
+				Version: ManifestVersion,
+				Id:      id,
+				User:    q.User,
+				Created: now,
+			},
+		}
+		err := mkdir(job.dir)
+		if err == nil {
+			return job, nil
+		}
+		if !os.IsExist(err) || attempt == 9 {
+			return nil, err
+		}
+	}
 }
 
+// AddJob adds a job consisting of pages to the queue. To add jobs page by page
+// as they are scanned, use NewStaging instead.
 func (q *Queue) AddJob(pages []*page.Any) (*Job, error) {
-	id := time.Now().Format(time.RFC3339)
-	dir := filepath.Join(q.Dir, id)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	job, err := q.newJob(func(dir string) error {
+		return os.Mkdir(dir, 0755)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.SyncDir(q.Dir); err != nil {
 		return nil, err
 	}
-	job := &Job{id: id, dir: dir}
 	for _, page := range pages {
 		if err := job.addPage(page); err != nil {
 			return nil, err
@@ -88,6 +160,8 @@ func (q *Queue) AddJob(pages []*page.Any) (*Job, error) {
 	return job, nil
 }
 
+// Scans reads all jobs of the queue. To show jobs, use List instead, which does
+// not need to read every job directory.
 func (q *Queue) Scans() (map[string]*Job, error) {
 	entries, err := ioutil.ReadDir(q.Dir)
 	if err != nil {
@@ -95,8 +169,8 @@ func (q *Queue) Scans() (map[string]*Job, error) {
 	}
 	jobs := make(map[string]*Job)
 	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue // not a job, e.g. the staging directory
 		}
 		job, err := q.JobById(entry.Name())
 		if err != nil {
@@ -107,81 +181,228 @@ func (q *Queue) Scans() (map[string]*Job, error) {
 	return jobs, nil
 }
 
+func validId(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("invalid job id %q", id)
+	}
+	return nil
+}
+
 func (q *Queue) JobById(id string) (*Job, error) {
+	if err := validId(id); err != nil {
+		return nil, err
+	}
+	id = q.Resolve(id)
 	dir := filepath.Join(q.Dir, id)
 	job := &Job{
-		id:  id,
-		dir: dir,
+		id:   id,
+		dir:  dir,
+		user: q.User,
 	}
 	if err := job.readStateFromDir(); err != nil {
 		return nil, err
 	}
 
-	if job.Markers.UploadedPDF {
-		job.state = Done
+	if job.state == InProgress || job.state == Failed {
+		if err := job.validate(); err != nil {
+			return nil, fmt.Errorf("job %s: validating: %v", id, err)
+		}
 	}
 
 	// load pages back into memory if the job is still in progress
-	if job.state == InProgress {
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
+	if job.state == InProgress || job.state == Failed {
+		if err := job.loadPages(); err != nil {
 			return nil, err
 		}
-		for _, file := range files {
-			if filepath.Ext(file.Name()) != ".jpg" {
-				continue
-			}
-			if file.Size() == 0 {
-				continue
-			}
-			b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
-			if err != nil {
-				return nil, err
+	}
+	return job, nil
+}
+
+// loadPages references the pages stored in the job directory, which are read
+// on demand (see page.FromFile).
+func (j *Job) loadPages() error {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	binarized := make(map[string]bool)
+	for _, file := range files {
+		switch filepath.Ext(file.Name()) {
+		case ".jpg":
+			if file.Size() > 0 {
+				names = append(names, file.Name())
 			}
-			job.pages = append(job.pages, page.JPEGPageFromBytes(b))
+		case ".png":
+			binarized[strings.TrimSuffix(file.Name(), ".png")] = true
+		}
+	}
+	// Sort page10.jpg after page9.jpg:
+	sort.SliceStable(names, func(i, k int) bool {
+		ni, iok := pageNum(names[i])
+		nk, kok := pageNum(names[k])
+		if iok && kok {
+			return ni < nk
+		}
+		return names[i] < names[k]
+	})
+	j.pages = nil
+	for _, name := range names {
+		var binarizedPath string
+		if base := strings.TrimSuffix(name, ".jpg"); binarized[base] {
+			binarizedPath = filepath.Join(j.dir, base+".png")
 		}
+		j.pages = append(j.pages, page.FromFile(filepath.Join(j.dir, name), binarizedPath))
+	}
+	return nil
+}
+
+// pageNum returns the number of the page stored in page<num>.jpg.
+func pageNum(name string) (int, bool) {
+	num, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "page"), ".jpg"))
+	return num, err == nil && strings.HasPrefix(name, "page")
+}
+
+// Cancel moves the job with the specified id into state Canceled. Jobs which
+// are currently being processed need to be interrupted, too (see
+// scheduler.Scheduler.Cancel).
+func (q *Queue) Cancel(id string) (*Job, error) {
+	job, err := q.JobById(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := job.Cancel(); err != nil {
+		return nil, err
 	}
 	return job, nil
 }
 
+// Delete removes the job with the specified id, including all of its files,
+// from the queue. Jobs must not be processed while they are deleted.
+func (q *Queue) Delete(id string) error {
+	if err := validId(id); err != nil {
+		return err
+	}
+	id = q.Resolve(id)
+	dir := filepath.Join(q.Dir, id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := atomicfile.SyncDir(q.Dir); err != nil {
+		return err
+	}
+	return indexFor(q.Dir).remove(id)
+}
+
+// readStateFromDir reads the job’s manifest, migrating job directories
+// written by earlier versions of scan2drive.
 func (j *Job) readStateFromDir() error {
+	defer lockManifest(j.dir)()
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	entries, err := ioutil.ReadDir(j.dir)
 	if err != nil {
 		return err
 	}
+	m, err := readManifest(j.dir)
+	if err != nil {
+		return err
+	}
+	changed, err := j.migrate(&m, entries)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := writeManifest(j.dir, &m); err != nil {
+			return err
+		}
+	}
+	j.manifest = m
+	j.derive()
+	j.index()
+	return nil
+}
+
+// derive updates the job state from the manifest.
+func (j *Job) derive() {
 	j.state = Canceled // zero value
-	for _, entry := range entries {
-		if entry.Name() == "COMPLETE.scan" {
+	j.Markers = CompletionMarkers{
+		Sinks:  make(map[string]bool),
+		Stages: make(map[string]bool),
+	}
+	for name, rec := range j.manifest.Stages {
+		if rec.Completed.IsZero() {
+			continue
+		}
+		j.Markers.Stages[name] = true
+		if name == "scan" {
 			j.state = InProgress
-		} else if entry.Name() == "COMPLETE.convert" {
+		} else if j.manifest.pdfStage(name) {
 			j.Markers.Converted = true
-		} else if entry.Name() == "COMPLETE.uploadoriginals" {
-			j.Markers.UploadedOriginals = true
-		} else if entry.Name() == "COMPLETE.uploadpdf" {
-			j.Markers.UploadedPDF = true
-		} else if entry.Name() == "COMPLETE.rename" {
+		} else if name == "done" {
+			j.Markers.Done = true
+		} else if name == "uploadoriginals" {
+			// Written by scan2drive versions before sinks were pluggable.
+			j.Markers.Sinks["driveoriginals"] = true
+			j.Markers.Stages["sink.driveoriginals"] = true
+		} else if name == "uploadpdf" {
+			// Written by scan2drive versions before sinks were pluggable, in
+			// which uploading the PDF to Google Drive was the last step.
+			j.Markers.Sinks["drive"] = true
+			j.Markers.Stages["sink.drive"] = true
+			j.Markers.Done = true
+		} else if strings.HasPrefix(name, "sink.") {
+			j.Markers.Sinks[strings.TrimPrefix(name, "sink.")] = true
+		} else if name == "rename" {
 			j.Markers.Renamed = true
-		} else if entry.Name() == "rename" {
-			content, err := os.ReadFile(filepath.Join(j.dir, "rename"))
-			if err != nil {
-				return err
-			}
-			j.NewName = string(content)
-		} else if entry.Name() == "pdf.drive_id" {
-			content, err := os.ReadFile(filepath.Join(j.dir, "pdf.drive_id"))
-			if err != nil {
-				return err
-			}
-			j.PDFDriveId = string(content)
 		}
 	}
-	return nil
+	if j.Markers.Done {
+		j.state = Done
+	} else if j.manifest.Canceled {
+		j.state = Canceled
+	} else if j.state == InProgress && j.manifest.Failed {
+		j.state = Failed
+	}
+	j.NewName = j.manifest.NewName
+	j.PDFDriveId = j.manifest.PDFDriveId
+	j.Source = j.manifest.Source
+	j.Profile = j.manifest.Profile
 }
 
 func (j *Job) Id() string {
 	return j.id
 }
 
+// Dir returns the directory in which the job’s files are stored.
+func (j *Job) Dir() string {
+	return j.dir
+}
+
+// Created returns the time at which the job was added to the queue.
+func (j *Job) Created() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.Created
+}
+
+func (j *Job) createdFromDir() time.Time {
+	if t, ok := parseId(j.id); ok {
+		return t
+	}
+	t, err := time.Parse(time.RFC3339, j.id)
+	if err != nil {
+		// Job directories created by scan.sh are named differently.
+		if fi, err := os.Stat(j.dir); err == nil {
+			return fi.ModTime()
+		}
+	}
+	return t
+}
+
 func (j *Job) State() State {
 	return j.state
 }
@@ -192,15 +413,18 @@ func (j *Job) Pages() []*page.Any {
 
 func (j *Job) addPage(page *page.Any) error {
 	j.curpage++
-	fn := filepath.Join(j.dir, fmt.Sprintf("page%d.jpg", j.curpage))
-	b, err := page.JPEGBytes()
+	base := filepath.Join(j.dir, fmt.Sprintf("page%d", j.curpage))
+	stored, err := page.WriteFiles(base+".jpg", base+".png")
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(fn, b, 0600); err != nil {
-		return err
+	j.pages = append(j.pages, stored)
+	if page.SkewHint != nil {
+		j.manifest.page(j.curpage).SkewHint = page.SkewHint
+	}
+	if page.DPI != 0 {
+		j.manifest.page(j.curpage).DPI = page.DPI
 	}
-	j.pages = append(j.pages, page)
 	return nil
 }
 
@@ -216,22 +440,65 @@ func (j *Job) Filenames() ([]string, error) {
 	return filenames, nil
 }
 
+// ReadDerivedFile returns the contents of a file previously stored using
+// AddDerivedFile.
+func (j *Job) ReadDerivedFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(j.dir, name))
+}
+
+// AddDerivedFile stores a file in the job directory. The file is replaced
+// atomically and durably (see atomicfile), so that a crash never leaves a
+// partially written file behind.
 func (j *Job) AddDerivedFile(name string, contents []byte) error {
-	fn := filepath.Join(j.dir, name)
-	if err := os.WriteFile(fn, contents, 0600); err != nil {
+	return atomicfile.WriteFile(filepath.Join(j.dir, name), contents, 0600)
+}
+
+// RemoveDerivedFile removes a file previously stored using AddDerivedFile, if
+// present.
+func (j *Job) RemoveDerivedFile(name string) error {
+	if err := os.Remove(filepath.Join(j.dir, name)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
+// CommitMarker records that the processing stage with the specified name
+// completed. The COMPLETE.<name> marker file is the commit point; should
+// scan2drive crash before updating job.json, the marker is merged when the job
+// is read again.
 func (j *Job) CommitMarker(name string) error {
-	if err := os.WriteFile(filepath.Join(j.dir, "COMPLETE."+name), nil, 0600); err != nil {
+	if err := atomicfile.WriteFile(filepath.Join(j.dir, "COMPLETE."+name), nil, 0600); err != nil {
 		return err
 	}
-	return j.readStateFromDir()
+	return j.update(func(m *Manifest) {
+		m.stage(name).Completed = time.Now()
+	})
+}
+
+// Delivered returns whether the job was delivered to the sink with the
+// specified id.
+func (j *Job) Delivered(sinkId string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Markers.Sinks[sinkId]
+}
+
+// Completed returns whether the processing stage with the specified name
+// completed, i.e. it was committed using CommitMarker.
+func (j *Job) Completed(stage string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Markers.Stages[stage]
+}
+
+// CommitDelivery records that the job was delivered to the sink with the
+// specified id.
+func (j *Job) CommitDelivery(sinkId string) error {
+	return j.CommitMarker("sink." + sinkId)
 }
 
 func (j *Job) commit() error {
+	j.manifest.Pages = len(j.pages)
 	if err := j.CommitMarker("scan"); err != nil {
 		return err
 	}
@@ -241,9 +508,21 @@ func (j *Job) commit() error {
 }
 
 func (j *Job) WritePDFDriveID(driveId string) error {
-	fn := filepath.Join(j.dir, "pdf.drive_id")
-	if err := os.WriteFile(fn, []byte(driveId), 0600); err != nil {
-		return err
-	}
-	return j.readStateFromDir()
+	return j.update(func(m *Manifest) {
+		m.PDFDriveId = driveId
+	})
+}
+
+// SetSource records the id of the scan source which produced the job.
+func (j *Job) SetSource(source string) error {
+	return j.update(func(m *Manifest) {
+		m.Source = source
+	})
+}
+
+// SetProfile records the name of the processing profile of the job.
+func (j *Job) SetProfile(profile string) error {
+	return j.update(func(m *Manifest) {
+		m.Profile = profile
+	})
 }
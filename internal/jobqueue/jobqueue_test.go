@@ -15,12 +15,33 @@
 package jobqueue_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/stapelberg/scan2drive/internal/jobqueue"
 	"github.com/stapelberg/scan2drive/internal/page"
 )
 
+// testJPEG returns a small, valid JPEG file which contains contents in a
+// comment, so that pages can be told apart.
+func testJPEG(contents string) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)), nil); err != nil {
+		panic(err)
+	}
+	b := buf.Bytes()
+	com := []byte{0xff, 0xfe, byte((len(contents) + 2) >> 8), byte(len(contents) + 2)}
+	return slices.Concat(b[:2], com, []byte(contents), b[2:])
+}
+
 func TestJobQueue(t *testing.T) {
 	dir := t.TempDir()
 	jobId := func() string {
@@ -28,7 +49,7 @@ func TestJobQueue(t *testing.T) {
 			Dir: dir,
 		}
 
-		b := []byte("hello world")
+		b := testJPEG("hello world")
 		job, err := defaultQueue.AddJob([]*page.Any{page.JPEGPageFromBytes(b)})
 		if err != nil {
 			t.Fatal(err)
@@ -49,3 +70,451 @@ func TestJobQueue(t *testing.T) {
 		t.Fatalf("unexpected number of pages: got %v, want %v", got, want)
 	}
 }
+
+func TestSinkMarkers(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("hello world"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitDelivery("nas"); err != nil {
+		t.Fatal(err)
+	}
+	if !job.Delivered("nas") {
+		t.Errorf("job not delivered to sink nas after CommitDelivery")
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Fatalf("unexpected job state: got %v, want %v", got, want)
+	}
+	if err := job.CommitMarker("done"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Done; got != want {
+		t.Fatalf("unexpected job state: got %v, want %v", got, want)
+	}
+}
+
+func TestLegacyMarkers(t *testing.T) {
+	dir := t.TempDir()
+	const id = "2016-05-09T21:05:02+02:00"
+	for _, fn := range []string{
+		"page1.jpg",
+		"COMPLETE.scan",
+		"COMPLETE.convert",
+		"COMPLETE.uploadoriginals",
+		"COMPLETE.uploadpdf",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := &jobqueue.Queue{Dir: dir}
+	job, err := q.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Done; got != want {
+		t.Fatalf("unexpected job state: got %v, want %v", got, want)
+	}
+	for _, sinkId := range []string{"driveoriginals", "drive"} {
+		if !job.Delivered(sinkId) {
+			t.Errorf("legacy job not delivered to sink %q", sinkId)
+		}
+	}
+	// The processing stages of the default profile are complete, too.
+	for _, stage := range []string{"convert", "sink.driveoriginals", "sink.drive"} {
+		if !job.Completed(stage) {
+			t.Errorf("legacy job: stage %q not completed", stage)
+		}
+	}
+}
+
+func TestManifestMigration(t *testing.T) {
+	dir := t.TempDir()
+	const id = "2016-05-09T21:05:02+02:00"
+	for fn, content := range map[string]string{
+		"page1.jpg":       string(testJPEG("")),
+		"COMPLETE.scan":   "",
+		"COMPLETE.rename": "",
+		"rename":          "invoice",
+		"pdf.drive_id":    "0B1234",
+		"source":          "fss500",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := &jobqueue.Queue{Dir: dir, User: "123"}
+	if _, err := q.JobById(id); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, id, "job.json"))
+	if err != nil {
+		t.Fatalf("job.json not written during migration: %v", err)
+	}
+	var m jobqueue.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	created, err := time.Parse(time.RFC3339, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Version, jobqueue.ManifestVersion; got != want {
+		t.Errorf("unexpected manifest version: got %d, want %d", got, want)
+	}
+	if !m.Created.Equal(created) {
+		t.Errorf("unexpected creation time: got %v, want %v", m.Created, created)
+	}
+	for _, tt := range []struct{ field, got, want string }{
+		{"id", m.Id, id},
+		{"user", m.User, "123"},
+		{"new name", m.NewName, "invoice"},
+		{"PDF drive id", m.PDFDriveId, "0B1234"},
+		{"source", m.Source, "fss500"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("unexpected %s: got %q, want %q", tt.field, tt.got, tt.want)
+		}
+	}
+	for _, stage := range []string{"scan", "rename"} {
+		if rec := m.Stages[stage]; rec == nil || rec.Completed.IsZero() {
+			t.Errorf("stage %q not completed in migrated manifest", stage)
+		}
+	}
+
+	// Markers committed without updating job.json (e.g. because of a crash)
+	// are merged, too.
+	if err := os.WriteFile(filepath.Join(dir, id, "COMPLETE.done"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Done; got != want {
+		t.Fatalf("unexpected job state: got %v, want %v", got, want)
+	}
+	if got, want := job.NewName, "invoice"; got != want {
+		t.Errorf("unexpected new name: got %q, want %q", got, want)
+	}
+}
+
+func TestManifestHistory(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir(), User: "123"}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("hello world"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetSource("http"); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.StageStarted("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.StageFailed("convert", fmt.Errorf("out of memory")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.LastError(), `stage "convert" (attempt 1): out of memory`; got != want {
+		t.Errorf("unexpected last error: got %q, want %q", got, want)
+	}
+	if err := job.StageStarted("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitMarker("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if got := job.LastError(); got != "" {
+		t.Errorf("unexpected last error after completion: %q", got)
+	}
+
+	// The history is persisted.
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := job.Manifest()
+	if got, want := m.Source, "http"; got != want {
+		t.Errorf("unexpected source: got %q, want %q", got, want)
+	}
+	rec := m.Stages["convert"]
+	if rec == nil {
+		t.Fatalf("no history for stage convert: %+v", m.Stages)
+	}
+	if got, want := rec.Attempts, 2; got != want {
+		t.Errorf("unexpected number of attempts: got %d, want %d", got, want)
+	}
+	if got, want := rec.Failures, 1; got != want {
+		t.Errorf("unexpected number of failures: got %d, want %d", got, want)
+	}
+	if got, want := rec.LastError, "out of memory"; got != want {
+		t.Errorf("unexpected last error: got %q, want %q", got, want)
+	}
+	if rec.Completed.IsZero() {
+		t.Errorf("stage convert not completed")
+	}
+}
+
+func TestManifestConcurrentJobs(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir(), User: "123"}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("hello world"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// E.g. the scheduler processes the job while the user rotates a page.
+	other, err := q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.StageStarted("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.UpdatePage(1, func(rec *jobqueue.PageRecord) {
+		rotation := 90
+		rec.ForcedRotation = &rotation
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitMarker("convert"); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := job.Manifest()
+	if rec := m.Stages["convert"]; rec == nil || rec.Attempts != 1 || rec.Completed.IsZero() {
+		t.Errorf("unexpected history of stage convert: %+v", rec)
+	}
+	if rec := m.PageRecords[1]; rec == nil || rec.ForcedRotation == nil {
+		t.Errorf("forced rotation of page 1 lost: %+v", rec)
+	}
+}
+
+func TestManifestNewerVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "job"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "job", "job.json"), []byte(`{"version": 999}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	q := &jobqueue.Queue{Dir: dir}
+	if _, err := q.JobById("job"); err == nil {
+		t.Errorf("JobById unexpectedly succeeded for job.json of a newer version")
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("first page"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range []string{"convert", "sink.drive", "done"} {
+		if err := job.CommitMarker(marker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := job.WritePDFDriveID("drive-id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Done jobs are read without their pages.
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Done; got != want {
+		t.Fatalf("unexpected job state: got %v, want %v", got, want)
+	}
+	if err := job.Reprocess(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reset persists, also across markers merged when reading the job.
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+	if job.Markers.Converted || job.Markers.Done || job.Delivered("drive") {
+		t.Errorf("markers not reset: %+v", job.Markers)
+	}
+	if got, want := len(job.Pages()), 1; got != want {
+		t.Errorf("unexpected number of pages: got %d, want %d", got, want)
+	}
+	// The Drive file is updated instead of uploading a new one.
+	if got, want := job.PDFDriveId, "drive-id"; got != want {
+		t.Errorf("unexpected PDF Drive id: got %q, want %q", got, want)
+	}
+	if rec := job.Manifest().Stages["convert"]; rec == nil || !rec.Completed.IsZero() {
+		t.Errorf("convert stage not reset: %+v", rec)
+	}
+}
+
+func TestStaging(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+
+	// An abandoned staged job is removed when staging the next job.
+	abandoned, err := q.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := abandoned.AddPage(page.JPEGPageFromBytes(testJPEG("abandoned"))); err != nil {
+		t.Fatal(err)
+	}
+	staged, err := filepath.Glob(filepath.Join(q.Dir, ".staging", "*"))
+	if err != nil || len(staged) != 1 {
+		t.Fatalf("unexpected staging directories: %q (err: %v)", staged, err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(staged[0], old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := q.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(staged[0]); !os.IsNotExist(err) {
+		t.Errorf("abandoned staged job not removed: %v", err)
+	}
+	s.Source = "fss500!usb"
+	s.Profile = "receipts"
+
+	// Pages arrive last page first, as with the ScanSnap iX500.
+	bin := image.NewGray(image.Rect(0, 0, 4, 2))
+	bin.Pix = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0}
+	for i := 11; i > 0; i-- {
+		b := testJPEG(fmt.Sprintf("page %d", i))
+		pg := page.JPEGPageFromBytes(b)
+		if i == 1 {
+			pg = page.Binarized(b, bin, 0.75)
+			skew := 1.5
+			pg.SkewHint = &skew
+			pg.DPI = 600
+		}
+		if err := s.AddPage(pg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Reverse()
+	job, err := s.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scans, err := q.Scans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scans) != 1 || scans[job.Id()] == nil {
+		t.Fatalf("unexpected scans: %v", scans)
+	}
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+	if job.Source != "fss500!usb" || job.Profile != "receipts" {
+		t.Errorf("unexpected source/profile: got %q/%q", job.Source, job.Profile)
+	}
+	// The skew measured by the scanner stays with its page.
+	if hint := job.PageRecord(1).SkewHint; hint == nil || *hint != 1.5 {
+		t.Errorf("skew hint of page 1 not recorded: %v", hint)
+	}
+	if got, want := job.PageRecord(1).DPI, 600; got != want {
+		t.Errorf("unexpected resolution of page 1: got %d, want %d", got, want)
+	}
+	if hint := job.PageRecord(11).SkewHint; hint != nil {
+		t.Errorf("page 11 unexpectedly has a skew hint: %v", *hint)
+	}
+	pages := job.Pages()
+	if got, want := len(pages), 11; got != want {
+		t.Fatalf("unexpected number of pages: got %d, want %d", got, want)
+	}
+	for idx, pg := range pages {
+		b, err := pg.JPEGBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), string(testJPEG(fmt.Sprintf("page %d", idx+1))); got != want {
+			t.Errorf("page %d: got %q, want %q", idx+1, got, want)
+		}
+	}
+	// The binarization of the scanner is retained.
+	got, whitePct, err := pages[0].Binarized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Pix, bin.Pix) || whitePct != 0.75 {
+		t.Errorf("unexpected binarized page: got %v (%f white), want %v (0.75 white)", got.Pix, whitePct, bin.Pix)
+	}
+
+	discarded, err := q.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := discarded.AddPage(page.JPEGPageFromBytes(testJPEG("discarded"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := discarded.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(q.Dir, ".staging", "*")); len(staged) > 0 {
+		t.Errorf("staging directories left behind: %q", staged)
+	}
+}
+
+func TestStagingCommitFailed(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	s, err := q.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"page 1", "page 2"} {
+		if err := s.AddPage(page.JPEGPageFromBytes(testJPEG(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staged, err := filepath.Glob(filepath.Join(q.Dir, ".staging", "*", "staged2.jpg"))
+	if err != nil || len(staged) != 1 {
+		t.Fatalf("unexpected staged pages: %q (err: %v)", staged, err)
+	}
+	if err := os.Remove(staged[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Commit(); err == nil {
+		t.Fatalf("Commit unexpectedly succeeded despite missing page")
+	}
+
+	// The remaining pages are kept, even once they are old enough to be
+	// considered abandoned.
+	kept, err := filepath.Glob(filepath.Join(q.Dir, ".staging", "failed-*"))
+	if err != nil || len(kept) != 1 {
+		t.Fatalf("staged job which could not be committed not kept: %q (err: %v)", kept, err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(kept[0], old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.NewStaging(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(kept[0], "page1.jpg")); err != nil {
+		t.Errorf("staged page of job which could not be committed removed: %v", err)
+	}
+}
@@ -0,0 +1,551 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+)
+
+// ManifestVersion is the version of the job.json format written by this
+// version of scan2drive.
+const ManifestVersion = 1
+
+const manifestName = "job.json"
+
+// Manifest is the state and history of a job, persisted in the job.json file
+// in the job directory.
+type Manifest struct {
+	Version int `json:"version"`
+
+	Id string `json:"id"`
+
+	// Alias is the id of the job before it was migrated to a new id (see
+	// Queue.Migrate).
+	Alias string `json:"alias,omitempty"`
+
+	// User is the sub of the user to whose queue the job belongs.
+	User string `json:"user,omitempty"`
+
+	// Source is the id of the scan source which produced the job, if known.
+	Source string `json:"source,omitempty"`
+
+	// Profile is the name of the processing profile, empty for the default.
+	Profile string `json:"profile,omitempty"`
+
+	Created time.Time `json:"created"`
+	NewName string    `json:"new_name,omitempty"`
+
+	// Pages is the number of original pages.
+	Pages int `json:"pages,omitempty"`
+
+	// PageRecords contains what is known about individual original pages, by
+	// page number (starting at 1).
+	PageRecords map[int]*PageRecord `json:"page_records,omitempty"`
+
+	PDFDriveId string `json:"pdf_drive_id,omitempty"`
+
+	// Stages contains the history of all processing stages by name, including
+	// the scan and done markers.
+	Stages map[string]*StageRecord `json:"stages,omitempty"`
+
+	// PDFStage is the name of the stage which writes scan.pdf (see
+	// Job.SetPDFStage). Jobs processed by earlier versions of scan2drive lack
+	// it: their PDF was written by the stage named convert or pdf.
+	PDFStage string `json:"pdf_stage,omitempty"`
+
+	// Attempts is the number of failed attempts to process the job (since it
+	// was last retried manually).
+	Attempts int `json:"attempts,omitempty"`
+
+	// Error is the error of the last failed attempt.
+	Error string `json:"error,omitempty"`
+
+	// NextAttempt is when the job should be processed again after a failed
+	// attempt.
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+
+	// Failed is set once processing the job was given up, until it is retried
+	// manually.
+	Failed bool `json:"failed,omitempty"`
+
+	// Canceled is set when the user canceled processing the job.
+	Canceled bool `json:"canceled,omitempty"`
+
+	// OriginalsPruned and FilesPruned are set when the local copies of the
+	// original pages and of the PDF and thumbnail, respectively, were removed
+	// according to the user’s retention policy.
+	OriginalsPruned time.Time `json:"originals_pruned,omitzero"`
+	FilesPruned     time.Time `json:"files_pruned,omitzero"`
+
+	// Reclaimed is the number of bytes which were removed in total.
+	Reclaimed int64 `json:"reclaimed,omitempty"`
+}
+
+// StageRecord is the history of one processing stage of a job.
+type StageRecord struct {
+	// Attempts is the number of times the stage was started.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Started is when the stage was last started.
+	Started time.Time `json:"started,omitzero"`
+
+	// Completed is when the stage completed, or zero if it did not complete.
+	Completed time.Time `json:"completed,omitzero"`
+
+	// Failures is the number of attempts which failed.
+	Failures int `json:"failures,omitempty"`
+
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitzero"`
+}
+
+// PageRecord contains what is known about an original page of a job.
+type PageRecord struct {
+	// SkewHint is the skew angle in degrees (clockwise) of the page as
+	// measured by the scanner, if the scanner measures it.
+	SkewHint *float64 `json:"skew_hint,omitempty"`
+
+	// DPI is the resolution at which the page was scanned, as reported by the
+	// scanner or, for cropped pages of scanners which do not report it,
+	// estimated by the crop stage.
+	DPI int `json:"dpi,omitempty"`
+
+	// Crop is the part of the page (in pixels) which the crop stage kept, if
+	// it trimmed the scanner background around the paper.
+	Crop *image.Rectangle `json:"crop,omitempty"`
+
+	// Skew is the skew angle in degrees (clockwise) which the deskew stage
+	// detected and corrected, if the page contains text lines.
+	Skew *float64 `json:"skew,omitempty"`
+
+	// Rotation is the rotation in degrees (clockwise: 0, 90, 180 or 270)
+	// which was applied to the page to turn its text upright, if the page’s
+	// orientation was detected or ForcedRotation is set.
+	Rotation *int `json:"rotation,omitempty"`
+
+	// ForcedRotation is the rotation in degrees (clockwise) which the user
+	// chose for the page, overriding the detected orientation.
+	ForcedRotation *int `json:"forced_rotation,omitempty"`
+
+	// Skipped is set when the page was detected as blank and left out of the
+	// PDF. Ink is then the fraction of the page which is black (not counting
+	// margins and specks).
+	Skipped bool     `json:"skipped,omitempty"`
+	Ink     *float64 `json:"ink,omitempty"`
+
+	// Restored is set when the user restored a skipped page: the page is kept
+	// even if it is detected as blank.
+	Restored bool `json:"restored,omitempty"`
+}
+
+func (m *Manifest) stage(name string) *StageRecord {
+	if m.Stages == nil {
+		m.Stages = make(map[string]*StageRecord)
+	}
+	rec, ok := m.Stages[name]
+	if !ok {
+		rec = &StageRecord{}
+		m.Stages[name] = rec
+	}
+	return rec
+}
+
+func (m *Manifest) page(num int) *PageRecord {
+	if m.PageRecords == nil {
+		m.PageRecords = make(map[int]*PageRecord)
+	}
+	rec, ok := m.PageRecords[num]
+	if !ok {
+		rec = &PageRecord{}
+		m.PageRecords[num] = rec
+	}
+	return rec
+}
+
+func (m *Manifest) clone() Manifest {
+	c := *m
+	c.Stages = make(map[string]*StageRecord, len(m.Stages))
+	for name, rec := range m.Stages {
+		r := *rec
+		c.Stages[name] = &r
+	}
+	if m.PageRecords != nil {
+		c.PageRecords = make(map[int]*PageRecord, len(m.PageRecords))
+		for num, rec := range m.PageRecords {
+			r := *rec
+			c.PageRecords[num] = &r
+		}
+	}
+	return c
+}
+
+// readManifest returns the manifest stored in dir, or the zero Manifest if
+// there is none (yet).
+func readManifest(dir string) (Manifest, error) {
+	var m Manifest
+	b, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%s: %v", filepath.Join(dir, manifestName), err)
+	}
+	if m.Version > ManifestVersion {
+		return m, fmt.Errorf("%s: unsupported version %d (newer than %d)", filepath.Join(dir, manifestName), m.Version, ManifestVersion)
+	}
+	return m, nil
+}
+
+// writeManifest atomically and durably replaces the manifest stored in dir.
+func writeManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, manifestName), b, 0600)
+}
+
+// legacyFiles maps the names of files in which scan2drive versions before
+// job.json stored job state to the corresponding manifest field.
+func legacyFiles(m *Manifest) map[string]*string {
+	return map[string]*string{
+		"rename":       &m.NewName,
+		"pdf.drive_id": &m.PDFDriveId,
+		"source":       &m.Source,
+		"profile":      &m.Profile,
+	}
+}
+
+// migrate merges state which the manifest does not contain: all of it for job
+// directories written by scan2drive versions before job.json (or before the
+// page count was recorded), and COMPLETE.* markers committed right before a
+// crash. It returns whether m was modified.
+func (j *Job) migrate(m *Manifest, entries []os.FileInfo) (bool, error) {
+	var changed bool
+	if m.Version == 0 {
+		m.Version = ManifestVersion
+		m.Id = j.id
+		m.Created = j.createdFromDir()
+		changed = true
+	}
+	if m.User == "" && j.user != "" {
+		m.User = j.user
+		changed = true
+	}
+	legacy := legacyFiles(m)
+	var pages int
+	for _, entry := range entries {
+		if _, ok := pageNum(entry.Name()); ok {
+			pages++
+		}
+		if name, ok := strings.CutPrefix(entry.Name(), "COMPLETE."); ok {
+			if rec := m.stage(name); rec.Completed.IsZero() {
+				rec.Completed = entry.ModTime()
+				changed = true
+			}
+			continue
+		}
+		if field, ok := legacy[entry.Name()]; ok && *field == "" {
+			content, err := os.ReadFile(filepath.Join(j.dir, entry.Name()))
+			if err != nil {
+				return false, err
+			}
+			*field = string(content)
+			changed = true
+		}
+	}
+	if m.Pages == 0 && pages > 0 {
+		m.Pages = pages
+		changed = true
+	}
+	return changed, nil
+}
+
+// manifestLocks contains a lock for each job directory whose manifest is
+// being updated: JobById returns a new Job on every call, so several Jobs
+// might update the manifest of the same job concurrently (e.g. the scheduler
+// and a request of the HTTP API).
+var manifestLocks = struct {
+	sync.Mutex
+	byDir map[string]*manifestLock
+}{byDir: make(map[string]*manifestLock)}
+
+type manifestLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockManifest locks the manifest stored in dir and returns a function which
+// unlocks it.
+func lockManifest(dir string) (unlock func()) {
+	manifestLocks.Lock()
+	l, ok := manifestLocks.byDir[dir]
+	if !ok {
+		l = &manifestLock{}
+		manifestLocks.byDir[dir] = l
+	}
+	l.refs++
+	manifestLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		manifestLocks.Lock()
+		defer manifestLocks.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(manifestLocks.byDir, dir)
+		}
+	}
+}
+
+// update applies f to the manifest, persists it and updates the job state
+// accordingly. The manifest is read from the job directory again, as other
+// Jobs of the same job might have updated it since.
+func (j *Job) update(f func(m *Manifest)) error {
+	defer lockManifest(j.dir)()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	m, err := readManifest(j.dir)
+	if err != nil {
+		return err
+	}
+	if m.Version == 0 {
+		// The job is being added: its manifest was not persisted yet.
+		m = j.manifest.clone()
+	}
+	f(&m)
+	if err := writeManifest(j.dir, &m); err != nil {
+		return err
+	}
+	j.manifest = m
+	j.derive()
+	j.index()
+	return nil
+}
+
+// Manifest returns a copy of the job’s manifest.
+func (j *Job) Manifest() Manifest {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.clone()
+}
+
+// pdfStage returns whether the stage with the specified name writes scan.pdf.
+func (m *Manifest) pdfStage(stage string) bool {
+	if m.PDFStage == "" {
+		return stage == "convert" || stage == "pdf"
+	}
+	return stage == m.PDFStage
+}
+
+// SetPDFStage records the name of the stage which writes scan.pdf, so that
+// the job is considered converted once the stage completed (see
+// CompletionMarkers.Converted).
+func (j *Job) SetPDFStage(stage string) error {
+	return j.update(func(m *Manifest) {
+		m.PDFStage = stage
+	})
+}
+
+// StageStarted records an attempt to run the processing stage.
+func (j *Job) StageStarted(stage string) error {
+	return j.update(func(m *Manifest) {
+		rec := m.stage(stage)
+		rec.Attempts++
+		rec.Started = time.Now()
+	})
+}
+
+// StageFailed records a failed attempt to run the processing stage.
+func (j *Job) StageFailed(stage string, err error) error {
+	return j.update(func(m *Manifest) {
+		rec := m.stage(stage)
+		rec.Failures++
+		rec.LastError = err.Error()
+		rec.LastErrorTime = time.Now()
+	})
+}
+
+// UpdatePage applies f to the record of the original page num (starting at
+// 1) and persists it.
+func (j *Job) UpdatePage(num int, f func(rec *PageRecord)) error {
+	return j.update(func(m *Manifest) {
+		f(m.page(num))
+	})
+}
+
+// PageRecord returns the record of the original page num (starting at 1).
+func (j *Job) PageRecord(num int) PageRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if rec, ok := j.manifest.PageRecords[num]; ok {
+		return *rec
+	}
+	return PageRecord{}
+}
+
+// LastError returns the most recent error of a stage which did not complete
+// since, or an empty string if there is none.
+func (j *Job) LastError() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.lastError()
+}
+
+func (m *Manifest) lastError() string {
+	var (
+		last  *StageRecord
+		stage string
+	)
+	for name, rec := range m.Stages {
+		if rec.LastError == "" || rec.Completed.After(rec.LastErrorTime) {
+			continue
+		}
+		if last == nil || rec.LastErrorTime.After(last.LastErrorTime) {
+			last = rec
+			stage = name
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return fmt.Sprintf("stage %q (attempt %d): %s", stage, last.Attempts, last.LastError)
+}
+
+// Attempts returns the number of failed attempts to process the job.
+func (j *Job) Attempts() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.Attempts
+}
+
+// NextAttempt returns when the job should be processed again after a failed
+// attempt, or the zero time if the job can be processed right away.
+func (j *Job) NextAttempt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.NextAttempt
+}
+
+// Waiting returns whether the job waits for its next attempt after a failed
+// attempt.
+func (j *Job) Waiting() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == InProgress && j.manifest.NextAttempt.After(time.Now())
+}
+
+// RecordFailure records a failed attempt to process the job, which should be
+// retried at next.
+func (j *Job) RecordFailure(err error, next time.Time) error {
+	return j.update(func(m *Manifest) {
+		m.Attempts++
+		m.Error = err.Error()
+		m.NextAttempt = next
+	})
+}
+
+// MarkFailed records a failed attempt to process the job and moves the job
+// into state Failed.
+func (j *Job) MarkFailed(err error) error {
+	return j.update(func(m *Manifest) {
+		m.Attempts++
+		m.Error = err.Error()
+		m.NextAttempt = time.Time{}
+		m.Failed = true
+	})
+}
+
+// Retry resets the failed attempts of the job, moving a Failed (or Canceled)
+// job back into state InProgress.
+func (j *Job) Retry() error {
+	return j.update(func(m *Manifest) {
+		m.Attempts = 0
+		m.NextAttempt = time.Time{}
+		m.Failed = false
+		m.Canceled = false
+	})
+}
+
+// Cancel moves the job into state Canceled, unless it is Done already.
+func (j *Job) Cancel() error {
+	return j.update(func(m *Manifest) {
+		m.Canceled = true
+	})
+}
+
+// Reprocess resets the job so that all of its processing stages (conversion
+// and delivery to all sinks) run again, e.g. with improved conversion
+// settings. The history of the stages is kept. Reprocess fails if the
+// original pages were removed (see PruneOriginals).
+func (j *Job) Reprocess() error {
+	if j.OriginalsPruned() {
+		return fmt.Errorf("job %s: original pages were removed", j.id)
+	}
+	// Remove the markers first: they would otherwise be merged into the
+	// manifest again when reading the job.
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), "COMPLETE.")
+		if !ok || name == "scan" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if err := atomicfile.SyncDir(j.dir); err != nil {
+		return err
+	}
+	ingested := j.State() != Canceled
+	if err := j.update(func(m *Manifest) {
+		for name, rec := range m.Stages {
+			if name != "scan" {
+				rec.Completed = time.Time{}
+			}
+		}
+		if rec := m.stage("scan"); rec.Completed.IsZero() && ingested {
+			// Job directories written by earlier versions of scan2drive
+			// might lack the scan marker.
+			rec.Completed = m.Created
+		}
+		m.Attempts = 0
+		m.Error = ""
+		m.NextAttempt = time.Time{}
+		m.Failed = false
+		m.Canceled = false
+		m.FilesPruned = time.Time{}
+	}); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.loadPages()
+}
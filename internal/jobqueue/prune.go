@@ -0,0 +1,162 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+)
+
+// Finished returns when the job was done, or the zero time if it is not done.
+func (j *Job) Finished() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.finished()
+}
+
+// finished returns when the job was done, or the zero time if it is not done.
+func (m *Manifest) finished() time.Time {
+	if rec, ok := m.Stages["done"]; ok && !rec.Completed.IsZero() {
+		return rec.Completed
+	}
+	// scan2drive versions before sinks were pluggable did not record a done
+	// stage: uploading the PDF to Google Drive was the last step.
+	if rec, ok := m.Stages["uploadpdf"]; ok {
+		return rec.Completed
+	}
+	return time.Time{}
+}
+
+// OriginalsPruned returns whether the original pages were removed (see
+// PruneOriginals).
+func (j *Job) OriginalsPruned() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.manifest.OriginalsPruned.IsZero()
+}
+
+// FilesPruned returns whether the PDF and thumbnail were removed (see
+// PruneFiles).
+func (j *Job) FilesPruned() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.manifest.FilesPruned.IsZero()
+}
+
+// Reclaimed returns the number of bytes which were removed by pruning the job.
+func (j *Job) Reclaimed() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.manifest.Reclaimed
+}
+
+// PruneOriginals removes the original pages (page*.jpg, and page*.png if the
+// scanner binarized them) and the intermediate files of processing stages of a
+// Done job. It returns the number of bytes reclaimed.
+func (j *Job) PruneOriginals() (int64, error) {
+	return j.prune(func(fi fs.FileInfo) bool {
+		name := fi.Name()
+		ext := filepath.Ext(name)
+		return fi.IsDir() ||
+			(strings.HasPrefix(name, "page") && (ext == ".jpg" || ext == ".png"))
+	}, func(m *Manifest, now time.Time) {
+		m.OriginalsPruned = now
+	})
+}
+
+// PruneFiles removes the PDF (scan.pdf) and thumbnail (thumb.png) of a Done
+// job. It returns the number of bytes reclaimed.
+func (j *Job) PruneFiles() (int64, error) {
+	return j.prune(func(fi fs.FileInfo) bool {
+		name := fi.Name()
+		return name == "scan.pdf" || name == "thumb.png"
+	}, func(m *Manifest, now time.Time) {
+		m.FilesPruned = now
+	})
+}
+
+// prune removes all files (or directories) of a Done job for which match
+// returns true, and records the reclaimed space (and, if all files were
+// removed, calls record) in the manifest. The manifest itself and the
+// completion markers are never removed.
+func (j *Job) prune(match func(fs.FileInfo) bool, record func(*Manifest, time.Time)) (int64, error) {
+	if st := j.State(); st != Done {
+		return 0, fmt.Errorf("job %s: not pruning in state %v", j.id, st)
+	}
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		reclaimed int64
+		removeErr error
+	)
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		if fi.Name() == manifestName ||
+			atomicfile.IsTemp(fi.Name()) ||
+			!match(fi) {
+			continue
+		}
+		fn := filepath.Join(j.dir, fi.Name())
+		size, err := diskUsage(fn)
+		if err != nil {
+			removeErr = err
+			break
+		}
+		if err := os.RemoveAll(fn); err != nil {
+			removeErr = err
+			break
+		}
+		reclaimed += size
+	}
+	if err := j.update(func(m *Manifest) {
+		m.Reclaimed += reclaimed
+		if removeErr == nil {
+			record(m, time.Now())
+		}
+	}); err != nil {
+		return reclaimed, err
+	}
+	return reclaimed, removeErr
+}
+
+// diskUsage returns the total size of the file or directory tree at path.
+func diskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
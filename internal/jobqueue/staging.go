@@ -0,0 +1,259 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// stagingDir is the directory within the queue directory in which the pages
+// of jobs are staged while they are being scanned.
+const stagingDir = ".staging"
+
+// staleAfter is the age after which staged jobs are considered abandoned,
+// e.g. because scan2drive crashed while scanning.
+const staleAfter = 24 * time.Hour
+
+// failedPrefix is prepended to the name of the directories of staged jobs
+// which could not be committed. They are never removed automatically.
+const failedPrefix = "failed-"
+
+// Staging collects the pages of a job as they arrive from the scanner. Pages
+// are written to disk right away so that jobs of any size can be scanned with
+// bounded memory usage. Once all pages were added, Commit adds the job to the
+// queue.
+type Staging struct {
+	// Source and Profile are recorded in the job when it is committed (see
+	// Job.SetSource and Job.SetProfile).
+	Source  string
+	Profile string
+
+	q   *Queue
+	dir string
+
+	// staged contains the pages in page order.
+	staged []stagedPage
+}
+
+// stagedPage is a page which was written to the staging directory.
+type stagedPage struct {
+	base     string   // file name without extension
+	skewHint *float64 // see page.Any.SkewHint
+	dpi      int      // see page.Any.DPI
+}
+
+// NewStaging returns a Staging for a new job in the queue. Staged jobs which
+// were neither committed nor discarded within a day are removed.
+func (q *Queue) NewStaging() (*Staging, error) {
+	parent := filepath.Join(q.Dir, stagingDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	if err := removeStale(parent, time.Now().Add(-staleAfter)); err != nil {
+		log.Printf("removing abandoned staged jobs: %v", err)
+	}
+	dir, err := os.MkdirTemp(parent, "job-")
+	if err != nil {
+		return nil, err
+	}
+	return &Staging{q: q, dir: dir}, nil
+}
+
+func removeStale(dir string, before time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(before) || strings.HasPrefix(entry.Name(), failedPrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPage writes the page to disk.
+func (s *Staging) AddPage(p *page.Any) error {
+	base := fmt.Sprintf("staged%d", len(s.staged)+1)
+	if _, err := p.WriteFiles(
+		filepath.Join(s.dir, base+".jpg"),
+		filepath.Join(s.dir, base+".png")); err != nil {
+		return err
+	}
+	s.staged = append(s.staged, stagedPage{base: base, skewHint: p.SkewHint, dpi: p.DPI})
+	// Keep the directory from being considered abandoned during long scans.
+	now := time.Now()
+	return os.Chtimes(s.dir, now, now)
+}
+
+// Len returns the number of staged pages.
+func (s *Staging) Len() int {
+	return len(s.staged)
+}
+
+// Reverse reverses the order of the staged pages, e.g. for scanners which
+// scan the last page first.
+func (s *Staging) Reverse() {
+	slices.Reverse(s.staged)
+}
+
+// Interleave moves the pages of backs into s, so that each of the pages of s
+// is followed by the page of backs at the same position, e.g. to combine the
+// front and back sides of a manual duplex scan. Both need to contain the same
+// number of pages. backs is empty afterwards and must not be used anymore.
+func (s *Staging) Interleave(backs *Staging) error {
+	if got, want := backs.Len(), s.Len(); got != want {
+		return fmt.Errorf("cannot interleave %d pages with %d pages", want, got)
+	}
+	moved, err := s.move(backs)
+	if err != nil {
+		return err
+	}
+	staged := make([]stagedPage, 0, 2*len(s.staged))
+	for idx, sp := range s.staged {
+		staged = append(staged, sp, moved[idx])
+	}
+	s.staged = staged
+	return nil
+}
+
+// Append moves the pages of other into s, after the pages of s. other is
+// empty afterwards and must not be used anymore.
+func (s *Staging) Append(other *Staging) error {
+	moved, err := s.move(other)
+	if err != nil {
+		return err
+	}
+	s.staged = append(s.staged, moved...)
+	return nil
+}
+
+// move moves the pages of other into the directory of s and returns them
+// under their new file names, in page order.
+func (s *Staging) move(other *Staging) ([]stagedPage, error) {
+	moved := make([]stagedPage, 0, len(other.staged))
+	for _, sp := range other.staged {
+		// Rename the pages, as both stagings use the same file names.
+		name := fmt.Sprintf("staged%d", len(s.staged)+len(moved)+1)
+		for _, ext := range []string{".jpg", ".png"} {
+			err := os.Rename(
+				filepath.Join(other.dir, sp.base+ext),
+				filepath.Join(s.dir, name+ext))
+			if err != nil && (ext == ".jpg" || !os.IsNotExist(err)) {
+				return nil, err
+			}
+		}
+		sp.base = name
+		moved = append(moved, sp)
+	}
+	other.staged = nil
+	now := time.Now()
+	if err := os.Chtimes(s.dir, now, now); err != nil {
+		return nil, err
+	}
+	return moved, other.Discard()
+}
+
+// Dir returns the directory in which the staged pages are stored.
+func (s *Staging) Dir() string {
+	return s.dir
+}
+
+// Discard removes the staged pages.
+func (s *Staging) Discard() error {
+	return os.RemoveAll(s.dir)
+}
+
+// Commit adds the job to the queue, moving the staged pages into the job
+// directory. Should that fail, the staged pages are kept (in a directory
+// whose name starts with failed-, which the returned error contains) so that
+// the job can be recovered manually.
+func (s *Staging) Commit() (*Job, error) {
+	job, err := s.commit()
+	if err != nil {
+		if _, statErr := os.Stat(s.dir); statErr == nil {
+			s.keep()
+		}
+		return nil, fmt.Errorf("committing staged job %s: %v", s.dir, err)
+	}
+	return job, nil
+}
+
+// keep moves the staged job out of the way of removeStale.
+func (s *Staging) keep() {
+	failed := filepath.Join(filepath.Dir(s.dir), failedPrefix+filepath.Base(s.dir))
+	if err := os.Rename(s.dir, failed); err != nil {
+		log.Printf("keeping staged job which could not be committed: %v", err)
+		return
+	}
+	s.dir = failed
+}
+
+func (s *Staging) commit() (*Job, error) {
+	for idx, sp := range s.staged {
+		for _, ext := range []string{".jpg", ".png"} {
+			err := os.Rename(
+				filepath.Join(s.dir, sp.base+ext),
+				filepath.Join(s.dir, fmt.Sprintf("page%d%s", idx+1, ext)))
+			if err != nil && (ext == ".jpg" || !os.IsNotExist(err)) {
+				return nil, err
+			}
+		}
+	}
+	if err := atomicfile.SyncDir(s.dir); err != nil {
+		return nil, err
+	}
+	// The rename fails if a job directory of the same id contains files
+	// already, so jobs are never merged.
+	job, err := s.q.newJob(func(dir string) error {
+		return atomicfile.Rename(s.dir, dir)
+	})
+	if err != nil {
+		return nil, err
+	}
+	job.manifest.Source = s.Source
+	job.manifest.Profile = s.Profile
+	for idx, sp := range s.staged {
+		if sp.skewHint != nil {
+			job.manifest.page(idx + 1).SkewHint = sp.skewHint
+		}
+		if sp.dpi != 0 {
+			job.manifest.page(idx + 1).DPI = sp.dpi
+		}
+	}
+	if err := job.loadPages(); err != nil {
+		return nil, err
+	}
+	if err := job.commit(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
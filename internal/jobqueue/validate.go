@@ -0,0 +1,232 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+)
+
+// format describes how a complete file of a certain type starts and ends.
+type format struct {
+	magic   string
+	trailer string
+	// padding contains bytes which may follow the trailer.
+	padding string
+	// decodeConfig, if set, decodes the header of the file.
+	decodeConfig func(io.Reader) (image.Config, error)
+}
+
+var formats = map[string]format{
+	".jpg": {magic: "\xff\xd8", trailer: "\xff\xd9", padding: "\x00", decodeConfig: jpeg.DecodeConfig},
+	".png": {magic: "\x89PNG\r\n\x1a\n", trailer: "IEND\xaeB`\x82", decodeConfig: png.DecodeConfig},
+	".pdf": {magic: "%PDF-", trailer: "%%EOF", padding: " \t\r\n\x00"},
+}
+
+// checkFile returns an error if the file is empty or truncated, which is what
+// a power loss while writing the file typically results in, or if the header
+// of an image cannot be decoded. Only the start and the end of the file are
+// read, so that checking is cheap enough to do whenever a job is read: damage
+// in the middle of the image data goes unnoticed. Missing files are not
+// considered damaged.
+func checkFile(fn string) error {
+	f, ok := formats[filepath.Ext(fn)]
+	if !ok {
+		return nil
+	}
+	file, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("%s: empty file", filepath.Base(fn))
+	}
+	magic := make([]byte, len(f.magic))
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != f.magic {
+		return fmt.Errorf("%s: not a %s file", filepath.Base(fn), filepath.Ext(fn))
+	}
+	tail := make([]byte, min(fi.Size(), 1024))
+	if _, err := file.ReadAt(tail, fi.Size()-int64(len(tail))); err != nil {
+		return err
+	}
+	tail = bytes.TrimRight(tail, f.padding)
+	if !bytes.HasSuffix(tail, []byte(f.trailer)) {
+		return fmt.Errorf("%s: truncated file", filepath.Base(fn))
+	}
+	if f.decodeConfig != nil {
+		cfg, err := f.decodeConfig(io.NewSectionReader(file, 0, fi.Size()))
+		if err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(fn), err)
+		}
+		if cfg.Width == 0 || cfg.Height == 0 {
+			return fmt.Errorf("%s: empty image", filepath.Base(fn))
+		}
+	}
+	return nil
+}
+
+// outputs returns the files in the job directory which the completed stage
+// wrote, or nil if unknown.
+func (j *Job) outputs(stage string) []string {
+	var fns []string
+	if j.manifest.pdfStage(stage) {
+		if !j.manifest.FilesPruned.IsZero() {
+			return nil
+		}
+		fns = append(fns,
+			filepath.Join(j.dir, "scan.pdf"),
+			filepath.Join(j.dir, "thumb.png"))
+	}
+	// Stages which process pages write them into a directory named after the
+	// stage (see pipeline.pageStage).
+	if matches, err := filepath.Glob(filepath.Join(j.dir, stage, "page*.png")); err == nil {
+		fns = append(fns, matches...)
+	}
+	return fns
+}
+
+// validate checks the files of the job for damage, e.g. by a power loss while
+// they were written (by scan2drive versions which did not use atomicfile, or by
+// a disk which ignores syncs), and rolls back the job state so that the damage
+// is repaired where possible:
+//
+//   - A damaged original page means that the job was not completely ingested:
+//     the scan stage is rolled back, moving the job into state Canceled.
+//   - A damaged binarized original page (page<n>.png) is removed, so that the
+//     page is binarized again from its JPEG.
+//   - A damaged output of a processing stage (e.g. scan.pdf) rolls back the
+//     stage and all stages which completed after it (e.g. sinks which might
+//     have delivered the damaged file), so that they run again.
+//
+// Only jobs which are not done are validated: files of done jobs are not read
+// by scan2drive anymore.
+func (j *Job) validate() error {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	damaged := make(map[string]error) // by stage name
+	for _, entry := range entries {
+		name := entry.Name()
+		fn := filepath.Join(j.dir, name)
+		switch {
+		case atomicfile.IsTemp(name):
+			// Left behind by a crash, unless the file is being written right
+			// now.
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleAfter {
+				if err := os.Remove(fn); err != nil {
+					return err
+				}
+			}
+
+		case strings.HasPrefix(name, "page") && strings.HasSuffix(name, ".jpg"):
+			if err := checkFile(fn); err != nil {
+				damaged["scan"] = err
+			}
+
+		case strings.HasPrefix(name, "page") && strings.HasSuffix(name, ".png"):
+			if err := checkFile(fn); err != nil {
+				log.Printf("job %s: removing damaged binarized page: %v", j.id, err)
+				if err := os.Remove(fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if _, ok := damaged["scan"]; !ok {
+		for stage, rec := range j.manifest.Stages {
+			if stage == "scan" || rec.Completed.IsZero() {
+				continue
+			}
+			for _, fn := range j.outputs(stage) {
+				if err := checkFile(fn); err != nil {
+					damaged[stage] = err
+					break
+				}
+			}
+		}
+	}
+	if len(damaged) == 0 {
+		return nil
+	}
+	return j.rollback(damaged)
+}
+
+// rollback marks the damaged stages, and all stages which completed after
+// them, as not completed. The damaged scan stage is rolled back on its own.
+func (j *Job) rollback(damaged map[string]error) error {
+	var cutoff time.Time
+	for stage := range damaged {
+		if stage == "scan" {
+			continue
+		}
+		if c := j.manifest.Stages[stage].Completed; cutoff.IsZero() || c.Before(cutoff) {
+			cutoff = c
+		}
+	}
+	rollback := make(map[string]bool)
+	for stage, rec := range j.manifest.Stages {
+		if _, ok := damaged[stage]; ok ||
+			(stage != "scan" && !cutoff.IsZero() && !rec.Completed.IsZero() && !rec.Completed.Before(cutoff)) {
+			rollback[stage] = true
+		}
+	}
+	for stage := range rollback {
+		if err, ok := damaged[stage]; ok {
+			log.Printf("job %s: rolling back stage %q: %v", j.id, stage, err)
+		} else {
+			log.Printf("job %s: rolling back stage %q, which completed after a damaged stage", j.id, stage)
+		}
+		// Remove the markers first: they would otherwise be merged into the
+		// manifest again when reading the job.
+		err := os.Remove(filepath.Join(j.dir, "COMPLETE."+stage))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := atomicfile.SyncDir(j.dir); err != nil {
+		return err
+	}
+	now := time.Now()
+	return j.update(func(m *Manifest) {
+		for stage := range rollback {
+			rec := m.stage(stage)
+			rec.Completed = time.Time{}
+			if err, ok := damaged[stage]; ok {
+				rec.LastError = err.Error()
+				rec.LastErrorTime = now
+			}
+		}
+	})
+}
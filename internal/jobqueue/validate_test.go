@@ -0,0 +1,269 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+const testPDF = "%PDF-1.4\n%%EOF\n"
+
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// injectFault makes writes of files named fn fail at the specified step.
+func injectFault(t *testing.T, step, fn string) {
+	atomicfile.FaultHook = func(s, name string) error {
+		if s == step && filepath.Base(name) == fn {
+			return fmt.Errorf("injected fault")
+		}
+		return nil
+	}
+	t.Cleanup(func() { atomicfile.FaultHook = nil })
+}
+
+// tempFiles returns the temporary files left behind in dir.
+func tempFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var temp []string
+	for _, entry := range entries {
+		if atomicfile.IsTemp(entry.Name()) {
+			temp = append(temp, entry.Name())
+		}
+	}
+	return temp
+}
+
+func TestAtomicWrites(t *testing.T) {
+	for _, step := range []string{"write", "sync", "rename"} {
+		t.Run(step, func(t *testing.T) {
+			q := &jobqueue.Queue{Dir: t.TempDir()}
+			job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes(testJPEG("page 1"))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := job.AddDerivedFile("scan.pdf", []byte(testPDF)); err != nil {
+				t.Fatal(err)
+			}
+
+			injectFault(t, step, "scan.pdf")
+			if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.4 new version")); err == nil {
+				t.Fatalf("AddDerivedFile unexpectedly succeeded despite injected fault")
+			}
+			// The file contains its old contents, and no temporary file is
+			// left behind.
+			b, err := job.ReadDerivedFile("scan.pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), testPDF; got != want {
+				t.Errorf("unexpected scan.pdf contents: got %q, want %q", got, want)
+			}
+			if temp := tempFiles(t, job.Dir()); len(temp) > 0 {
+				t.Errorf("temporary files left behind: %q", temp)
+			}
+
+			// Should updating the manifest fail, the marker (the commit point)
+			// is merged when the job is read again.
+			injectFault(t, step, "job.json")
+			if err := job.CommitMarker("convert"); err == nil {
+				t.Fatalf("CommitMarker unexpectedly succeeded despite injected fault")
+			}
+			atomicfile.FaultHook = nil
+			job, err = q.JobById(job.Id())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !job.Completed("convert") {
+				t.Errorf("stage convert not completed after reading the job")
+			}
+		})
+	}
+}
+
+func TestStagingCommitFault(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	s, err := q.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddPage(page.JPEGPageFromBytes(testJPEG("page 1"))); err != nil {
+		t.Fatal(err)
+	}
+	injectFault(t, "write", "COMPLETE.scan")
+	if _, err := s.Commit(); err == nil {
+		t.Fatalf("Commit unexpectedly succeeded despite injected fault")
+	}
+	// Without the scan marker, the job was not completely ingested.
+	scans, err := q.Scans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(scans), 1; got != want {
+		t.Fatalf("unexpected number of scans: got %d, want %d", got, want)
+	}
+	for id, job := range scans {
+		if got, want := job.State(), jobqueue.Canceled; got != want {
+			t.Errorf("job %s: unexpected state: got %v, want %v", id, got, want)
+		}
+	}
+}
+
+// damagedJob returns a job whose PDF was written after its originals were
+// delivered, and which was delivered to a NAS afterwards.
+func damagedJob(t *testing.T) (*jobqueue.Queue, *jobqueue.Job) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	bin := image.NewGray(image.Rect(0, 0, 2, 2))
+	job, err := q.AddJob([]*page.Any{
+		page.Binarized(testJPEG("page 1"), bin, 0),
+		page.JPEGPageFromBytes(testJPEG("page 2")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitDelivery("originals"); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte(testPDF)); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("thumb.png", testPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitMarker("convert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.CommitDelivery("nas"); err != nil {
+		t.Fatal(err)
+	}
+	return q, job
+}
+
+// truncate simulates a power loss while writing the file.
+func truncate(t *testing.T, fn string, size int64) {
+	if err := os.Truncate(fn, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateDamagedOutput(t *testing.T) {
+	q, job := damagedJob(t)
+	truncate(t, filepath.Join(job.Dir(), "scan.pdf"), 5)
+
+	// The conversion and the delivery to the NAS (which might have delivered
+	// the damaged PDF) run again, but the originals are not delivered again.
+	for i := 0; i < 2; i++ { // rolling back persists
+		job, err := q.JobById(job.Id())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := job.State(), jobqueue.InProgress; got != want {
+			t.Errorf("unexpected job state: got %v, want %v", got, want)
+		}
+		if job.Completed("convert") || job.Markers.Converted {
+			t.Errorf("stage convert not rolled back")
+		}
+		if job.Delivered("nas") {
+			t.Errorf("delivery to nas not rolled back")
+		}
+		if !job.Delivered("originals") {
+			t.Errorf("delivery of originals unexpectedly rolled back")
+		}
+		if got := job.LastError(); !strings.Contains(got, "scan.pdf") {
+			t.Errorf("unexpected last error: got %q, want it to mention scan.pdf", got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(job.Dir(), "COMPLETE.convert")); !os.IsNotExist(err) {
+		t.Errorf("COMPLETE.convert not removed: %v", err)
+	}
+}
+
+func TestValidateDamagedPage(t *testing.T) {
+	q, job := damagedJob(t)
+	truncate(t, filepath.Join(job.Dir(), "page2.jpg"), 0)
+
+	job, err := q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The page cannot be recovered: the job was not completely ingested.
+	if got, want := job.State(), jobqueue.Canceled; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+	if got := job.LastError(); !strings.Contains(got, "page2.jpg") {
+		t.Errorf("unexpected last error: got %q, want it to mention page2.jpg", got)
+	}
+}
+
+func TestValidateDamagedBinarizedPage(t *testing.T) {
+	q, job := damagedJob(t)
+	truncate(t, filepath.Join(job.Dir(), "page1.png"), 20)
+
+	job, err := q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The page is binarized again from its JPEG.
+	if _, err := os.Stat(filepath.Join(job.Dir(), "page1.png")); !os.IsNotExist(err) {
+		t.Errorf("damaged page1.png not removed: %v", err)
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+	if !job.Completed("convert") {
+		t.Errorf("stage convert unexpectedly rolled back")
+	}
+	if got, want := len(job.Pages()), 2; got != want {
+		t.Errorf("unexpected number of pages: got %d, want %d", got, want)
+	}
+}
+
+func TestValidateCorruptPage(t *testing.T) {
+	q, job := damagedJob(t)
+	// Complete, but not a JPEG image.
+	if err := os.WriteFile(filepath.Join(job.Dir(), "page2.jpg"), []byte("\xff\xd8page 2\xff\xd9"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := job.State(), jobqueue.Canceled; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+	if got := job.LastError(); !strings.Contains(got, "page2.jpg") {
+		t.Errorf("unexpected last error: got %q, want it to mention page2.jpg", got)
+	}
+}
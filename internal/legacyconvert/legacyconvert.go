@@ -26,23 +26,55 @@ import (
 	"golang.org/x/net/trace"
 )
 
-func ConvertLogic(tr trace.Trace, pages []*page.Any) (pdf []byte, thumb []byte, err error) {
+// Options configure ConvertLogic. The zero value uses the defaults of package
+// page and does not rotate pages.
+type Options struct {
+	// Thresholder binarizes the pages which the scanner did not binarize
+	// already (page.DefaultThresholder if nil).
+	Thresholder page.Thresholder
+
+	// Blank returns whether the page num (starting at 1) is blank and should
+	// be skipped. If nil, pages are checked using page.DefaultBlankDetector.
+	Blank func(num int, bin *image.Gray) (bool, error)
+
+	// Rotate, if non-nil, returns the page num (starting at 1) rotated as
+	// needed.
+	Rotate func(num int, bin *image.Gray) (*image.Gray, error)
+}
+
+// ConvertLogic binarizes the pages, skips blank pages, rotates the remaining
+// pages (see Options) and returns the PDF and a thumbnail of the first page.
+func ConvertLogic(tr trace.Trace, pages []*page.Any, opts Options) (pdf []byte, thumb []byte, err error) {
+	blank := opts.Blank
+	if blank == nil {
+		blank = func(num int, bin *image.Gray) (bool, error) {
+			blank, ink := page.DefaultBlankDetector.Blank(bin)
+			tr.LazyPrintf("page %d is covered by %f ink, blank = %v", num, ink, blank)
+			return blank, nil
+		}
+	}
 	compressed := make([]*bytes.Buffer, len(pages))
 	bounds := make([]image.Rectangle, len(pages))
 	var first *image.Gray
 	for idx, page := range pages {
-		var binarized *image.Gray
-		{
-			bin, whitePct, err := page.Binarized()
+		binarized, _, err := page.BinarizedWith(opts.Thresholder)
+		if err != nil {
+			return nil, nil, err
+		}
+		skip, err := blank(idx+1, binarized)
+		if err != nil {
+			return nil, nil, err
+		}
+		if skip {
+			continue
+		}
+
+		if opts.Rotate != nil {
+			rotated, err := opts.Rotate(idx+1, binarized)
 			if err != nil {
 				return nil, nil, err
 			}
-			binarized = bin
-			blank := whitePct > 0.99
-			tr.LazyPrintf("white percentage of page %d is %f, blank = %v", idx, whitePct, blank)
-			if blank {
-				continue
-			}
+			binarized = rotated
 		}
 
 		if first == nil {
@@ -69,7 +101,7 @@ func ConvertLogic(tr trace.Trace, pages []*page.Any) (pdf []byte, thumb []byte,
 	}
 
 	var buf bytes.Buffer
-	if err := writePDF(&buf, compressed, bounds); err != nil {
+	if err := WritePDF(&buf, compressed, bounds, nil); err != nil {
 		return nil, nil, err
 	}
 
@@ -24,7 +24,12 @@ import (
 	"github.com/stapelberg/scan2drive/internal/pdf"
 )
 
-func writePDF(w io.Writer, compressed []*bytes.Buffer, bounds []image.Rectangle) error {
+// WritePDF writes a PDF document to w, containing one DIN A4 page for each
+// non-nil entry in compressed (G3-encoded images with the corresponding bounds).
+// Pages whose images are wider than tall are in landscape format. Pages whose
+// resolution is known (non-zero entries in dpi, which may be nil) are sized
+// like the paper instead, e.g. for cropped receipts.
+func WritePDF(w io.Writer, compressed []*bytes.Buffer, bounds []image.Rectangle, dpi []int) error {
 	var kids []pdf.Object
 	var cnt int
 	for idx, m := range compressed {
@@ -32,9 +37,21 @@ func writePDF(w io.Writer, compressed []*bytes.Buffer, bounds []image.Rectangle)
 			continue
 		}
 
+		width, height := pdf.A4Width, pdf.A4Height
+		if bounds[idx].Dx() > bounds[idx].Dy() {
+			width, height = height, width
+		}
+		if dpi != nil && dpi[idx] > 0 {
+			// PDF units are 1/72 inch.
+			width = float64(bounds[idx].Dx()) * 72 / float64(dpi[idx])
+			height = float64(bounds[idx].Dy()) * 72 / float64(dpi[idx])
+		}
+
 		scanName := fmt.Sprintf("scan%d", cnt)
 		kids = append(kids, &pdf.Page{
 			Common: pdf.Common{ObjectName: fmt.Sprintf("page%d", cnt)},
+			Width:  width,
+			Height: height,
 			Resources: []pdf.Object{
 				&pdf.Image{
 					Common: pdf.Common{
@@ -48,7 +65,7 @@ func writePDF(w io.Writer, compressed []*bytes.Buffer, bounds []image.Rectangle)
 			Contents: []pdf.Object{
 				&pdf.Common{
 					ObjectName: fmt.Sprintf("content%d", cnt),
-					Stream:     []byte(fmt.Sprintf("q 595.28 0 0 841.89 0.00 0.00 cm /%s Do Q\n", scanName)),
+					Stream:     []byte(fmt.Sprintf("q %.2f 0 0 %.2f 0.00 0.00 cm /%s Do Q\n", width, height, scanName)),
 				},
 			},
 		})
@@ -13,13 +13,15 @@
 // limitations under the License.
 
 // Package mayqtt implements an MQTT client which receives scan requests from
-// scan2drive/cmd/scan and publishes status to scan2drive/ui/status.
+// scan2drive/cmd/scan and job requests (see scan2drive.JobRequest) from
+// scan2drive/cmd/job, and publishes status to scan2drive/ui/status.
 package mayqtt
 
 import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stapelberg/scan2drive"
@@ -38,7 +40,7 @@ type PublishRequest struct {
 	Payload  interface{}
 }
 
-func mqttLoop(mqttScanRequests chan *scan2drive.ScanRequest, requests <-chan PublishRequest) error {
+func mqttLoop(mqttScanRequests chan *scan2drive.ScanRequest, mqttJobRequests chan *scan2drive.JobRequest, requests <-chan PublishRequest) error {
 	tr := trace.New("MQTT", "Loop")
 	defer tr.Finish()
 
@@ -67,6 +69,25 @@ func mqttLoop(mqttScanRequests chan *scan2drive.ScanRequest, requests <-chan Pub
 		if token.Wait() && token.Error() != nil {
 			tr.LazyPrintf("subscription failed! %v", token.Error())
 		}
+
+		tr.LazyPrintf("subscribing to scan2drive/cmd/job")
+		token = c.Subscribe(
+			"scan2drive/cmd/job",
+			0, /* qos */
+			func(_ mqtt.Client, m mqtt.Message) {
+				tr.LazyPrintf("message on topic %s: %q", m.Topic(), string(m.Payload()))
+				var jr scan2drive.JobRequest
+				if err := json.Unmarshal(m.Payload(), &jr); err != nil {
+					log.Printf("error unmarshaling payload: %v", err)
+					return
+				}
+				// Unlike scan requests, job requests are not interchangeable,
+				// so block instead of dropping them.
+				mqttJobRequests <- &jr
+			})
+		if token.Wait() && token.Error() != nil {
+			tr.LazyPrintf("subscription failed! %v", token.Error())
+		}
 	}
 	mqttClient := mqtt.NewClient(opts)
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
@@ -84,20 +105,25 @@ func mqttLoop(mqttScanRequests chan *scan2drive.ScanRequest, requests <-chan Pub
 
 var publish chan PublishRequest
 
-func MQTT(scanRequests chan *scan2drive.ScanRequest) {
+func MQTT(scanRequests chan *scan2drive.ScanRequest, jobRequests chan *scan2drive.JobRequest) {
 	publish = make(chan PublishRequest)
 	go func() {
-		if err := mqttLoop(scanRequests, publish); err != nil {
+		if err := mqttLoop(scanRequests, jobRequests, publish); err != nil {
 			log.Print(err)
 		}
 	}()
 }
 
-var lastStatus string
+var (
+	lastStatusMu sync.Mutex
+	lastStatus   string
+)
 
 func Publishf(format string, args ...interface{}) {
 	status := fmt.Sprintf(format, args...)
 	// Prevent duplicate messages if status has not changed
+	lastStatusMu.Lock()
+	defer lastStatusMu.Unlock()
 	if lastStatus == status {
 		return
 	}
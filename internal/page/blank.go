@@ -0,0 +1,165 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page
+
+import (
+	"fmt"
+	"image"
+)
+
+// BlankDetector tells blank pages (e.g. empty back sides) from pages with
+// content, even sparse content such as a single signature. Its fields are
+// configured in processing profiles.
+type BlankDetector struct {
+	// Margin is the fraction of the page’s width and height which is ignored
+	// at each edge, where punch holes, staples and the shadows of the paper
+	// edges are.
+	Margin float64 `json:"margin"`
+
+	// Speck is the size, as a fraction of the page’s width, below which
+	// connected areas of black pixels are considered specks of dust or scan
+	// noise and are ignored.
+	Speck float64 `json:"speck"`
+
+	// MinInk is the fraction of the page (without margins) which needs to be
+	// black, not counting specks, for the page to not be blank.
+	MinInk float64 `json:"min_ink"`
+}
+
+// DefaultBlankDetector is used where no BlankDetector is configured. On DIN
+// A4 pages, the margins cover punch holes (up to 15mm from the edge), specks
+// are smaller than 0.4mm, and a page with a short signature is not blank.
+var DefaultBlankDetector = BlankDetector{
+	Margin: 0.08,
+	Speck:  0.002,
+	MinInk: 0.0001,
+}
+
+// Validate returns an error if the BlankDetector is misconfigured.
+func (d *BlankDetector) Validate() error {
+	if d.Margin < 0 || d.Margin >= 0.5 {
+		return fmt.Errorf("blank margin %v out of range [0, 0.5)", d.Margin)
+	}
+	if d.Speck < 0 || d.Speck > 1 {
+		return fmt.Errorf("blank speck %v out of range [0, 1]", d.Speck)
+	}
+	if d.MinInk < 0 || d.MinInk > 1 {
+		return fmt.Errorf("blank min_ink %v out of range [0, 1]", d.MinInk)
+	}
+	return nil
+}
+
+// Blank returns whether the black/white image bin is blank, and the fraction
+// of bin (without margins) which is black, not counting specks.
+func (d *BlankDetector) Blank(bin *image.Gray) (bool, float64) {
+	width, height := bin.Rect.Dx(), bin.Rect.Dy()
+	mx, my := int(d.Margin*float64(width)), int(d.Margin*float64(height))
+	content := image.Rect(mx, my, width-mx, height-my)
+	if content.Empty() {
+		return true, 0
+	}
+	speck := int(d.Speck * float64(width))
+	var ink int
+	for _, c := range components(bin, content) {
+		if c.bounds.Dx() < speck && c.bounds.Dy() < speck {
+			continue // speck
+		}
+		ink += c.pixels
+	}
+	fraction := float64(ink) / float64(content.Dx()*content.Dy())
+	return fraction < d.MinInk, fraction
+}
+
+// component is a connected area of black pixels.
+type component struct {
+	bounds image.Rectangle
+	pixels int
+}
+
+// run is a horizontal run of black pixels from x0 to x1 (exclusive).
+type run struct {
+	x0, x1 int
+	label  int
+}
+
+// components returns the 8-connected components of black pixels of bin within
+// r. Components are labeled run by run, row by row: each run is merged with the
+// runs of the previous row which it touches (union-find).
+func components(bin *image.Gray, r image.Rectangle) []component {
+	var (
+		parent []int // by label
+		comps  []component
+	)
+	find := func(l int) int {
+		for parent[l] != l {
+			parent[l] = parent[parent[l]]
+			l = parent[l]
+		}
+		return l
+	}
+	var prev, cur []run
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		px := row(bin, y)
+		cur = cur[:0]
+		next := 0 // first run of prev which can touch the current run
+		for x := r.Min.X; x < r.Max.X; {
+			if px[x] != 0x00 {
+				x++
+				continue
+			}
+			x0 := x
+			for x < r.Max.X && px[x] == 0x00 {
+				x++
+			}
+			label := len(parent)
+			parent = append(parent, label)
+			comps = append(comps, component{
+				bounds: image.Rect(x0, y, x, y+1),
+				pixels: x - x0,
+			})
+			// Runs touch (including diagonally) if they overlap when
+			// extended by one pixel.
+			for next < len(prev) && prev[next].x1 < x0 {
+				next++
+			}
+			for _, p := range prev[next:] {
+				if p.x0 > x {
+					break
+				}
+				a, b := find(label), find(p.label)
+				if a != b {
+					parent[b] = a
+				}
+			}
+			cur = append(cur, run{x0: x0, x1: x, label: label})
+		}
+		prev, cur = cur, prev
+	}
+
+	// Merge the bounds and pixel counts of all runs of each component.
+	index := make([]int, len(parent)) // by root label, 1-based index in result
+	var result []component
+	for l := range parent {
+		root := find(l)
+		if index[root] == 0 {
+			result = append(result, component{bounds: comps[l].bounds})
+			index[root] = len(result)
+		}
+		idx := index[root] - 1
+		result[idx].bounds = result[idx].bounds.Union(comps[l].bounds)
+		result[idx].pixels += comps[l].pixels
+	}
+	return result
+}
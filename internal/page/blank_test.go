@@ -0,0 +1,105 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// backside returns an empty A4 page at 300 dpi with two punch holes, a
+// shadow along the right edge and specks of dust.
+func backside() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 2480, 3508))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xff}), image.Point{}, draw.Src)
+	black := image.NewUniform(color.Gray{0x00})
+	for _, y := range []int{1400, 2100} {
+		// 6mm diameter, 12mm from the edge (ISO 838).
+		for dy := -35; dy <= 35; dy++ {
+			for dx := -35; dx <= 35; dx++ {
+				if dx*dx+dy*dy <= 35*35 {
+					img.SetGray(142+dx, y+dy, color.Gray{0x00})
+				}
+			}
+		}
+	}
+	draw.Draw(img, image.Rect(2450, 0, 2480, 3508), black, image.Point{}, draw.Src)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		x, y := 200+rnd.Intn(2000), 200+rnd.Intn(3000)
+		draw.Draw(img, image.Rect(x, y, x+1+rnd.Intn(3), y+1+rnd.Intn(3)), black, image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func TestBlank(t *testing.T) {
+	d := page.DefaultBlankDetector
+
+	img := backside()
+	if blank, ink := d.Blank(img); !blank {
+		t.Errorf("backside with punch holes and dust not blank (ink %v)", ink)
+	}
+	// The fixed threshold of earlier scan2drive versions did not consider
+	// this page blank.
+	var white int
+	for _, v := range img.Pix {
+		if v == 0xff {
+			white++
+		}
+	}
+	if pct := float64(white) / float64(len(img.Pix)); pct > 0.99 {
+		t.Fatalf("test page too white (%v) to demonstrate the difference", pct)
+	}
+
+	// A signature: a thin, wavy line.
+	for x := 800; x < 1400; x++ {
+		y := 2800 + int(30*math.Sin(float64(x)/20))
+		for dy := 0; dy < 3; dy++ {
+			img.SetGray(x, y+dy, color.Gray{0x00})
+		}
+	}
+	if blank, ink := d.Blank(img); blank {
+		t.Errorf("page with signature considered blank (ink %v)", ink)
+	}
+}
+
+func TestBlankConfig(t *testing.T) {
+	img := backside()
+	// Without margin, the punch holes and the shadow are content.
+	d := page.DefaultBlankDetector
+	d.Margin = 0
+	if blank, ink := d.Blank(img); blank {
+		t.Errorf("page considered blank without margin (ink %v)", ink)
+	}
+	// Without speck removal, the dust is content.
+	d = page.DefaultBlankDetector
+	d.Speck = 0
+	d.MinInk = 0.00001
+	if blank, ink := d.Blank(img); blank {
+		t.Errorf("page considered blank without speck removal (ink %v)", ink)
+	}
+
+	d = page.DefaultBlankDetector
+	d.Margin = 0.5
+	if err := d.Validate(); err == nil {
+		t.Errorf("Validate(margin 0.5) unexpectedly succeeded")
+	}
+}
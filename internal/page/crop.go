@@ -0,0 +1,127 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page
+
+import "image"
+
+const (
+	// cropBlocks is the number of blocks (along the shorter side of the page)
+	// into which pages are divided for finding the paper. Finer blocks are not
+	// needed: at 600 dpi, a block is about 0.35mm wide.
+	cropBlocks = 600
+
+	// minPaperArea is the fraction of the page which the paper needs to cover
+	// at least for it to be told from the background.
+	minPaperArea = 0.01
+)
+
+// PaperBounds returns the part of the grayscale image img which is covered by
+// the paper, and whether the paper could be told from the scanner background
+// around it (e.g. the dark overscan area of a document feeder, or the lid of
+// a flatbed scanner). If the paper covers all of img, PaperBounds returns
+// img’s bounds.
+//
+// The paper is the largest connected area which is brighter than the
+// background: img is divided into blocks, whose average luminance is split
+// into bright and dark using Otsu’s method. Text on the paper does not
+// disconnect the paper, as the paper’s margins connect all of it.
+func PaperBounds(img *image.Gray) (image.Rectangle, bool) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	step := max(1, min(width, height)/cropBlocks)
+	bw, bh := width/step, height/step
+	if bw == 0 || bh == 0 {
+		return image.Rectangle{}, false
+	}
+
+	// Average the luminance of each block.
+	blocks := image.NewGray(image.Rect(0, 0, bw, bh))
+	sums := make([]int, bw)
+	var hist [256]int
+	for by := 0; by < bh; by++ {
+		clear(sums)
+		for y := by * step; y < (by+1)*step; y++ {
+			px := row(img, y)
+			for bx := range sums {
+				for _, v := range px[bx*step : (bx+1)*step] {
+					sums[bx] += int(v)
+				}
+			}
+		}
+		dst := row(blocks, by)
+		for bx, sum := range sums {
+			dst[bx] = uint8(sum / (step * step))
+			hist[dst[bx]]++
+		}
+	}
+
+	// Paper is brighter than mid-gray, even if Otsu’s method splits a page
+	// which is only background (or only paper) into a darker and a brighter
+	// part. components labels black pixels, so paper is black in the mask.
+	level := max(otsuLevel(&hist), defaultLevel)
+	for idx, v := range blocks.Pix {
+		if v > level {
+			blocks.Pix[idx] = 0x00
+		} else {
+			blocks.Pix[idx] = 0xff
+		}
+	}
+	var paper component
+	for _, c := range components(blocks, blocks.Rect) {
+		if c.pixels > paper.pixels {
+			paper = c
+		}
+	}
+	if float64(paper.pixels) < minPaperArea*float64(bw*bh) {
+		return image.Rectangle{}, false
+	}
+
+	// Blocks along the paper’s edges are partly background (or the shadow of
+	// the paper’s edge), so they are trimmed, too.
+	r := image.Rect(
+		paper.bounds.Min.X*step,
+		paper.bounds.Min.Y*step,
+		paper.bounds.Max.X*step,
+		paper.bounds.Max.Y*step)
+	if paper.bounds.Min.X > 0 {
+		r.Min.X += step
+	}
+	if paper.bounds.Min.Y > 0 {
+		r.Min.Y += step
+	}
+	if paper.bounds.Max.X < bw {
+		r.Max.X -= step
+	} else {
+		r.Max.X = width
+	}
+	if paper.bounds.Max.Y < bh {
+		r.Max.Y -= step
+	} else {
+		r.Max.Y = height
+	}
+	if r.Empty() {
+		return image.Rectangle{}, false
+	}
+	return r, true
+}
+
+// Crop returns a copy of the part r of img.
+func Crop(img *image.Gray, r image.Rectangle) *image.Gray {
+	r = r.Intersect(img.Rect)
+	out := image.NewGray(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := range r.Dy() {
+		copy(row(out, y), img.Pix[img.PixOffset(r.Min.X, r.Min.Y+y):][:r.Dx()])
+	}
+	return out
+}
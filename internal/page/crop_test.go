@@ -0,0 +1,72 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// overscan returns a flatbed scan of a receipt: a page of text, placed on a
+// dark scanner background.
+func overscan(receipt image.Rectangle) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 2480, 3508))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0x30}), image.Point{}, draw.Src)
+	text := textPage()
+	draw.Draw(img, receipt, image.NewUniform(color.Gray{0xf0}), image.Point{}, draw.Src)
+	draw.Draw(img, receipt.Inset(40), text, image.Point{}, draw.Src)
+	// The shadow of the paper’s edge.
+	draw.Draw(img, image.Rect(receipt.Max.X, receipt.Min.Y+10, receipt.Max.X+6, receipt.Max.Y+6), image.NewUniform(color.Gray{0x10}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestPaperBounds(t *testing.T) {
+	receipt := image.Rect(300, 200, 1100, 2000)
+	img := overscan(receipt)
+	got, ok := page.PaperBounds(img)
+	if !ok {
+		t.Fatalf("PaperBounds: paper not found")
+	}
+	// The paper’s edges are trimmed by at most a few pixels, and no
+	// background remains.
+	if !got.In(receipt) || got.Dx() < receipt.Dx()-20 || got.Dy() < receipt.Dy()-20 {
+		t.Errorf("PaperBounds = %v, want (almost) %v", got, receipt)
+	}
+	cropped := page.Crop(img, got)
+	if got, want := cropped.Bounds(), image.Rect(0, 0, got.Dx(), got.Dy()); got != want {
+		t.Errorf("Crop: unexpected bounds: got %v, want %v", got, want)
+	}
+	if got, want := cropped.GrayAt(0, 0).Y, uint8(0xf0); got != want {
+		t.Errorf("Crop: unexpected corner: got %#x, want %#x", got, want)
+	}
+
+	// Paper covering the whole page is not cropped.
+	full := overscan(img.Bounds())
+	if got, ok := page.PaperBounds(full); !ok || got != full.Bounds() {
+		t.Errorf("PaperBounds(full page) = %v, %v, want %v", got, ok, full.Bounds())
+	}
+}
+
+func TestPaperBoundsBackground(t *testing.T) {
+	// A scan without paper is only background.
+	img := overscan(image.Rectangle{})
+	if got, ok := page.PaperBounds(img); ok {
+		t.Errorf("PaperBounds(background) = %v, want not found", got)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// coarseStep and fineStep are the angle steps (in degrees) with which
+	// SkewAngle first searches the whole range, and then refines the angle
+	// around the best candidate.
+	coarseStep = 0.25
+	fineStep   = 0.025
+
+	// minSkewPoints is the number of sampled black pixels below which pages
+	// are considered to not contain enough text to detect their skew.
+	minSkewPoints = 1000
+
+	// minSkewContrast is how much more pronounced the lines of the projection
+	// profile need to be at the best angle than at the worst angle for the
+	// page to be considered to contain text lines at all.
+	minSkewContrast = 1.1
+)
+
+// SkewAngle returns the angle in degrees (at most maxAngle in either
+// direction) by which the text lines of the black/white image bin are
+// rotated clockwise, and whether the image contains enough text lines to
+// tell. If hint is non-nil, e.g. because the scanner measured the skew of
+// the paper, it is considered along with the other candidate angles.
+//
+// The angle is the one at which projecting the black pixels along lines of
+// that angle results in the most pronounced profile (i.e. the highest sum of
+// squared line counts): along the text lines, projections alternate between
+// many black pixels (text) and none (line spacing).
+func SkewAngle(bin *image.Gray, maxAngle float64, hint *float64) (float64, bool) {
+	points := skewPoints(bin)
+	if len(points) < minSkewPoints {
+		return 0, false
+	}
+	bins := make([]int, 0, bin.Rect.Dy()*2)
+	score := func(angle float64) float64 {
+		return projectionScore(points, bin.Rect.Dx(), bin.Rect.Dy(), angle, bins)
+	}
+
+	best, bestScore := 0.0, score(0)
+	worstScore := bestScore
+	steps := int(maxAngle / coarseStep)
+	for i := -steps; i <= steps; i++ {
+		angle := float64(i) * coarseStep
+		s := score(angle)
+		if s > bestScore {
+			best, bestScore = angle, s
+		}
+		worstScore = min(worstScore, s)
+	}
+	if hint != nil && math.Abs(*hint) <= maxAngle {
+		if s := score(*hint); s > bestScore {
+			best, bestScore = *hint, s
+		}
+	}
+	if bestScore < minSkewContrast*worstScore {
+		return 0, false
+	}
+
+	coarse := best
+	for angle := coarse - coarseStep; angle <= coarse+coarseStep; angle += fineStep {
+		if math.Abs(angle) > maxAngle {
+			continue
+		}
+		if s := score(angle); s > bestScore {
+			best, bestScore = angle, s
+		}
+	}
+	return best, true
+}
+
+// skewPoints returns the coordinates of a sample of the black pixels of bin:
+// every fourth column suffices to follow the text lines, whereas every row is
+// needed to resolve small angles.
+func skewPoints(bin *image.Gray) []image.Point {
+	var points []image.Point
+	for y := 0; y < bin.Rect.Dy(); y++ {
+		r := row(bin, y)
+		for x := 0; x < len(r); x += 4 {
+			if r[x] == 0x00 {
+				points = append(points, image.Point{x, y})
+			}
+		}
+	}
+	return points
+}
+
+// projectionScore projects points along lines of the specified angle onto the
+// left edge of a width×height image and returns the sum of squared counts.
+// bins is used as scratch space.
+func projectionScore(points []image.Point, width, height int, angle float64, bins []int) float64 {
+	slope := math.Tan(angle * math.Pi / 180)
+	// Lines which intersect the image can start above or below it.
+	pad := int(math.Ceil(math.Abs(slope)*float64(width))) + 1
+	bins = bins[:0]
+	for range height + 2*pad {
+		bins = append(bins, 0)
+	}
+	for _, p := range points {
+		bins[int(math.Round(float64(p.Y)-float64(p.X)*slope))+pad]++
+	}
+	var score float64
+	for _, n := range bins {
+		score += float64(n) * float64(n)
+	}
+	return score
+}
+
+// Rotate returns a copy of the black/white image bin rotated by angle degrees
+// counter-clockwise around its center, e.g. to straighten text lines which
+// SkewAngle found to be rotated clockwise by angle degrees. The size of the
+// image is retained: areas rotated into the image are white.
+func Rotate(bin *image.Gray, angle float64) *image.Gray {
+	width, height := bin.Rect.Dx(), bin.Rect.Dy()
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	cx, cy := float64(width)/2, float64(height)/2
+	for y := 0; y < height; y++ {
+		dst := row(out, y)
+		dy := float64(y) + 0.5 - cy
+		// Each pixel of out is taken from the pixel of bin which rotating
+		// clockwise moves it to.
+		sx := cx - cx*cos - dy*sin
+		sy := cy - cx*sin + dy*cos
+		for x := range dst {
+			ix, iy := int(math.Floor(sx+0.5*cos)), int(math.Floor(sy+0.5*sin))
+			if ix >= 0 && ix < width && iy >= 0 && iy < height {
+				dst[x] = bin.Pix[iy*bin.Stride+ix]
+			} else {
+				dst[x] = 0xff // white
+			}
+			sx += cos
+			sy += sin
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// textPage returns a black/white page with lines of “words” (black boxes of
+// random width) on it.
+func textPage() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 800, 1100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xff}), image.Point{}, draw.Src)
+	rnd := rand.New(rand.NewSource(1))
+	black := image.NewUniform(color.Gray{0x00})
+	for y := 100; y < 1000; y += 30 {
+		for x := 100; x < 700; {
+			width := 10 + rnd.Intn(60)
+			draw.Draw(img, image.Rect(x, y, min(x+width, 700), y+12), black, image.Point{}, draw.Src)
+			x += width + 8
+		}
+	}
+	return img
+}
+
+func TestSkewAngle(t *testing.T) {
+	straight := textPage()
+	for _, want := range []float64{0, 0.7, -2.3, 4.1} {
+		// Rotating by -want skews the text lines clockwise by want.
+		skewed := page.Rotate(straight, -want)
+		got, ok := page.SkewAngle(skewed, 5, nil)
+		if !ok {
+			t.Fatalf("skew %v: no text lines found", want)
+		}
+		if math.Abs(got-want) > 0.1 {
+			t.Errorf("skew %v: detected angle %v", want, got)
+		}
+
+		// Deskewing results in straight lines again.
+		if got, ok := page.SkewAngle(page.Rotate(skewed, got), 5, nil); !ok || math.Abs(got) > 0.1 {
+			t.Errorf("skew %v: deskewed page has skew %v (ok = %v)", want, got, ok)
+		}
+	}
+}
+
+func TestSkewAngleHint(t *testing.T) {
+	// The hint lies between the coarse candidate angles.
+	const want = 1.13
+	skewed := page.Rotate(textPage(), -want)
+	hint := want
+	got, ok := page.SkewAngle(skewed, 5, &hint)
+	if !ok || math.Abs(got-want) > 0.05 {
+		t.Errorf("SkewAngle(hint %v) = %v, %v", hint, got, ok)
+	}
+
+	// An implausible hint does not change the result.
+	hint = -3
+	got, ok = page.SkewAngle(skewed, 5, &hint)
+	if !ok || math.Abs(got-want) > 0.1 {
+		t.Errorf("SkewAngle(hint %v) = %v, %v", hint, got, ok)
+	}
+}
+
+func TestSkewAngleBlank(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 800, 1100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xff}), image.Point{}, draw.Src)
+	if got, ok := page.SkewAngle(img, 5, nil); ok {
+		t.Errorf("SkewAngle(blank page) = %v, want no text lines", got)
+	}
+
+	// Noise contains no text lines, either.
+	rnd := rand.New(rand.NewSource(1))
+	for idx := range img.Pix {
+		if rnd.Intn(4) == 0 {
+			img.Pix[idx] = 0x00
+		}
+	}
+	if got, ok := page.SkewAngle(img, 5, nil); ok {
+		t.Errorf("SkewAngle(noise) = %v, want no text lines", got)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page
+
+import (
+	"fmt"
+	"image"
+)
+
+const (
+	// minOrientationPixels is the number of black pixels below which pages
+	// are considered to not contain enough text to detect their orientation.
+	minOrientationPixels = 1000
+
+	// minLineContrast is how much more the black pixels of the page need to
+	// vary along one axis than along the other for the page to be considered
+	// to contain text lines along the latter.
+	minLineContrast = 1.5
+
+	// minOutsideCore is the fraction of black pixels which need to be outside
+	// the text lines’ core (i.e. in ascenders and descenders) to tell which
+	// side is up.
+	minOutsideCore = 0.01
+
+	// minAsymmetry is how many more black pixels need to be on one side of
+	// the text lines’ core than on the other to tell which side is up.
+	minAsymmetry = 1.2
+)
+
+// Orientation returns the clockwise rotation in degrees (0, 90, 180 or 270)
+// which turns the text of the black/white image bin upright (see Turn), and
+// whether bin contains enough text lines to tell.
+//
+// The direction of the text lines is the axis along which the number of black
+// pixels varies least: across text lines, rows (or columns) of text alternate
+// with line spacing. Which side is up is determined from the ink on either
+// side of the core of each text line (the band of lowercase letters without
+// ascenders and descenders): in Latin script, more ink is above the core
+// (ascenders, capital letters, dots) than below it (descenders).
+func Orientation(bin *image.Gray) (int, bool) {
+	width, height := bin.Rect.Dx(), bin.Rect.Dy()
+	rows := make([]int, height)
+	cols := make([]int, width)
+	var black int
+	for y := 0; y < height; y++ {
+		for x, v := range row(bin, y) {
+			if v == 0x00 {
+				rows[y]++
+				cols[x]++
+				black++
+			}
+		}
+	}
+	if black < minOrientationPixels {
+		return 0, false
+	}
+	// upFirst returns whether the tops of the text lines across which profile
+	// runs point towards the start of profile, and whether that can be told.
+	upFirst := func(profile []int) (bool, bool) {
+		before, after := lineAsymmetry(profile)
+		if before+after < minOutsideCore*float64(black) {
+			return false, false
+		}
+		if before >= minAsymmetry*after {
+			return true, true
+		}
+		if after >= minAsymmetry*before {
+			return false, true
+		}
+		return false, false
+	}
+	rowVar, colVar := variation(rows), variation(cols)
+	switch {
+	case rowVar >= minLineContrast*colVar:
+		// Horizontal text lines: upright or upside down.
+		if up, ok := upFirst(rows); ok {
+			if up {
+				return 0, true
+			}
+			return 180, true
+		}
+	case colVar >= minLineContrast*rowVar:
+		// Vertical text lines, whose tops point left or right.
+		if up, ok := upFirst(cols); ok {
+			if up {
+				return 90, true
+			}
+			return 270, true
+		}
+	}
+	return 0, false
+}
+
+// variation returns the squared coefficient of variation of the profile,
+// ignoring the empty margins before and after the content.
+func variation(profile []int) float64 {
+	lo, hi := 0, len(profile)
+	for lo < hi && profile[lo] == 0 {
+		lo++
+	}
+	for hi > lo && profile[hi-1] == 0 {
+		hi--
+	}
+	if hi-lo < 2 {
+		return 0
+	}
+	var sum, sq float64
+	for _, n := range profile[lo:hi] {
+		sum += float64(n)
+		sq += float64(n) * float64(n)
+	}
+	count := float64(hi - lo)
+	mean := sum / count
+	if mean == 0 {
+		return 0
+	}
+	return (sq/count - mean*mean) / (mean * mean)
+}
+
+// lineAsymmetry splits the profile (black pixels per row across horizontal
+// text lines, or per column across vertical text lines) into text lines and
+// returns how many black pixels are before and after the core of each line,
+// summed up across lines.
+func lineAsymmetry(profile []int) (before, after float64) {
+	var peak int
+	for _, n := range profile {
+		peak = max(peak, n)
+	}
+	// Text lines are separated by line spacing, which contains (almost) no
+	// black pixels.
+	gap := peak / 20
+	for start := 0; start < len(profile); {
+		if profile[start] <= gap {
+			start++
+			continue
+		}
+		end := start
+		var linePeak int
+		for end < len(profile) && profile[end] > gap {
+			linePeak = max(linePeak, profile[end])
+			end++
+		}
+		// The core contains the densest rows of the line.
+		coreStart, coreEnd := start, end
+		for profile[coreStart] < linePeak/2 {
+			coreStart++
+		}
+		for profile[coreEnd-1] < linePeak/2 {
+			coreEnd--
+		}
+		for _, n := range profile[start:coreStart] {
+			before += float64(n)
+		}
+		for _, n := range profile[coreEnd:end] {
+			after += float64(n)
+		}
+		start = end
+	}
+	return before, after
+}
+
+// Turn returns a copy of the image bin rotated clockwise by degrees, which
+// must be 0, 90, 180 or 270. Unlike Rotate, Turn does not lose any pixels:
+// width and height are swapped when turning by 90 or 270 degrees.
+func Turn(bin *image.Gray, degrees int) *image.Gray {
+	width, height := bin.Rect.Dx(), bin.Rect.Dy()
+	var out *image.Gray
+	switch degrees {
+	case 0:
+		out = image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			copy(row(out, y), row(bin, y))
+		}
+	case 90:
+		out = image.NewGray(image.Rect(0, 0, height, width))
+		for y := 0; y < width; y++ {
+			dst := row(out, y)
+			for x := range dst {
+				dst[x] = bin.Pix[(height-1-x)*bin.Stride+y]
+			}
+		}
+	case 180:
+		out = image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			src, dst := row(bin, height-1-y), row(out, y)
+			for x := range dst {
+				dst[x] = src[width-1-x]
+			}
+		}
+	case 270:
+		out = image.NewGray(image.Rect(0, 0, height, width))
+		for y := 0; y < width; y++ {
+			dst := row(out, y)
+			for x := range dst {
+				dst[x] = bin.Pix[x*bin.Stride+width-1-y]
+			}
+		}
+	default:
+		panic(fmt.Sprintf("page.Turn: invalid rotation %d", degrees))
+	}
+	return out
+}
+
+// ValidRotation returns an error unless degrees is a rotation which Turn
+// supports.
+func ValidRotation(degrees int) error {
+	switch degrees {
+	case 0, 90, 180, 270:
+		return nil
+	}
+	return fmt.Errorf("invalid rotation %d: must be 0, 90, 180 or 270 degrees", degrees)
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// latinPage returns an upright black/white page with lines of “words” whose
+// letters have ascenders more often than descenders, like Latin script.
+func latinPage() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 800, 1100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xff}), image.Point{}, draw.Src)
+	rnd := rand.New(rand.NewSource(1))
+	black := image.NewUniform(color.Gray{0x00})
+	for y := 100; y < 1000; y += 30 {
+		for x := 100; x < 680; x += 10 {
+			if rnd.Intn(6) == 0 {
+				continue // space between words
+			}
+			// The core of the letter, and its ascender or descender.
+			draw.Draw(img, image.Rect(x, y, x+7, y+10), black, image.Point{}, draw.Src)
+			switch rnd.Intn(10) {
+			case 0, 1, 2, 3:
+				draw.Draw(img, image.Rect(x, y-6, x+2, y), black, image.Point{}, draw.Src)
+			case 4:
+				draw.Draw(img, image.Rect(x+5, y+10, x+7, y+15), black, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+func TestOrientation(t *testing.T) {
+	upright := latinPage()
+	for _, turned := range []int{0, 90, 180, 270} {
+		img := page.Turn(upright, turned)
+		got, ok := page.Orientation(img)
+		if !ok {
+			t.Fatalf("page turned by %d degrees: orientation not detected", turned)
+		}
+		if want := (360 - turned) % 360; got != want {
+			t.Errorf("page turned by %d degrees: got rotation %d, want %d", turned, got, want)
+		}
+		if fixed := page.Turn(img, got); !bytes.Equal(fixed.Pix, upright.Pix) {
+			t.Errorf("page turned by %d degrees: rotating by %d does not restore the page", turned, got)
+		}
+	}
+}
+
+func TestOrientationBlank(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 800, 1100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xff}), image.Point{}, draw.Src)
+	if got, ok := page.Orientation(img); ok {
+		t.Errorf("Orientation(blank page) = %d, want not detected", got)
+	}
+
+	// Without ascenders and descenders, it is impossible to tell which side
+	// is up.
+	if got, ok := page.Orientation(textPage()); ok {
+		t.Errorf("Orientation(page without ascenders) = %d, want not detected", got)
+	}
+}
+
+func TestTurn(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(img.Pix, []uint8{
+		1, 2, 3,
+		4, 5, 6,
+	})
+	for _, tt := range []struct {
+		degrees int
+		want    []uint8
+	}{
+		{0, []uint8{1, 2, 3, 4, 5, 6}},
+		{90, []uint8{4, 1, 5, 2, 6, 3}},
+		{180, []uint8{6, 5, 4, 3, 2, 1}},
+		{270, []uint8{3, 6, 2, 5, 1, 4}},
+	} {
+		if got := page.Turn(img, tt.degrees).Pix; !bytes.Equal(got, tt.want) {
+			t.Errorf("Turn(%d) = %v, want %v", tt.degrees, got, tt.want)
+		}
+	}
+}
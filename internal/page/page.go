@@ -14,44 +14,169 @@
 
 // Package page implements scanned pages (as JPEG), which can either be already
 // binarized or are binarized if not loaded to memory yet.
+//
+// Pages can be kept in memory or stored on disk (see FromFile), in which case
+// their contents are read on demand and not retained.
 package page
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
 
 	_ "image/jpeg"
+
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
 )
 
 type Any struct {
+	// SkewHint is the skew angle in degrees (clockwise) of the page as
+	// measured by the scanner, if the scanner measures it. It is recorded in
+	// the job when the page is staged (see jobqueue.Staging).
+	SkewHint *float64
+
+	// DPI is the resolution at which the page was scanned, or zero if
+	// unknown. It is recorded in the job like SkewHint.
+	DPI int
+
 	jpegBytes []byte
 	binarized *image.Gray
 	whitePct  float64
+
+	// jpegPath and binarizedPath are set for pages stored on disk.
+	jpegPath      string
+	binarizedPath string
 }
 
 func (p *Any) JPEGBytes() ([]byte, error) {
+	if p.jpegPath != "" {
+		return os.ReadFile(p.jpegPath)
+	}
 	return p.jpegBytes, nil
 }
 
+// Binarized returns the page as a black/white image, as binarized by the
+// scanner or, if the scanner did not binarize the page, by
+// DefaultThresholder, along with the fraction of white pixels.
 func (p *Any) Binarized() (*image.Gray, float64, error) {
+	return p.BinarizedWith(nil)
+}
+
+// BinarizedWith is like Binarized, but binarizes pages which the scanner did
+// not binarize with th (DefaultThresholder if nil).
+func (p *Any) BinarizedWith(th Thresholder) (*image.Gray, float64, error) {
 	if p.binarized != nil {
 		return p.binarized, p.whitePct, nil
 	}
 
+	if p.binarizedPath != "" {
+		return readBinarized(p.binarizedPath)
+	}
+
+	if p.jpegPath != "" {
+		b, err := p.JPEGBytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, 0, err
+		}
+		bin, whitePct := Binarize(img, th)
+		return bin, whitePct, nil
+	}
+
 	img, _, err := image.Decode(bytes.NewReader(p.jpegBytes))
 	if err != nil {
 		return nil, 0, err
 	}
 
-	p.binarized, p.whitePct = binarize(img)
-	return p.binarized, p.whitePct, nil
+	bin, whitePct := Binarize(img, th)
+	if th == nil {
+		p.binarized, p.whitePct = bin, whitePct
+	}
+	return bin, whitePct, nil
 }
 
 func JPEGPageFromBytes(b []byte) *Any {
 	return &Any{jpegBytes: b}
 }
 
+// FromFile returns a page which is stored on disk as JPEG in jpegPath. If
+// binarizedPath is non-empty, the page was binarized already and is stored as
+// PNG in binarizedPath (see WriteFiles).
+func FromFile(jpegPath, binarizedPath string) *Any {
+	return &Any{
+		jpegPath:      jpegPath,
+		binarizedPath: binarizedPath,
+	}
+}
+
+// WriteFiles stores the page on disk (atomically and durably, see atomicfile)
+// as JPEG in jpegPath and, if the page was binarized already (e.g. by the
+// scanner), as PNG in binarizedPath. It returns
+// the stored page (see FromFile), which does not retain the page contents in
+// memory.
+func (p *Any) WriteFiles(jpegPath, binarizedPath string) (*Any, error) {
+	b, err := p.JPEGBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(jpegPath, b, 0600); err != nil {
+		return nil, err
+	}
+	if p.binarized == nil && p.binarizedPath == "" {
+		return FromFile(jpegPath, ""), nil
+	}
+	bin, _, err := p.Binarized()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBinarized(binarizedPath, bin); err != nil {
+		return nil, err
+	}
+	return FromFile(jpegPath, binarizedPath), nil
+}
+
+func writeBinarized(fn string, bin *image.Gray) error {
+	return atomicfile.Write(fn, 0600, func(w io.Writer) error {
+		// Binarized pages compress well even at the fastest compression
+		// level.
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		return enc.Encode(w, bin)
+	})
+}
+
+func readBinarized(fn string) (*image.Gray, float64, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	img, err := png.Decode(bufio.NewReader(f))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", fn, err)
+	}
+	bin, ok := img.(*image.Gray)
+	if !ok {
+		bin = image.NewGray(img.Bounds())
+		draw.Draw(bin, bin.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	var white int
+	for _, px := range bin.Pix {
+		if px == 0xff {
+			white++
+		}
+	}
+	return bin, float64(white) / float64(len(bin.Pix)), nil
+}
+
 func Binarized(jpegBytes []byte, binarized *image.Gray, whitePct float64) *Any {
 	return &Any{
 		jpegBytes: jpegBytes,
@@ -60,27 +185,37 @@ func Binarized(jpegBytes []byte, binarized *image.Gray, whitePct float64) *Any {
 	}
 }
 
-// binarize turns image into a black/white image.
-func binarize(img image.Image) (*image.Gray, float64) {
+// Binarize turns img into a black/white image using th (DefaultThresholder if
+// nil) and returns it along with the fraction of white pixels.
+func Binarize(img image.Image, th Thresholder) (*image.Gray, float64) {
+	if th == nil {
+		th = DefaultThresholder
+	}
+	out := Luminance(img)
+	white := th.NewBinarizer(out).Finish()
+	bounds := out.Bounds()
+	return out, float64(white) / float64(bounds.Dx()*bounds.Dy())
+}
+
+// Luminance returns a grayscale copy of img.
+func Luminance(img image.Image) *image.Gray {
 	bounds := img.Bounds()
 	out := image.NewGray(bounds)
-
-	var white int
+	if gray, ok := img.(*image.Gray); ok {
+		// The stride of decoded images can exceed their width (e.g. JPEG
+		// images are decoded into whole blocks of 8x8 pixels).
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(out.Pix[out.PixOffset(bounds.Min.X, y):][:bounds.Dx()], gray.Pix[gray.PixOffset(bounds.Min.X, y):])
+		}
+		return out
+	}
 	// This loop arrangement is faster:
 	// 49s in Y outer, then X inner
 	// 63s in X outer, then Y inner
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			c := img.At(x, y)
-			a := color.GrayModel.Convert(c).(color.Gray).Y
-			if a > 127 {
-				out.SetGray(x, y, color.Gray{0xff}) // white
-				white++
-			} else {
-				out.SetGray(x, y, color.Gray{0x00}) // black
-			}
+			out.SetGray(x, y, color.GrayModel.Convert(img.At(x, y)).(color.Gray))
 		}
 	}
-	total := (bounds.Max.Y - bounds.Min.Y) * (bounds.Max.X - bounds.Min.X)
-	return out, float64(white) / float64(total)
+	return out
 }
@@ -0,0 +1,334 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// A Thresholder decides which pixels of a grayscale image become white when
+// binarizing the image.
+type Thresholder interface {
+	// NewBinarizer returns a Binarizer which binarizes img in place.
+	NewBinarizer(img *image.Gray) Binarizer
+}
+
+// A Binarizer binarizes a grayscale image in place, row by row, so that pages
+// can be binarized while they are being scanned (see package fss500) without
+// keeping a second copy of the page in memory. Rows are numbered from 0.
+type Binarizer interface {
+	// Advance is called once the first n rows of the image contain their
+	// luminance values. The Binarizer binarizes as many of these rows as it
+	// can already.
+	Advance(n int)
+
+	// Finish binarizes all remaining rows and returns the number of white
+	// pixels in the image.
+	Finish() int
+}
+
+// defaultLevel is the level of DefaultThresholder.
+const defaultLevel = 127
+
+// DefaultThresholder is used where no Thresholder is configured. It matches
+// how scan2drive binarized pages before thresholding was configurable.
+var DefaultThresholder = Fixed(defaultLevel)
+
+// ThresholdConfig configures a Thresholder, e.g. in processing profiles.
+type ThresholdConfig struct {
+	// Method is one of “fixed” (the default), “otsu” or “sauvola”.
+	Method string `json:"method"`
+
+	// Level is the luminance above which pixels become white with method
+	// fixed, defaulting to 127.
+	Level *int `json:"level,omitempty"`
+
+	// Window is the size in pixels of the (square) neighborhood of each pixel
+	// which method sauvola considers, defaulting to 51.
+	Window int `json:"window,omitempty"`
+
+	// K is the sensitivity of method sauvola to the contrast within the
+	// neighborhood, defaulting to 0.34. Higher values turn more pixels white.
+	K float64 `json:"k,omitempty"`
+}
+
+// Thresholder returns the configured Thresholder.
+func (c *ThresholdConfig) Thresholder() (Thresholder, error) {
+	switch c.Method {
+	case "", "fixed":
+		if c.Level == nil {
+			return DefaultThresholder, nil
+		}
+		if *c.Level < 0 || *c.Level > 255 {
+			return nil, fmt.Errorf("threshold level %d out of range [0, 255]", *c.Level)
+		}
+		return Fixed(uint8(*c.Level)), nil
+	case "otsu":
+		return Otsu(), nil
+	case "sauvola":
+		window, k := c.Window, c.K
+		if window == 0 {
+			window = 51
+		}
+		if k == 0 {
+			k = 0.34
+		}
+		if window < 3 || window%2 == 0 {
+			return nil, fmt.Errorf("sauvola window must be an odd number >= 3, got %d", window)
+		}
+		if k < 0 || k > 1 {
+			return nil, fmt.Errorf("sauvola k %v out of range [0, 1]", k)
+		}
+		return Sauvola(window, k), nil
+	default:
+		return nil, fmt.Errorf("unknown thresholding method %q", c.Method)
+	}
+}
+
+// row returns row y of img.
+func row(img *image.Gray, y int) []uint8 {
+	return img.Pix[y*img.Stride:][:img.Rect.Dx()]
+}
+
+type fixed uint8
+
+// Fixed returns a Thresholder which turns all pixels whose luminance is above
+// level white. It works well for clean black-on-white documents only.
+func Fixed(level uint8) Thresholder { return fixed(level) }
+
+func (f fixed) NewBinarizer(img *image.Gray) Binarizer {
+	return &fixedBinarizer{img: img, level: uint8(f)}
+}
+
+type fixedBinarizer struct {
+	img   *image.Gray
+	level uint8
+	done  int // number of binarized rows
+	white int
+}
+
+func (b *fixedBinarizer) Advance(n int) {
+	for ; b.done < n; b.done++ {
+		r := row(b.img, b.done)
+		for x, v := range r {
+			if v > b.level {
+				r[x] = 0xff // white
+				b.white++
+			} else {
+				r[x] = 0x00 // black
+			}
+		}
+	}
+}
+
+func (b *fixedBinarizer) Finish() int {
+	b.Advance(b.img.Rect.Dy())
+	return b.white
+}
+
+type otsu struct{}
+
+// Otsu returns a Thresholder which picks a global threshold per image, such
+// that the variance between the luminance of the resulting black and white
+// pixels is maximal (Otsu’s method). It adapts to pale or dark scans, but not
+// to uneven backgrounds within a page. Pages are only binarized in Finish,
+// once the histogram of the whole image is known.
+func Otsu() Thresholder { return otsu{} }
+
+func (otsu) NewBinarizer(img *image.Gray) Binarizer {
+	return &otsuBinarizer{img: img}
+}
+
+type otsuBinarizer struct {
+	img  *image.Gray
+	done int // number of rows in hist
+	hist [256]int
+}
+
+func (b *otsuBinarizer) Advance(n int) {
+	for ; b.done < n; b.done++ {
+		for _, v := range row(b.img, b.done) {
+			b.hist[v]++
+		}
+	}
+}
+
+// otsuLevel returns the level which maximizes the between-class variance of
+// the pixels at or below the level and those above it.
+func otsuLevel(hist *[256]int) uint8 {
+	var total, sum float64
+	for v, n := range hist {
+		total += float64(n)
+		sum += float64(v * n)
+	}
+	var (
+		best     float64
+		level    uint8
+		w0, sum0 float64
+		found    bool
+	)
+	for v, n := range hist {
+		w0 += float64(n)
+		sum0 += float64(v * n)
+		w1 := total - w0
+		if w0 == 0 || w1 == 0 {
+			continue
+		}
+		m0 := sum0 / w0
+		m1 := (sum - sum0) / w1
+		between := w0 * w1 * (m0 - m1) * (m0 - m1)
+		if !found || between > best {
+			best = between
+			level = uint8(v)
+			found = true
+		}
+	}
+	if !found {
+		// All pixels have the same luminance: fall back to the default
+		// level, so that uniformly white pages stay white.
+		return defaultLevel
+	}
+	return level
+}
+
+func (b *otsuBinarizer) Finish() int {
+	b.Advance(b.img.Rect.Dy())
+	fb := fixedBinarizer{img: b.img, level: otsuLevel(&b.hist)}
+	return fb.Finish()
+}
+
+type sauvola struct {
+	window int
+	k      float64
+}
+
+// Sauvola returns a Thresholder which computes a threshold for each pixel
+// from the mean m and standard deviation s of the luminance within the
+// window×window pixels around it: T = m·(1 + k·(s/128 − 1)) (Sauvola’s
+// method). It handles uneven backgrounds, e.g. colored forms, shadows or
+// thermal receipts, and pale strokes such as pencil.
+//
+// Means and standard deviations are computed from integral images of the
+// luminance and its square. To binarize images row by row with bounded
+// memory, only the band of window rows around the current row is summed up.
+func Sauvola(window int, k float64) Thresholder {
+	return sauvola{window: window, k: k}
+}
+
+func (s sauvola) NewBinarizer(img *image.Gray) Binarizer {
+	width := img.Rect.Dx()
+	return &sauvolaBinarizer{
+		img:    img,
+		radius: s.window / 2,
+		k:      s.k,
+		ring:   make([][]uint8, s.window),
+		colSum: make([]int64, width),
+		colSq:  make([]int64, width),
+		sum:    make([]int64, width+1),
+		sq:     make([]int64, width+1),
+	}
+}
+
+type sauvolaBinarizer struct {
+	img    *image.Gray
+	radius int
+	k      float64
+
+	// ring contains copies of the luminance values of the rows in the band,
+	// which are needed to remove the rows from the column sums after they
+	// were binarized in place.
+	ring [][]uint8
+
+	// colSum and colSq contain the sum of the luminance (and of its square)
+	// of each column within rows [lo, added).
+	colSum, colSq []int64
+	lo, added     int
+
+	// sum and sq are the integrals of colSum and colSq along the row.
+	sum, sq []int64
+
+	done  int // number of binarized rows
+	white int
+}
+
+func (b *sauvolaBinarizer) addRow(y int) {
+	// The ring only holds window rows: drop the oldest row first.
+	b.drop(y - len(b.ring) + 1)
+	r := row(b.img, y)
+	slot := y % len(b.ring)
+	b.ring[slot] = append(b.ring[slot][:0], r...)
+	for x, v := range r {
+		b.colSum[x] += int64(v)
+		b.colSq[x] += int64(v) * int64(v)
+	}
+	b.added = y + 1
+}
+
+// drop removes the rows before lo from the column sums.
+func (b *sauvolaBinarizer) drop(lo int) {
+	for ; b.lo < lo; b.lo++ {
+		for x, v := range b.ring[b.lo%len(b.ring)] {
+			b.colSum[x] -= int64(v)
+			b.colSq[x] -= int64(v) * int64(v)
+		}
+	}
+}
+
+func (b *sauvolaBinarizer) binarizeRow(y int) {
+	b.drop(y - b.radius)
+	for x := range b.colSum {
+		b.sum[x+1] = b.sum[x] + b.colSum[x]
+		b.sq[x+1] = b.sq[x] + b.colSq[x]
+	}
+	rows := int64(b.added - b.lo)
+	width := len(b.colSum)
+	r := row(b.img, y)
+	for x, v := range r {
+		x0 := max(0, x-b.radius)
+		x1 := min(width, x+b.radius+1)
+		n := float64(rows * int64(x1-x0))
+		mean := float64(b.sum[x1]-b.sum[x0]) / n
+		variance := float64(b.sq[x1]-b.sq[x0])/n - mean*mean
+		stddev := math.Sqrt(max(variance, 0))
+		threshold := mean * (1 + b.k*(stddev/128-1))
+		if float64(v) > threshold {
+			r[x] = 0xff // white
+			b.white++
+		} else {
+			r[x] = 0x00 // black
+		}
+	}
+}
+
+func (b *sauvolaBinarizer) Advance(n int) {
+	for b.added < n {
+		b.addRow(b.added)
+		// A row is binarized once all rows of its window were added.
+		if y := b.added - 1 - b.radius; y >= b.done {
+			b.binarizeRow(y)
+			b.done = y + 1
+		}
+	}
+}
+
+func (b *sauvolaBinarizer) Finish() int {
+	b.Advance(b.img.Rect.Dy())
+	for ; b.done < b.img.Rect.Dy(); b.done++ {
+		b.binarizeRow(b.done)
+	}
+	return b.white
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package page_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// testPage returns a 200x100 pixel page whose background luminance is
+// returned by bg, with a 4 pixel wide vertical stroke every 20 pixels which
+// is delta darker than the background.
+func testPage(bg func(x, y int) uint8, delta uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			v := bg(x, y)
+			if x%20 < 4 {
+				v -= delta
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+// strokes returns the fraction of stroke pixels which are black and of
+// background pixels which are white in the binarized page.
+func strokes(bin *image.Gray) (black, white float64) {
+	var strokePx, bgPx, blackPx, whitePx int
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			v := bin.GrayAt(x, y).Y
+			if x%20 < 4 {
+				strokePx++
+				if v == 0x00 {
+					blackPx++
+				}
+			} else {
+				bgPx++
+				if v == 0xff {
+					whitePx++
+				}
+			}
+		}
+	}
+	return float64(blackPx) / float64(strokePx), float64(whitePx) / float64(bgPx)
+}
+
+func TestOtsu(t *testing.T) {
+	// Pale pencil on gray paper: above the fixed threshold.
+	img := testPage(func(x, y int) uint8 { return 200 }, 40)
+	if black, _ := strokes(binarize(img, page.DefaultThresholder)); black > 0 {
+		t.Fatalf("test page unexpectedly binarized correctly with the default thresholder")
+	}
+	black, white := strokes(binarize(img, page.Otsu()))
+	if black < 1 || white < 1 {
+		t.Errorf("otsu: %.2f of strokes black, %.2f of background white, want all", black, white)
+	}
+}
+
+func TestSauvola(t *testing.T) {
+	// A shadow darkens the left part of the page.
+	img := testPage(func(x, y int) uint8 { return uint8(100 + x/2) }, 40)
+	for _, th := range []page.Thresholder{page.DefaultThresholder, page.Otsu()} {
+		if _, white := strokes(binarize(img, th)); white == 1 {
+			t.Fatalf("test page unexpectedly binarized correctly with %T", th)
+		}
+	}
+	black, white := strokes(binarize(img, page.Sauvola(31, 0.2)))
+	if black < 0.99 || white < 0.99 {
+		t.Errorf("sauvola: %.2f of strokes black, %.2f of background white, want all", black, white)
+	}
+}
+
+func binarize(img *image.Gray, th page.Thresholder) *image.Gray {
+	bin, _ := page.Binarize(img, th)
+	return bin
+}
+
+func TestBinarizeRowByRow(t *testing.T) {
+	img := testPage(func(x, y int) uint8 { return uint8(100 + x/2 - y/4) }, 30)
+	for _, th := range []page.Thresholder{page.DefaultThresholder, page.Otsu(), page.Sauvola(15, 0.3)} {
+		want, wantPct := page.Binarize(img, th)
+
+		// Rows arrive in chunks, as when scanning.
+		got := page.Luminance(img)
+		b := th.NewBinarizer(got)
+		for n := 7; n < 100; n += 7 {
+			b.Advance(n)
+		}
+		white := b.Finish()
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%T: binarizing row by row differs from binarizing at once", th)
+		}
+		if gotPct := float64(white) / float64(len(got.Pix)); gotPct != wantPct {
+			t.Errorf("%T: unexpected white fraction: got %v, want %v", th, gotPct, wantPct)
+		}
+	}
+}
+
+func TestThresholdConfig(t *testing.T) {
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: `{}`},
+		{config: `{"method": "fixed", "level": 160}`},
+		{config: `{"method": "otsu"}`},
+		{config: `{"method": "sauvola", "window": 31, "k": 0.2}`},
+		{config: `{"method": "fixed", "level": 256}`, wantErr: true},
+		{config: `{"method": "sauvola", "window": 30}`, wantErr: true},
+		{config: `{"method": "niblack"}`, wantErr: true},
+	} {
+		var cfg page.ThresholdConfig
+		if err := json.Unmarshal([]byte(tt.config), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		_, err := cfg.Thresholder()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: Thresholder() = %v, want error: %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
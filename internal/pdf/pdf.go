@@ -175,10 +175,20 @@ endobj`, int(p.ID), p.Kids, len(p.Kids))
 	return err
 }
 
+// A4Width and A4Height are the size of a DIN A4 page in points.
+const (
+	A4Width  = 595.28
+	A4Height = 841.89
+)
+
 // Page represents a PDF page object with size DIN A4
 type Page struct {
 	Common
 
+	// Width and Height are the size of the page in points (1/72 inch). The
+	// page is DIN A4 portrait if they are zero.
+	Width, Height float64
+
 	Resources []Object // Image
 	Contents  []Object // Common (streams)
 
@@ -205,6 +215,10 @@ func (p *Page) Encode(w io.Writer, ids map[string]ObjectID) error {
 	for idx, o := range p.Resources {
 		xObjects[idx] = fmt.Sprintf("/%s %v", o.Name(), ids[o.Name()])
 	}
+	width, height := p.Width, p.Height
+	if width == 0 || height == 0 {
+		width, height = A4Width, A4Height
+	}
 	_, err := fmt.Fprintf(w, `
 %d 0 obj
 <<
@@ -216,9 +230,9 @@ func (p *Page) Encode(w io.Writer, ids map[string]ObjectID) error {
   /Contents %v
   /Parent %v
   /Type /Page
-  /MediaBox [ 0 0 595.28 841.89 ]
+  /MediaBox [ 0 0 %.2f %.2f ]
 >>
-endobj`, int(p.ID), strings.Join(xObjects, "\n"), p.Contents, ids[p.Parent])
+endobj`, int(p.ID), strings.Join(xObjects, "\n"), p.Contents, ids[p.Parent], width, height)
 	return err
 }
 
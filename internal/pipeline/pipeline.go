@@ -0,0 +1,541 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipeline processes jobs according to a processing profile: a graph
+// of named stages (see scan2drive.ProfileConfig), e.g.
+//
+//	binarize → blank-skip → pdf → sinks
+//
+// Completion of each stage is persisted in the job directory as a
+// COMPLETE.<name> marker, so processing resumes with the stages which did not
+// complete yet, e.g. after a crash or a failed upload.
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/mayqtt"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// A Stage is one step of processing a job, e.g. binarizing its pages.
+type Stage interface {
+	// Run performs the stage for the job. Run is retried until it succeeds,
+	// so it should be safe to call repeatedly for the same job.
+	Run(ctx context.Context, j *jobqueue.Job) error
+}
+
+// CPUIntensive is implemented by stages which keep the CPU busy (as opposed to
+// e.g. waiting for uploads to finish). At most one CPU-intensive stage runs at
+// any time, across all jobs: the Raspberry Pi has enough cores to convert one
+// job while uploading others, but converting multiple jobs at once would only
+// make each of them slower.
+type CPUIntensive interface {
+	CPUIntensive()
+}
+
+// cpuSlot is held while running a CPUIntensive stage.
+var cpuSlot = make(chan struct{}, 1)
+
+// A Factory creates a Stage from its configuration.
+type Factory func(u *user.Account, cfg *scan2drive.StageConfig) (Stage, error)
+
+var factories = make(map[string]Factory)
+
+// Register makes a stage type available. Register is meant to be called from
+// init functions.
+func Register(typ string, f Factory) {
+	if _, ok := factories[typ]; ok {
+		panic(fmt.Sprintf("stage type %q registered twice", typ))
+	}
+	factories[typ] = f
+}
+
+// DefaultProfile is used for jobs without a profile (or with profile
+// “default”) unless the user configured a profile named default.
+var DefaultProfile = scan2drive.ProfileConfig{
+	Stages: []scan2drive.StageConfig{
+		{Type: "convert"},
+		{Type: "sinks", After: []string{"convert"}},
+	},
+}
+
+// reserved contains marker names which are not available as stage names.
+var reserved = map[string]bool{
+	"scan":   true,
+	"done":   true,
+	"rename": true,
+}
+
+// jobFiles contains the names of files in the job directory (besides pages,
+// COMPLETE.* markers and files of earlier scan2drive versions).
+var jobFiles = map[string]bool{
+	"job.json":     true,
+	"scan.pdf":     true,
+	"thumb.png":    true,
+	"pdf.drive_id": true,
+	"source":       true,
+	"profile":      true,
+}
+
+// validStageName returns an error unless name can be used as a stage name.
+// Page stages write into a directory of that name in the job directory, so
+// the name must neither leave the job directory nor collide with a file in it.
+func validStageName(name string) error {
+	if reserved[name] {
+		return fmt.Errorf("stage name %q is reserved", name)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("stage name %q is not a valid directory name", name)
+	}
+	if jobFiles[name] ||
+		strings.HasPrefix(name, "COMPLETE.") ||
+		strings.HasPrefix(name, ".") ||
+		(strings.HasPrefix(name, "page") && (strings.HasSuffix(name, ".jpg") || strings.HasSuffix(name, ".png"))) {
+		return fmt.Errorf("stage name %q collides with a file in the job directory", name)
+	}
+	return nil
+}
+
+type node struct {
+	name  string
+	after []string
+	stage Stage
+}
+
+// A Graph is a validated processing profile, ready to run.
+type Graph struct {
+	nodes []*node // in topological order
+}
+
+// Stages returns the names of all stages in the order in which they are
+// started when run sequentially.
+func (g *Graph) Stages() []string {
+	names := make([]string, len(g.nodes))
+	for idx, n := range g.nodes {
+		names[idx] = n.name
+	}
+	return names
+}
+
+// profile returns the user’s processing profile of the specified name, and
+// the name (“default” for an empty name).
+func profile(u *user.Account, name string) (scan2drive.ProfileConfig, string, error) {
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := u.Profiles[name]
+	if !ok {
+		if name != "default" {
+			return profile, name, fmt.Errorf("profile %q not found in profiles.json", name)
+		}
+		profile = DefaultProfile
+	}
+	return profile, name, nil
+}
+
+// ForJob returns the processing graph for the profile of job j.
+func ForJob(u *user.Account, j *jobqueue.Job) (*Graph, error) {
+	profile, name, err := profile(u, j.Profile)
+	if err != nil {
+		return nil, err
+	}
+	g, err := New(u, profile)
+	if err != nil {
+		return nil, fmt.Errorf("profile %q: %v", name, err)
+	}
+	return g, nil
+}
+
+// ScanThresholder returns the Thresholder of the convert stage of the user’s
+// processing profile of the specified name, for scanners which binarize pages
+// while scanning (see scaningest.Ingester.Thresholders): the convert stage
+// uses these pages as-is. Profiles without a convert stage do not use pages
+// binarized by the scanner, so that the DefaultThresholder is returned.
+func ScanThresholder(u *user.Account, name string) (page.Thresholder, error) {
+	profile, name, err := profile(u, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range profile.Stages {
+		if cfg.Type != "convert" {
+			continue
+		}
+		th, err := stageThresholder(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", name, err)
+		}
+		return th, nil
+	}
+	return page.DefaultThresholder, nil
+}
+
+// pdfWriter is implemented by stages which write scan.pdf.
+type pdfWriter interface {
+	// pdf returns the PDF of the original pages nums (starting at 1; all
+	// pages if nil) and the thumbnail of its first page, without writing
+	// them into the job directory.
+	pdf(ctx context.Context, j *jobqueue.Job, nums []int) (pdf, thumb []byte, err error)
+}
+
+// PDF returns a PDF of the original pages nums (starting at 1) of job j,
+// converted like scan.pdf by the processing profile of the job (pages which
+// the profile skips are left out), e.g. for sinks which split scan.pdf into
+// parts. Stages which scan.pdf depends on must have completed.
+func PDF(ctx context.Context, u *user.Account, j *jobqueue.Job, nums []int) ([]byte, error) {
+	g, err := ForJob(u, j)
+	if err != nil {
+		return nil, err
+	}
+	for idx := len(g.nodes) - 1; idx >= 0; idx-- {
+		if w, ok := g.nodes[idx].stage.(pdfWriter); ok {
+			pdf, _, err := w.pdf(ctx, j, nums)
+			return pdf, err
+		}
+	}
+	return nil, fmt.Errorf("profile %q: no stage writes scan.pdf", j.Profile)
+}
+
+// sinkStage delivers to a sink. Its name is sink.<id>, so that its marker is
+// the same one which jobqueue.Job.CommitDelivery writes.
+type sinkStage struct {
+	sink scan2drive.Sink
+}
+
+func (s *sinkStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	if needs := s.sink.Needs(); needs.PDF || needs.Thumbnail {
+		mayqtt.Publishf("delivering to %s", s.sink.Id())
+	}
+	return s.sink.Deliver(ctx, j)
+}
+
+// New validates profile and instantiates its stages. Besides the registered
+// stage types, profiles can contain stages of type “sink” (config: {"id":
+// "<sink id>"}), which deliver to the specified sink, and “sinks” (config:
+// {"ids": [...]}, defaulting to all sinks), which expands into one sink stage
+// per sink of the user. Stages which list “sinks” in their after field wait
+// for all of these.
+//
+// Sinks which only need the originals are started right away. All other sinks
+// of a “sinks” stage are delivered to one after the other, in the order of
+// sinks.json.
+func New(u *user.Account, profile scan2drive.ProfileConfig) (*Graph, error) {
+	sinks, err := sink.ForUser(u)
+	if err != nil {
+		return nil, err
+	}
+	sinkById := make(map[string]scan2drive.Sink)
+	for _, s := range sinks {
+		sinkById[s.Id()] = s
+	}
+
+	var nodes []*node
+	byName := make(map[string]*node)
+	groups := make(map[string][]string)
+	add := func(n *node) error {
+		if _, ok := byName[n.name]; ok {
+			return fmt.Errorf("duplicate stage name %q", n.name)
+		}
+		if _, ok := groups[n.name]; ok {
+			return fmt.Errorf("duplicate stage name %q", n.name)
+		}
+		byName[n.name] = n
+		nodes = append(nodes, n)
+		return nil
+	}
+
+	for idx := range profile.Stages {
+		cfg := profile.Stages[idx] // copy
+		if cfg.Type == "" {
+			return nil, fmt.Errorf("stage %d: type not configured", idx)
+		}
+		if cfg.Name == "" {
+			cfg.Name = cfg.Type
+		}
+		if err := validStageName(cfg.Name); err != nil {
+			return nil, err
+		}
+
+		switch cfg.Type {
+		case "sink":
+			var c struct {
+				Id string `json:"id"`
+			}
+			if len(cfg.Config) > 0 {
+				if err := json.Unmarshal(cfg.Config, &c); err != nil {
+					return nil, fmt.Errorf("stage %q: %v", cfg.Name, err)
+				}
+			}
+			s, ok := sinkById[c.Id]
+			if !ok {
+				return nil, fmt.Errorf("stage %q: sink %q not found in sinks.json", cfg.Name, c.Id)
+			}
+			if cfg.Name != "sink" && cfg.Name != "sink."+c.Id {
+				return nil, fmt.Errorf("stage %q: sink stages are named sink.<id>", cfg.Name)
+			}
+			if err := add(&node{
+				name:  "sink." + c.Id,
+				after: cfg.After,
+				stage: &sinkStage{sink: s},
+			}); err != nil {
+				return nil, err
+			}
+
+		case "sinks":
+			var c struct {
+				Ids []string `json:"ids"`
+			}
+			if len(cfg.Config) > 0 {
+				if err := json.Unmarshal(cfg.Config, &c); err != nil {
+					return nil, fmt.Errorf("stage %q: %v", cfg.Name, err)
+				}
+			}
+			selected := sinks
+			if len(c.Ids) > 0 {
+				selected = nil
+				for _, id := range c.Ids {
+					s, ok := sinkById[id]
+					if !ok {
+						return nil, fmt.Errorf("stage %q: sink %q not found in sinks.json", cfg.Name, id)
+					}
+					selected = append(selected, s)
+				}
+			}
+			if _, ok := byName[cfg.Name]; ok {
+				return nil, fmt.Errorf("duplicate stage name %q", cfg.Name)
+			}
+			var members []string
+			var prev string
+			for _, s := range selected {
+				n := &node{
+					name:  "sink." + s.Id(),
+					stage: &sinkStage{sink: s},
+				}
+				if needs := s.Needs(); needs.PDF || needs.Thumbnail {
+					n.after = slices.Clone(cfg.After)
+					if prev != "" {
+						n.after = append(n.after, prev)
+					}
+					prev = n.name
+				}
+				if err := add(n); err != nil {
+					return nil, err
+				}
+				members = append(members, n.name)
+			}
+			groups[cfg.Name] = members
+
+		default:
+			if strings.HasPrefix(cfg.Name, "sink.") {
+				return nil, fmt.Errorf("stage %q: only sink stages can be named sink.<id>", cfg.Name)
+			}
+			f, ok := factories[cfg.Type]
+			if !ok {
+				return nil, fmt.Errorf("stage %q: unknown stage type %q", cfg.Name, cfg.Type)
+			}
+			st, err := f(u, &cfg)
+			if err != nil {
+				return nil, fmt.Errorf("stage %q: %v", cfg.Name, err)
+			}
+			if err := add(&node{
+				name:  cfg.Name,
+				after: cfg.After,
+				stage: st,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Resolve references to groups and verify all references.
+	for _, n := range nodes {
+		var after []string
+		for _, dep := range n.after {
+			if members, ok := groups[dep]; ok {
+				after = append(after, members...)
+				continue
+			}
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("stage %q: after refers to unknown stage %q", n.name, dep)
+			}
+			if dep == n.name {
+				return nil, fmt.Errorf("stage %q: cannot run after itself", n.name)
+			}
+			after = append(after, dep)
+		}
+		n.after = after
+	}
+
+	sorted, err := topoSort(nodes)
+	if err != nil {
+		return nil, err
+	}
+	return &Graph{nodes: sorted}, nil
+}
+
+// topoSort returns nodes in an order in which every node comes after its
+// dependencies, retaining the configured order where possible.
+func topoSort(nodes []*node) ([]*node, error) {
+	placed := make(map[string]bool)
+	sorted := make([]*node, 0, len(nodes))
+	for len(sorted) < len(nodes) {
+		progress := false
+		for _, n := range nodes {
+			if placed[n.name] {
+				continue
+			}
+			ready := true
+			for _, dep := range n.after {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			placed[n.name] = true
+			sorted = append(sorted, n)
+			progress = true
+		}
+		if !progress {
+			var cycle []string
+			for _, n := range nodes {
+				if !placed[n.name] {
+					cycle = append(cycle, n.name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between stages %q", cycle)
+		}
+	}
+	return sorted, nil
+}
+
+func runStage(ctx context.Context, n *node, j *jobqueue.Job) error {
+	if _, ok := n.stage.(CPUIntensive); ok {
+		tr, _ := trace.FromContext(ctx)
+		select {
+		case cpuSlot <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-cpuSlot }()
+		tr.LazyPrintf("stage %q acquired CPU slot", n.name)
+	}
+	return n.stage.Run(ctx, j)
+}
+
+// Run runs all stages of the graph which did not complete yet. Each stage is
+// started as soon as the stages it depends on completed, so independent stages
+// run concurrently. When a stage fails, stages which do not depend on it are
+// still run, and the first error is returned. Run returns only once all stages
+// it started finished.
+func (g *Graph) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	type result struct {
+		n   *node
+		err error
+	}
+	results := make(chan result, len(g.nodes))
+
+	completed := make(map[string]bool)
+	for _, n := range g.nodes {
+		completed[n.name] = j.Completed(n.name)
+	}
+	started := make(map[string]bool)
+	var running int
+	var firstErr error
+	// stateErr is set when the job’s state cannot be updated. No more stages
+	// are started, but Run waits for the running stages before returning.
+	var stateErr error
+	for {
+		for _, n := range g.nodes {
+			if ctx.Err() != nil || stateErr != nil {
+				break
+			}
+			if completed[n.name] || started[n.name] {
+				continue
+			}
+			ready := true
+			for _, dep := range n.after {
+				if !completed[dep] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			started[n.name] = true
+			if _, ok := n.stage.(pdfWriter); ok {
+				if err := j.SetPDFStage(n.name); err != nil {
+					stateErr = err
+					break
+				}
+			}
+			if err := j.StageStarted(n.name); err != nil {
+				stateErr = err
+				break
+			}
+			running++
+			tr.LazyPrintf("starting stage %q", n.name)
+			go func() {
+				results <- result{n: n, err: runStage(ctx, n, j)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		// Markers (and the stage history) are committed from this
+		// goroutine only.
+		res := <-results
+		running--
+		if res.err != nil {
+			tr.LazyPrintf("stage %q failed: %v", res.n.name, res.err)
+			if err := j.StageFailed(res.n.name, res.err); err != nil && stateErr == nil {
+				stateErr = err
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("stage %q: %w", res.n.name, res.err)
+			}
+			continue
+		}
+		if err := j.CommitMarker(res.n.name); err != nil {
+			if stateErr == nil {
+				stateErr = err
+			}
+			continue
+		}
+		completed[res.n.name] = true
+		tr.LazyPrintf("stage %q completed", res.n.name)
+	}
+	if stateErr != nil {
+		return stateErr
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
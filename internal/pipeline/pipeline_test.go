@@ -0,0 +1,794 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/pipeline"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// recorder records the order in which stages and sinks ran, and fails the
+// stages listed in fail once.
+type recorder struct {
+	mu   sync.Mutex
+	ran  []string
+	fail map[string]bool
+}
+
+func (r *recorder) run(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ran = append(r.ran, name)
+	if r.fail[name] {
+		delete(r.fail, name)
+		return fmt.Errorf("injected failure")
+	}
+	return nil
+}
+
+func (r *recorder) reset() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ran := r.ran
+	r.ran = nil
+	return ran
+}
+
+var rec = &recorder{fail: make(map[string]bool)}
+
+type recordStage struct{ name string }
+
+func (s *recordStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	return rec.run(s.name)
+}
+
+type recordSink struct {
+	id    string
+	needs scan2drive.SinkNeeds
+}
+
+func (s *recordSink) Id() string                  { return s.id }
+func (s *recordSink) Needs() scan2drive.SinkNeeds { return s.needs }
+func (s *recordSink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	return rec.run("sink." + s.id)
+}
+
+// heavyStage tracks how many CPU-intensive stages run concurrently.
+type heavyStage struct{}
+
+var heavy struct {
+	mu           sync.Mutex
+	running, max int
+}
+
+func (heavyStage) CPUIntensive() {}
+
+func (heavyStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	heavy.mu.Lock()
+	heavy.running++
+	heavy.max = max(heavy.max, heavy.running)
+	heavy.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	heavy.mu.Lock()
+	heavy.running--
+	heavy.mu.Unlock()
+	return nil
+}
+
+// funcStage runs the function registered in funcs under the stage’s name.
+type funcStage struct{ name string }
+
+var funcs = make(map[string]func(j *jobqueue.Job) error)
+
+func (s *funcStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	return funcs[s.name](j)
+}
+
+func init() {
+	pipeline.Register("func", func(_ *user.Account, cfg *scan2drive.StageConfig) (pipeline.Stage, error) {
+		return &funcStage{name: cfg.Name}, nil
+	})
+	pipeline.Register("heavy", func(*user.Account, *scan2drive.StageConfig) (pipeline.Stage, error) {
+		return heavyStage{}, nil
+	})
+	pipeline.Register("record", func(_ *user.Account, cfg *scan2drive.StageConfig) (pipeline.Stage, error) {
+		return &recordStage{name: cfg.Name}, nil
+	})
+	sink.Register("record", func(_ *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var needs scan2drive.SinkNeeds
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &needs); err != nil {
+				return nil, err
+			}
+		}
+		return &recordSink{id: cfg.Id, needs: needs}, nil
+	})
+}
+
+func testUser(t *testing.T, profiles string) *user.Account {
+	u := &user.Account{
+		SinkConfigs: []scan2drive.SinkConfig{
+			{Type: "record", Id: "originals", Config: json.RawMessage(`{"Originals": true}`)},
+			{Type: "record", Id: "first", Config: json.RawMessage(`{"PDF": true}`)},
+			{Type: "record", Id: "second", Config: json.RawMessage(`{"PDF": true}`)},
+		},
+	}
+	if profiles != "" {
+		if err := json.Unmarshal([]byte(profiles), &u.Profiles); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u
+}
+
+func testContext(t *testing.T) context.Context {
+	tr := trace.New("test", t.Name())
+	t.Cleanup(tr.Finish)
+	return trace.NewContext(context.Background(), tr)
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, tt := range []struct {
+		profile string
+		wantErr string
+	}{
+		{`{"stages": [{"type": "nope"}]}`, "unknown stage type"},
+		{`{"stages": [{"type": "record", "after": ["nope"]}]}`, "unknown stage"},
+		{`{"stages": [{"type": "record"}, {"type": "record"}]}`, "duplicate stage name"},
+		{`{"stages": [{"name": "done", "type": "record"}]}`, "reserved"},
+		{`{"stages": [{"name": "..", "type": "binarize"}]}`, "not a valid directory name"},
+		{`{"stages": [{"name": "../..", "type": "binarize"}]}`, "not a valid directory name"},
+		{`{"stages": [{"name": "page1.jpg", "type": "binarize"}]}`, "collides"},
+		{`{"stages": [{"name": "job.json", "type": "binarize"}]}`, "collides"},
+		{`{"stages": [{"type": "binarize", "config": {"input": ".."}}]}`, "not a valid directory name"},
+		{`{"stages": [{"name": "sink.x", "type": "record"}]}`, "only sink stages"},
+		{`{"stages": [{"type": "sink", "config": {"id": "nope"}}]}`, "not found"},
+		{`{"stages": [
+			{"name": "a", "type": "record", "after": ["b"]},
+			{"name": "b", "type": "record", "after": ["a"]}
+		]}`, "cycle"},
+	} {
+		var profile scan2drive.ProfileConfig
+		if err := json.Unmarshal([]byte(tt.profile), &profile); err != nil {
+			t.Fatal(err)
+		}
+		_, err := pipeline.New(testUser(t, ""), profile)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("New(%s) = %v, want error containing %q", tt.profile, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	u := testUser(t, `{"default": {"stages": [
+		{"name": "a", "type": "record"},
+		{"name": "b", "type": "record", "after": ["a"]},
+		{"name": "c", "type": "record", "after": ["b"]},
+		{"type": "sinks", "after": ["c"]},
+		{"name": "d", "type": "record", "after": ["sinks"]}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.Stages(), []string{"a", "b", "c", "sink.originals", "sink.first", "sink.second", "d"}; !slices.Equal(got, want) {
+		t.Errorf("unexpected stage order: got %q, want %q", got, want)
+	}
+
+	rec.reset()
+	rec.fail["b"] = true
+	if err := g.Run(testContext(t), job); err == nil {
+		t.Fatalf("Run unexpectedly succeeded")
+	}
+	ran := rec.reset()
+	slices.Sort(ran)
+	// b failed, so neither c nor anything after it ran, but the sink which
+	// only needs the originals did.
+	if want := []string{"a", "b", "sink.originals"}; !slices.Equal(ran, want) {
+		t.Errorf("unexpected stages ran: got %q, want %q", ran, want)
+	}
+
+	// Processing resumes from persisted markers, e.g. after a restart.
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.Completed("a") || job.Completed("b") || !job.Delivered("originals") {
+		t.Errorf("unexpected markers after failure: %+v", job.Markers)
+	}
+	if rec := job.Manifest().Stages["b"]; rec == nil || rec.Failures != 1 || rec.LastError != "injected failure" {
+		t.Errorf("failure of stage b not recorded: %+v", rec)
+	}
+	rec.fail["sink.second"] = true
+	if err := g.Run(testContext(t), job); err == nil {
+		t.Fatalf("Run unexpectedly succeeded")
+	}
+	if got, want := rec.reset(), []string{"b", "c", "sink.first", "sink.second"}; !slices.Equal(got, want) {
+		t.Errorf("unexpected stages ran: got %q, want %q", got, want)
+	}
+
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.reset(), []string{"sink.second", "d"}; !slices.Equal(got, want) {
+		t.Errorf("unexpected stages ran: got %q, want %q", got, want)
+	}
+}
+
+func TestProfileNotFound(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetProfile("receipts"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipeline.ForJob(testUser(t, ""), job); err == nil {
+		t.Errorf("ForJob unexpectedly succeeded for unknown profile")
+	}
+}
+
+func testPage(t *testing.T, blank bool) *page.Any {
+	img := image.NewGray(image.Rect(0, 0, 200, 280))
+	for y := 0; y < 280; y++ {
+		for x := 0; x < 200; x++ {
+			if !blank && (x+y)%4 == 0 {
+				img.SetGray(x, y, color.Gray{0})
+			} else {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return page.JPEGPageFromBytes(buf.Bytes())
+}
+
+func TestPageStages(t *testing.T) {
+	u := testUser(t, `{"bw": {"stages": [
+		{"type": "binarize"},
+		{"type": "blank-skip", "after": ["binarize"]},
+		{"type": "pdf", "after": ["blank-skip"]}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{
+		testPage(t, false),
+		testPage(t, true),
+		testPage(t, false),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetProfile("bw"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		stage string
+		want  []string
+	}{
+		{"binarize", []string{"page1.png", "page2.png", "page3.png"}},
+		{"blank-skip", []string{"page1.png", "page3.png"}},
+	} {
+		entries, err := os.ReadDir(filepath.Join(job.Dir(), tt.stage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("stage %s: unexpected pages: got %q, want %q", tt.stage, got, tt.want)
+		}
+	}
+
+	pdf, err := job.ReadDerivedFile("scan.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bytes.Count(pdf, []byte("/Type /Page\n")), 2; got != want {
+		t.Errorf("unexpected number of PDF pages: got %d, want %d", got, want)
+	}
+	if !job.Markers.Converted {
+		t.Errorf("job not marked as converted: %+v", job.Markers)
+	}
+	if rec := job.PageRecord(2); !rec.Skipped || rec.Ink == nil {
+		t.Errorf("blank page 2 not recorded as skipped: %+v", rec)
+	}
+	if rec := job.PageRecord(1); rec.Skipped {
+		t.Errorf("page 1 unexpectedly recorded as skipped")
+	}
+
+	// Restored pages are not skipped when reprocessing.
+	if err := job.UpdatePage(2, func(rec *jobqueue.PageRecord) {
+		rec.Restored = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.Reprocess(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+	if rec := job.PageRecord(2); rec.Skipped {
+		t.Errorf("restored page 2 still recorded as skipped")
+	}
+	pdf, err = job.ReadDerivedFile("scan.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bytes.Count(pdf, []byte("/Type /Page\n")), 3; got != want {
+		t.Errorf("restored page not in PDF: got %d pages, want %d", got, want)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	u := testUser(t, "")
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{
+		testPage(t, false),
+		testPage(t, true),
+		testPage(t, false),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.UpdatePage(3, func(rec *jobqueue.PageRecord) {
+		rotation := 90
+		rec.ForcedRotation = &rotation
+	}); err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+	if err := g.Run(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// The part is converted like scan.pdf: blank page 2 is skipped, and page
+	// 3 is rotated as forced.
+	pdf, err := pipeline.PDF(ctx, u, job, []int{2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bytes.Count(pdf, []byte("/Type /Page\n")), 1; got != want {
+		t.Errorf("unexpected number of PDF pages: got %d, want %d", got, want)
+	}
+	if !bytes.Contains(pdf, []byte("/MediaBox [ 0 0 841.89 595.28 ]")) {
+		t.Errorf("PDF does not contain a landscape page")
+	}
+	if rec := job.PageRecord(2); !rec.Skipped {
+		t.Errorf("blank page 2 no longer recorded as skipped: %+v", rec)
+	}
+}
+
+func TestAllBlank(t *testing.T) {
+	u := testUser(t, `{"bw": {"stages": [
+		{"type": "binarize"},
+		{"type": "blank-skip", "after": ["binarize"]},
+		{"type": "pdf", "after": ["blank-skip"]},
+		{"type": "sinks", "after": ["pdf"]}
+	]}}`)
+	for _, tt := range []struct {
+		profile string
+		stage   string
+	}{
+		{profile: "", stage: "convert"},
+		{profile: "bw", stage: "pdf"},
+	} {
+		t.Run(tt.stage, func(t *testing.T) {
+			q := &jobqueue.Queue{Dir: t.TempDir()}
+			job, err := q.AddJob([]*page.Any{
+				testPage(t, true),
+				testPage(t, true),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.profile != "" {
+				if err := job.SetProfile(tt.profile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			g, err := pipeline.ForJob(u, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := g.Run(testContext(t), job); err != nil {
+				t.Fatal(err)
+			}
+			// Without pages, there is no thumbnail.
+			if _, err := os.Stat(filepath.Join(job.Dir(), "thumb.png")); !os.IsNotExist(err) {
+				t.Errorf("thumb.png unexpectedly written: %v", err)
+			}
+
+			// Reading the job again does not consider it damaged.
+			job, err = q.JobById(job.Id())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !job.Completed(tt.stage) {
+				t.Errorf("stage %s unexpectedly rolled back", tt.stage)
+			}
+			if !job.Delivered("first") {
+				t.Errorf("delivery to first unexpectedly rolled back")
+			}
+		})
+	}
+}
+
+func TestPDFStageName(t *testing.T) {
+	u := testUser(t, `{"renamed": {"stages": [
+		{"type": "binarize"},
+		{"name": "render", "type": "pdf", "after": ["binarize"]},
+		{"type": "sinks", "after": ["render"]}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{testPage(t, false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetProfile("renamed"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+	// The stage which wrote scan.pdf marks the job as converted, whatever its
+	// name.
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.Markers.Converted {
+		t.Errorf("job not marked as converted: %+v", job.Markers)
+	}
+	if got, want := job.Summary().Thumb, "thumb.png"; got != want {
+		t.Errorf("unexpected thumbnail in summary: got %q, want %q", got, want)
+	}
+}
+
+func TestRunWaitsForStages(t *testing.T) {
+	u := testUser(t, `{"default": {"stages": [
+		{"name": "slow", "type": "func"},
+		{"name": "corrupt", "type": "func"}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := make(chan struct{})
+	var finished sync.WaitGroup
+	finished.Add(1)
+	var slowDone bool
+	funcs["slow"] = func(*jobqueue.Job) error {
+		defer finished.Done()
+		<-corrupted
+		time.Sleep(50 * time.Millisecond)
+		slowDone = true
+		return nil
+	}
+	funcs["corrupt"] = func(j *jobqueue.Job) error {
+		// Committing the marker of this stage fails.
+		defer close(corrupted)
+		return os.WriteFile(filepath.Join(j.Dir(), "job.json"), []byte("{"), 0600)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err == nil {
+		t.Errorf("Run unexpectedly succeeded")
+	}
+	if !slowDone {
+		t.Errorf("Run returned before the running stage finished")
+	}
+	finished.Wait()
+}
+
+func TestCPUIntensiveSerialized(t *testing.T) {
+	u := testUser(t, `{"default": {"stages": [
+		{"name": "a", "type": "heavy"},
+		{"name": "b", "type": "heavy"}
+	]}}`)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		// Separate queues, as job ids have a resolution of one second.
+		q := &jobqueue.Queue{Dir: t.TempDir()}
+		job, err := q.AddJob(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := pipeline.ForJob(u, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.Run(testContext(t), job); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := heavy.max, 1; got != want {
+		t.Errorf("unexpected number of concurrent CPU-intensive stages: got %d, want %d", got, want)
+	}
+}
+
+// skewedPage returns a page with lines of text whose lines are skewed
+// clockwise by angle degrees.
+func skewedPage(t *testing.T, angle float64) *page.Any {
+	img := image.NewGray(image.Rect(0, 0, 400, 560))
+	for y := 0; y < 560; y++ {
+		for x := 0; x < 400; x++ {
+			// 8 pixel high lines of text with gaps between the words.
+			if x >= 40 && x < 360 && y >= 40 && y < 520 && y%20 < 8 && (x/10+y/20)%5 != 0 {
+				img.SetGray(x, y, color.Gray{0})
+			} else {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, page.Rotate(img, -angle), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return page.JPEGPageFromBytes(buf.Bytes())
+}
+
+func TestDeskew(t *testing.T) {
+	u := testUser(t, `{"deskew": {"stages": [
+		{"type": "deskew"},
+		{"type": "pdf", "after": ["deskew"]}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	skewed := skewedPage(t, 2)
+	hint := 1.8
+	skewed.SkewHint = &hint
+	job, err := q.AddJob([]*page.Any{skewed, testPage(t, true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetProfile("deskew"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = q.JobById(job.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := job.PageRecord(1)
+	if rec.SkewHint == nil || *rec.SkewHint != hint {
+		t.Errorf("skew hint of page 1 not recorded: %+v", rec)
+	}
+	if rec.Skew == nil || *rec.Skew < 1.9 || *rec.Skew > 2.1 {
+		t.Errorf("unexpected skew of page 1: %+v", rec)
+	}
+	if rec := job.PageRecord(2); rec.Skew != nil {
+		t.Errorf("blank page 2 unexpectedly has a skew: %v", *rec.Skew)
+	}
+	if !job.Markers.Converted {
+		t.Errorf("job not marked as converted: %+v", job.Markers)
+	}
+}
+
+// upsideDownPage returns a page with lines of text which is upside down.
+func upsideDownPage(t *testing.T) *page.Any {
+	img := image.NewGray(image.Rect(0, 0, 400, 560))
+	for y := 0; y < 560; y++ {
+		for x := 0; x < 400; x++ {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	for y := 40; y < 520; y += 20 {
+		for x := 40; x < 360; x += 8 {
+			// The core of each letter, with an ascender on every other
+			// letter.
+			for dy := 0; dy < 8; dy++ {
+				for dx := 0; dx < 6; dx++ {
+					img.SetGray(x+dx, y+dy, color.Gray{0})
+				}
+			}
+			if x%16 == 0 {
+				for dy := -5; dy < 0; dy++ {
+					img.SetGray(x, y+dy, color.Gray{0})
+					img.SetGray(x+1, y+dy, color.Gray{0})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, page.Turn(img, 180), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return page.JPEGPageFromBytes(buf.Bytes())
+}
+
+func TestOrient(t *testing.T) {
+	u := testUser(t, `{"orient": {"stages": [
+		{"type": "orient"},
+		{"type": "pdf", "after": ["orient"]}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{upsideDownPage(t), upsideDownPage(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetProfile("orient"); err != nil {
+		t.Fatal(err)
+	}
+	// The user knows better for page 2.
+	if err := job.UpdatePage(2, func(rec *jobqueue.PageRecord) {
+		rotation := 90
+		rec.ForcedRotation = &rotation
+	}); err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+
+	for num, want := range map[int]int{1: 180, 2: 90} {
+		if got := job.PageRecord(num).Rotation; got == nil || *got != want {
+			t.Errorf("page %d: unexpected rotation: got %v, want %d", num, got, want)
+		}
+	}
+	f, err := os.Open(filepath.Join(job.Dir(), "orient", "page2.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 560 || cfg.Height != 400 {
+		t.Errorf("page 2 not turned: got %dx%d, want 560x400", cfg.Width, cfg.Height)
+	}
+	pdf, err := job.ReadDerivedFile("scan.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(pdf, []byte("/MediaBox [ 0 0 841.89 595.28 ]")) {
+		t.Errorf("PDF does not contain a landscape page")
+	}
+}
+
+// receiptPage returns a 100 dpi flatbed scan of a 3x6 inch receipt at
+// (100, 100), on a dark scanner background.
+func receiptPage(t *testing.T) *page.Any {
+	img := image.NewGray(image.Rect(0, 0, 850, 1100))
+	for y := 0; y < 1100; y++ {
+		for x := 0; x < 850; x++ {
+			v := uint8(0x20)
+			if x >= 100 && x < 400 && y >= 100 && y < 700 {
+				v = 0xf0
+				if y%20 < 5 && x >= 120 && x < 380 {
+					v = 0x00 // text
+				}
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	pg := page.JPEGPageFromBytes(buf.Bytes())
+	pg.DPI = 100
+	return pg
+}
+
+func TestCrop(t *testing.T) {
+	u := testUser(t, `{"receipt": {"stages": [
+		{"type": "crop"},
+		{"type": "binarize", "after": ["crop"]},
+		{"type": "pdf", "after": ["binarize"]}
+	]}}`)
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{receiptPage(t), testPage(t, false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.SetProfile("receipt"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := pipeline.ForJob(u, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Run(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+
+	crop := job.PageRecord(1).Crop
+	if receipt := image.Rect(100, 100, 400, 700); crop == nil || !crop.In(receipt) || crop.Dx() < 296 || crop.Dy() < 596 {
+		t.Fatalf("page 1: unexpected crop: got %v, want (almost) %v", crop, receipt)
+	}
+	if crop := job.PageRecord(2).Crop; crop != nil {
+		t.Errorf("page 2 without background unexpectedly cropped to %v", *crop)
+	}
+
+	pdf, err := job.ReadDerivedFile("scan.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The receipt is 3x6 inches (216x432 points), minus the trimmed edges.
+	receipt := fmt.Sprintf("/MediaBox [ 0 0 %.2f %.2f ]", float64(crop.Dx())*72/100, float64(crop.Dy())*72/100)
+	if !bytes.Contains(pdf, []byte(receipt)) {
+		t.Errorf("PDF does not contain a receipt-sized page (%s)", receipt)
+	}
+	if !bytes.Contains(pdf, []byte("/MediaBox [ 0 0 595.28 841.89 ]")) {
+		t.Errorf("PDF does not contain an A4 page for the uncropped page")
+	}
+}
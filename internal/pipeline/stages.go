@@ -0,0 +1,703 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+	"github.com/stapelberg/scan2drive/internal/g3"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/legacyconvert"
+	"github.com/stapelberg/scan2drive/internal/mayqtt"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+func init() {
+	Register("convert", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		th, err := stageThresholder(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c := struct {
+			Orient bool               `json:"orient"`
+			Blank  page.BlankDetector `json:"blank"`
+		}{Blank: page.DefaultBlankDetector}
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.Blank.Validate(); err != nil {
+			return nil, err
+		}
+		return convertStage{th: th, orient: c.Orient, blank: c.Blank}, nil
+	})
+	Register("binarize", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		ps, err := newPageStage(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		th, err := stageThresholder(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &binarizeStage{ps, th}, nil
+	})
+	Register("blank-skip", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		st := &blankSkipStage{BlankDetector: page.DefaultBlankDetector}
+		ps, err := newPageStage(cfg, st)
+		if err != nil {
+			return nil, err
+		}
+		if err := st.Validate(); err != nil {
+			return nil, err
+		}
+		if ps.input == "" {
+			return nil, fmt.Errorf("blank-skip needs binarized input pages, e.g. after: [\"binarize\"]")
+		}
+		st.pageStage = ps
+		return st, nil
+	})
+	Register("orient", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		ps, err := newPageStage(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &orientStage{ps}, nil
+	})
+	Register("crop", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		ps, err := newPageStage(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &cropStage{ps}, nil
+	})
+	Register("deskew", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		st := &deskewStage{MaxAngle: 5}
+		ps, err := newPageStage(cfg, st)
+		if err != nil {
+			return nil, err
+		}
+		if st.MaxAngle <= 0 || st.MaxAngle > 45 {
+			return nil, fmt.Errorf("deskew max_angle %v out of range (0, 45]", st.MaxAngle)
+		}
+		st.pageStage = ps
+		return st, nil
+	})
+	Register("pdf", func(_ *user.Account, cfg *scan2drive.StageConfig) (Stage, error) {
+		ps, err := newPageStage(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ps.input == "" {
+			return nil, fmt.Errorf("pdf needs binarized input pages, e.g. after: [\"binarize\"]")
+		}
+		return &pdfStage{ps}, nil
+	})
+}
+
+// stageThresholder returns the Thresholder configured in the “thresholding”
+// key of the stage configuration (see page.ThresholdConfig).
+func stageThresholder(cfg *scan2drive.StageConfig) (page.Thresholder, error) {
+	var c struct {
+		Thresholding page.ThresholdConfig `json:"thresholding"`
+	}
+	if len(cfg.Config) > 0 {
+		if err := json.Unmarshal(cfg.Config, &c); err != nil {
+			return nil, err
+		}
+	}
+	return c.Thresholding.Thresholder()
+}
+
+// convertStage binarizes, G3-encodes and writes the PDF and thumbnail in one
+// go, like scan2drive did before processing was configurable. Blank pages
+// are skipped (see skipBlank), and pages are rotated as forced by the user
+// and, if orient is set, turned upright (see orient).
+type convertStage struct {
+	th     page.Thresholder
+	orient bool
+	blank  page.BlankDetector
+}
+
+func (convertStage) CPUIntensive() {}
+
+func (s convertStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	mayqtt.Publishf("processing %d pages", len(j.Pages()))
+	pdf, thumb, err := s.pdf(ctx, j, nil)
+	if err != nil {
+		return err
+	}
+	tr.LazyPrintf("Converted. Writing scan.pdf (%d bytes)", len(pdf))
+	if err := j.AddDerivedFile("scan.pdf", pdf); err != nil {
+		return err
+	}
+	return writeThumb(j, thumb)
+}
+
+// writeThumb writes thumb.png, or removes the thumbnail of an earlier
+// conversion if all pages were skipped as blank (thumb is nil).
+func writeThumb(j *jobqueue.Job, thumb []byte) error {
+	if thumb == nil {
+		return j.RemoveDerivedFile("thumb.png")
+	}
+	return j.AddDerivedFile("thumb.png", thumb)
+}
+
+// implements pdfWriter
+func (s convertStage) pdf(ctx context.Context, j *jobqueue.Job, nums []int) (pdf, thumb []byte, err error) {
+	tr, _ := trace.FromContext(ctx)
+	pages := j.Pages()
+	if nums != nil {
+		subset := make([]*page.Any, len(nums))
+		for idx, num := range nums {
+			if num < 1 || num > len(pages) {
+				return nil, nil, fmt.Errorf("page %d out of range [1, %d]", num, len(pages))
+			}
+			subset[idx] = pages[num-1]
+		}
+		pages = subset
+	}
+	// pageNum maps the page number within pages to the original page number.
+	pageNum := func(num int) int {
+		if nums == nil {
+			return num
+		}
+		return nums[num-1]
+	}
+	return legacyconvert.ConvertLogic(tr, pages, legacyconvert.Options{
+		Thresholder: s.th,
+		Blank: func(num int, bin *image.Gray) (bool, error) {
+			return skipBlank(tr, j, pageNum(num), bin, &s.blank)
+		},
+		Rotate: func(num int, bin *image.Gray) (*image.Gray, error) {
+			return orient(tr, j, pageNum(num), bin, s.orient)
+		},
+	})
+}
+
+// pageStage contains what all stages which process pages one by one have in
+// common: pages are read from the output directory of the input stage (or
+// from the original pages), and are written as page<n>.png into a directory
+// named after the stage.
+type pageStage struct {
+	name  string
+	input string // stage name, or empty for the original pages
+}
+
+func (*pageStage) CPUIntensive() {}
+
+// newPageStage unmarshals the stage configuration into cfgPtr (if non-nil).
+// The input stage is configured using the “input” key and defaults to the
+// first stage in after.
+func newPageStage(cfg *scan2drive.StageConfig, cfgPtr any) (pageStage, error) {
+	var c struct {
+		Input *string `json:"input"`
+	}
+	if len(cfg.Config) > 0 {
+		if err := json.Unmarshal(cfg.Config, &c); err != nil {
+			return pageStage{}, err
+		}
+		if cfgPtr != nil {
+			if err := json.Unmarshal(cfg.Config, cfgPtr); err != nil {
+				return pageStage{}, err
+			}
+		}
+	}
+	ps := pageStage{name: cfg.Name}
+	if c.Input != nil {
+		ps.input = *c.Input
+	} else if len(cfg.After) > 0 {
+		ps.input = cfg.After[0]
+	}
+	if ps.input != "" {
+		if err := validStageName(ps.input); err != nil {
+			return pageStage{}, fmt.Errorf("input: %v", err)
+		}
+	}
+	return ps, nil
+}
+
+// inputPage is a page to be processed by a pageStage.
+type inputPage struct {
+	num  int    // 1-based page number within the original scan
+	path string // empty for original pages
+	orig *page.Any
+}
+
+func (p inputPage) load() (image.Image, error) {
+	if p.orig != nil {
+		b, err := p.orig.JPEGBytes()
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(b))
+		return img, err
+	}
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func (ps *pageStage) inputPages(j *jobqueue.Job) ([]inputPage, error) {
+	if ps.input == "" {
+		pages := j.Pages()
+		result := make([]inputPage, len(pages))
+		for idx, p := range pages {
+			result[idx] = inputPage{num: idx + 1, orig: p}
+		}
+		return result, nil
+	}
+	dir := filepath.Join(j.Dir(), ps.input)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading pages of stage %q: %v", ps.input, err)
+	}
+	var result []inputPage
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "page") || !strings.HasSuffix(name, ".png") {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "page"), ".png"))
+		if err != nil {
+			continue
+		}
+		result = append(result, inputPage{num: num, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].num < result[j].num })
+	return result, nil
+}
+
+// outputDir returns the (empty) directory into which the stage writes its
+// pages. Pages from an earlier, interrupted run are discarded.
+func (ps *pageStage) outputDir(j *jobqueue.Job) (string, error) {
+	dir := filepath.Join(j.Dir(), ps.name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := atomicfile.SyncDir(j.Dir()); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func pageFilename(dir string, num int) string {
+	return filepath.Join(dir, fmt.Sprintf("page%d.png", num))
+}
+
+func writePNG(fn string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(fn, buf.Bytes(), 0600)
+}
+
+// bilevel returns img as a black/white image, as required by the G3 encoder.
+func bilevel(img image.Image) *image.Gray {
+	if gray, ok := img.(*image.Gray); ok {
+		bilevel := true
+		for _, v := range gray.Pix {
+			if v != 0x00 && v != 0xff {
+				bilevel = false
+				break
+			}
+		}
+		if bilevel {
+			return gray
+		}
+	}
+	gray, _ := page.Binarize(img, nil)
+	return gray
+}
+
+// binarizeStage turns pages into black/white images.
+type binarizeStage struct {
+	pageStage
+	th page.Thresholder
+}
+
+func (s *binarizeStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	pages, err := s.inputPages(j)
+	if err != nil {
+		return err
+	}
+	mayqtt.Publishf("processing %d pages", len(pages))
+	dir, err := s.outputDir(j)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		img, err := p.load()
+		if err != nil {
+			return err
+		}
+		binarized, whitePct := page.Binarize(img, s.th)
+		tr.LazyPrintf("binarized page %d, white percentage %f", p.num, whitePct)
+		if err := writePNG(pageFilename(dir, p.num), binarized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blankSkipStage passes through all pages which are not blank (see
+// skipBlank).
+type blankSkipStage struct {
+	pageStage
+	page.BlankDetector
+}
+
+// skipBlank returns whether the black/white page num (starting at 1) of the
+// job is blank according to d and is skipped, which it is not if the user
+// restored the page. Skipped pages are recorded in the job.
+func skipBlank(tr trace.Trace, j *jobqueue.Job, num int, bin *image.Gray, d *page.BlankDetector) (bool, error) {
+	blank, ink := d.Blank(bin)
+	rec := j.PageRecord(num)
+	skip := blank && !rec.Restored
+	tr.LazyPrintf("page %d is covered by %f ink, blank = %v, skipped = %v", num, ink, blank, skip)
+	if skip || rec.Skipped {
+		if err := j.UpdatePage(num, func(rec *jobqueue.PageRecord) {
+			rec.Skipped = skip
+			rec.Ink = nil
+			if skip {
+				rec.Ink = &ink
+			}
+		}); err != nil {
+			return false, err
+		}
+	}
+	return skip, nil
+}
+
+func copyFile(dst, src string) error {
+	if err := os.Link(src, dst); err == nil {
+		return atomicfile.SyncDir(filepath.Dir(dst))
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return atomicfile.Write(dst, 0600, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+func (s *blankSkipStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	pages, err := s.inputPages(j)
+	if err != nil {
+		return err
+	}
+	dir, err := s.outputDir(j)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		img, err := p.load()
+		if err != nil {
+			return err
+		}
+		skip, err := skipBlank(tr, j, p.num, bilevel(img), &s.BlankDetector)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		if err := copyFile(pageFilename(dir, p.num), p.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orient turns the black/white page num (starting at 1) of the job upright:
+// by the rotation which the user forced for the page, if any, or else (if
+// detect is set) according to its detected orientation. The applied rotation
+// is recorded in the job.
+func orient(tr trace.Trace, j *jobqueue.Job, num int, bin *image.Gray, detect bool) (*image.Gray, error) {
+	rec := j.PageRecord(num)
+	var rotation *int
+	if rec.ForcedRotation != nil {
+		if err := page.ValidRotation(*rec.ForcedRotation); err != nil {
+			return nil, fmt.Errorf("page %d: %v", num, err)
+		}
+		rotation = rec.ForcedRotation
+		tr.LazyPrintf("page %d: rotating by %d° as forced", num, *rotation)
+	} else if detect {
+		if detected, ok := page.Orientation(bin); ok {
+			rotation = &detected
+			tr.LazyPrintf("page %d: rotating by %d° to turn it upright", num, detected)
+		} else {
+			tr.LazyPrintf("page %d: orientation not detected, not rotating", num)
+		}
+	}
+	if rotation != nil || rec.Rotation != nil {
+		if err := j.UpdatePage(num, func(rec *jobqueue.PageRecord) {
+			rec.Rotation = rotation
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if rotation == nil || *rotation == 0 {
+		return bin, nil
+	}
+	return page.Turn(bin, *rotation), nil
+}
+
+// orientStage turns pages upright which were scanned sideways or upside down
+// (see orient). Pages which are not black/white are binarized first.
+type orientStage struct {
+	pageStage
+}
+
+func (s *orientStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	pages, err := s.inputPages(j)
+	if err != nil {
+		return err
+	}
+	dir, err := s.outputDir(j)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		img, err := p.load()
+		if err != nil {
+			return err
+		}
+		bin, err := orient(tr, j, p.num, bilevel(img), true)
+		if err != nil {
+			return err
+		}
+		if err := writePNG(pageFilename(dir, p.num), bin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a4WidthInches is the width of DIN A4 paper.
+const a4WidthInches = 210 / 25.4
+
+// cropStage trims the scanner background around the paper (see
+// page.PaperBounds), e.g. the overscan area of document feeders, or the area
+// of a flatbed scanner around a receipt. Pages are converted to grayscale.
+// The part of each page which was kept is recorded in the job, and the pdf
+// stage sizes cropped pages like the paper.
+type cropStage struct {
+	pageStage
+}
+
+func (s *cropStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	pages, err := s.inputPages(j)
+	if err != nil {
+		return err
+	}
+	dir, err := s.outputDir(j)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		img, err := p.load()
+		if err != nil {
+			return err
+		}
+		gray := page.Luminance(img)
+		r, ok := page.PaperBounds(gray)
+		cropped := ok && r != gray.Bounds()
+		if cropped {
+			tr.LazyPrintf("page %d: paper found at %v, cropping", p.num, r)
+			gray = page.Crop(gray, r)
+		} else {
+			tr.LazyPrintf("page %d: no background around the paper found, not cropping", p.num)
+		}
+		if err := writePNG(pageFilename(dir, p.num), gray); err != nil {
+			return err
+		}
+		if err := j.UpdatePage(p.num, func(rec *jobqueue.PageRecord) {
+			rec.Crop = nil
+			if !cropped {
+				return
+			}
+			rec.Crop = &r
+			if rec.DPI == 0 {
+				// The scanner did not report its resolution: assume
+				// that the page as scanned is as wide as DIN A4 paper,
+				// like the pdf stage does for uncropped pages.
+				bounds := img.Bounds()
+				rec.DPI = int(math.Round(float64(min(bounds.Dx(), bounds.Dy())) / a4WidthInches))
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// minDeskewAngle is the skew angle in degrees below which deskewStage does not
+// rotate pages: rotating by such small angles would only add artifacts.
+const minDeskewAngle = 0.05
+
+// deskewStage straightens pages whose text lines are not horizontal, e.g.
+// because the paper was fed crookedly. Pages which are not black/white are
+// binarized first.
+type deskewStage struct {
+	pageStage
+
+	// MaxAngle is the largest skew angle in degrees which is detected.
+	MaxAngle float64 `json:"max_angle"`
+}
+
+func (s *deskewStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	pages, err := s.inputPages(j)
+	if err != nil {
+		return err
+	}
+	dir, err := s.outputDir(j)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		img, err := p.load()
+		if err != nil {
+			return err
+		}
+		bin := bilevel(img)
+		hint := j.PageRecord(p.num).SkewHint
+		if hint != nil {
+			tr.LazyPrintf("page %d: scanner measured a skew angle of %.1f°", p.num, *hint)
+		}
+		angle, ok := page.SkewAngle(bin, s.MaxAngle, hint)
+		if !ok {
+			tr.LazyPrintf("page %d: no text lines found, not deskewing", p.num)
+		} else {
+			tr.LazyPrintf("page %d: skew angle %.3f°", p.num, angle)
+			if math.Abs(angle) >= minDeskewAngle {
+				bin = page.Rotate(bin, angle)
+			}
+		}
+		if err := writePNG(pageFilename(dir, p.num), bin); err != nil {
+			return err
+		}
+		if err := j.UpdatePage(p.num, func(rec *jobqueue.PageRecord) {
+			rec.Skew = nil
+			if ok {
+				rec.Skew = &angle
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pdfStage G3-encodes black/white pages and writes scan.pdf and thumb.png.
+// Pages which the crop stage trimmed are sized like the paper.
+type pdfStage struct {
+	pageStage
+}
+
+func (s *pdfStage) Run(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+	pdf, thumb, err := s.pdf(ctx, j, nil)
+	if err != nil {
+		return err
+	}
+	tr.LazyPrintf("Writing scan.pdf (%d bytes)", len(pdf))
+	if err := j.AddDerivedFile("scan.pdf", pdf); err != nil {
+		return err
+	}
+	return writeThumb(j, thumb)
+}
+
+// implements pdfWriter
+func (s *pdfStage) pdf(ctx context.Context, j *jobqueue.Job, nums []int) (pdf, thumb []byte, err error) {
+	tr, _ := trace.FromContext(ctx)
+	pages, err := s.inputPages(j)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nums != nil {
+		pages = slices.DeleteFunc(pages, func(p inputPage) bool {
+			return !slices.Contains(nums, p.num)
+		})
+	}
+	compressed := make([]*bytes.Buffer, len(pages))
+	bounds := make([]image.Rectangle, len(pages))
+	dpi := make([]int, len(pages))
+	for idx, p := range pages {
+		img, err := p.load()
+		if err != nil {
+			return nil, nil, err
+		}
+		binarized := bilevel(img)
+		if thumb == nil {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, binarized); err != nil {
+				return nil, nil, err
+			}
+			thumb = buf.Bytes()
+		}
+		var buf bytes.Buffer
+		if err := g3.NewEncoder(&buf).Encode(binarized); err != nil {
+			return nil, nil, err
+		}
+		compressed[idx] = &buf
+		bounds[idx] = binarized.Bounds()
+		if rec := j.PageRecord(p.num); rec.Crop != nil {
+			// Cropped pages are sized like the paper, uncropped pages
+			// like DIN A4.
+			dpi[idx] = rec.DPI
+		}
+		tr.LazyPrintf("page %d g3-compressed into %d bytes", p.num, buf.Len())
+	}
+	var buf bytes.Buffer
+	if err := legacyconvert.WritePDF(&buf, compressed, bounds, dpi); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), thumb, nil
+}
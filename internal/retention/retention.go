@@ -0,0 +1,159 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retention removes the local copies of jobs from the scans directory
+// according to each user’s retention policy (see scan2drive.RetentionConfig).
+//
+// Only jobs in state jobqueue.Done are pruned. The job manifest (job.json) is
+// kept, so that the job’s history and the space reclaimed remain visible.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+const day = 24 * time.Hour
+
+// Result describes the space reclaimed by a sweep.
+type Result struct {
+	Jobs  int   // number of jobs which were pruned
+	Bytes int64 // number of bytes reclaimed
+}
+
+// Due returns whether the originals and files, respectively, of the job
+// summarized by s should be pruned at now according to cfg.
+func Due(s jobqueue.Summary, cfg scan2drive.RetentionConfig, now time.Time) (originals, files bool) {
+	if s.State != jobqueue.Done {
+		return false, false
+	}
+	finished := s.Finished
+	if finished.IsZero() {
+		return false, false
+	}
+	due := func(days int) bool {
+		return days > 0 && now.Sub(finished) >= time.Duration(days)*day
+	}
+	return due(cfg.OriginalsDays) && !s.OriginalsPruned,
+		due(cfg.FilesDays) && !s.FilesPruned
+}
+
+// Sweep applies the user’s retention policy to all of the user’s jobs.
+func Sweep(ctx context.Context, u *user.Account, now time.Time) (Result, error) {
+	tr, _ := trace.FromContext(ctx)
+	var res Result
+	cfg := u.Retention
+	if cfg.OriginalsDays <= 0 && cfg.FilesDays <= 0 {
+		return res, nil // keep forever
+	}
+	scans, _, err := u.Queue.List(0, 0)
+	if err != nil {
+		return res, err
+	}
+	for _, s := range scans {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		originals, files := Due(s, cfg, now)
+		if !originals && !files {
+			continue
+		}
+		j, err := u.Queue.JobById(s.Id)
+		if err != nil {
+			return res, err
+		}
+		var reclaimed int64
+		if originals {
+			n, err := j.PruneOriginals()
+			reclaimed += n
+			if err != nil {
+				return res, fmt.Errorf("job %s: %v", j.Id(), err)
+			}
+		}
+		if files {
+			n, err := j.PruneFiles()
+			reclaimed += n
+			if err != nil {
+				return res, fmt.Errorf("job %s: %v", j.Id(), err)
+			}
+		}
+		tr.LazyPrintf("job %s: reclaimed %d bytes (originals: %v, files: %v)", j.Id(), reclaimed, originals, files)
+		res.Jobs++
+		res.Bytes += reclaimed
+	}
+	return res, nil
+}
+
+// Sweeper periodically sweeps the jobs of all users.
+type Sweeper struct {
+	// Users returns all users whose jobs should be swept.
+	Users func() map[string]*user.Account
+
+	// Interval is the delay between sweeps.
+	Interval time.Duration
+}
+
+// SweepAll sweeps the jobs of all users once and logs the space reclaimed.
+func (s *Sweeper) SweepAll(ctx context.Context) {
+	tr := trace.New("Retention", "Sweep")
+	defer tr.Finish()
+	ctx = trace.NewContext(ctx, tr)
+
+	now := time.Now()
+	for sub, u := range s.Users() {
+		res, err := Sweep(ctx, u, now)
+		if err != nil {
+			log.Printf("retention: user %s: %v", sub, err)
+			tr.LazyPrintf("user %s: %v", sub, err)
+			tr.SetError()
+		}
+		if res.Jobs > 0 {
+			log.Printf("retention: user %s: reclaimed %s from %d jobs", sub, FormatBytes(res.Bytes), res.Jobs)
+		}
+	}
+}
+
+// Run sweeps the jobs of all users every Interval until ctx is canceled.
+func (s *Sweeper) Run(ctx context.Context) error {
+	for {
+		s.SweepAll(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.Interval):
+		}
+	}
+}
+
+// FormatBytes returns a human-readable representation of n bytes, e.g. 1.5
+// MiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retention_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/retention"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+func testJob(t *testing.T, q *jobqueue.Queue, id string, done bool) *jobqueue.Job {
+	dir := filepath.Join(q.Dir, id)
+	if err := os.MkdirAll(filepath.Join(dir, "binarize"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fn, content := range map[string]string{
+		"page1.jpg":          "first page",
+		"binarize/page1.png": "binarized",
+		"scan.pdf":           "%PDF-1.4",
+		"thumb.png":          "thumb",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j, err := q.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markers := []string{"scan"}
+	if done {
+		markers = append(markers, "done")
+	}
+	for _, marker := range markers {
+		if err := j.CommitMarker(marker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return j
+}
+
+func exists(t *testing.T, j *jobqueue.Job, fn string) bool {
+	_, err := os.Stat(filepath.Join(j.Dir(), fn))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestSweep(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	u := &user.Account{
+		Sub:   "a",
+		Queue: q,
+		Retention: scan2drive.RetentionConfig{
+			OriginalsDays: 7,
+			FilesDays:     30,
+		},
+	}
+	done := testJob(t, q, "done", true)
+	inProgress := testJob(t, q, "inprogress", false)
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+	now := time.Now()
+
+	for _, tt := range []struct {
+		after     time.Duration
+		wantJobs  int
+		wantBytes int64
+		originals bool // whether the originals are still present
+		files     bool // whether the PDF and thumbnail are still present
+	}{
+		{after: 0, originals: true, files: true},
+		{after: 8 * 24 * time.Hour, wantJobs: 1, wantBytes: 19, files: true},
+		{after: 9 * 24 * time.Hour, files: true}, // nothing left to prune
+		{after: 31 * 24 * time.Hour, wantJobs: 1, wantBytes: 13},
+	} {
+		res, err := retention.Sweep(ctx, u, now.Add(tt.after))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Jobs != tt.wantJobs || res.Bytes != tt.wantBytes {
+			t.Errorf("Sweep(+%v) = %+v, want %d jobs, %d bytes", tt.after, res, tt.wantJobs, tt.wantBytes)
+		}
+		for _, fn := range []string{"page1.jpg", "binarize"} {
+			if got := exists(t, done, fn); got != tt.originals {
+				t.Errorf("after %v: %s exists = %v, want %v", tt.after, fn, got, tt.originals)
+			}
+		}
+		for _, fn := range []string{"scan.pdf", "thumb.png"} {
+			if got := exists(t, done, fn); got != tt.files {
+				t.Errorf("after %v: %s exists = %v, want %v", tt.after, fn, got, tt.files)
+			}
+		}
+	}
+
+	// Jobs which are not done are never touched.
+	for _, fn := range []string{"page1.jpg", "binarize", "scan.pdf", "thumb.png"} {
+		if !exists(t, inProgress, fn) {
+			t.Errorf("%s of job in progress removed", fn)
+		}
+	}
+
+	// The pruning is recorded in the manifest.
+	done, err := q.JobById(done.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done.OriginalsPruned() || !done.FilesPruned() {
+		t.Errorf("pruning not recorded: %+v", done.Manifest())
+	}
+	if got, want := done.Reclaimed(), int64(19+13); got != want {
+		t.Errorf("unexpected reclaimed space: got %d, want %d", got, want)
+	}
+	if got, want := done.State(), jobqueue.Done; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+}
+
+func TestSweepLegacy(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	u := &user.Account{
+		Sub:       "a",
+		Queue:     q,
+		Retention: scan2drive.RetentionConfig{OriginalsDays: 7},
+	}
+	// scan2drive versions before job.json and pluggable sinks marked jobs as
+	// done by uploading the PDF.
+	dir := filepath.Join(q.Dir, "legacy")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fn, content := range map[string]string{
+		"page1.jpg":          "first page",
+		"scan.pdf":           "%PDF-1.4",
+		"COMPLETE.scan":      "",
+		"COMPLETE.uploadpdf": "",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j, err := q.JobById("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Finished().IsZero() {
+		t.Fatalf("legacy job not finished")
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	res, err := retention.Sweep(trace.NewContext(context.Background(), tr), u, time.Now().Add(8*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Jobs != 1 {
+		t.Errorf("Sweep = %+v, want 1 job pruned", res)
+	}
+	if exists(t, j, "page1.jpg") {
+		t.Errorf("originals of legacy job not pruned")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	} {
+		if got := retention.FormatBytes(tt.n); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -16,36 +16,220 @@
 // a jobqueue.
 package scaningest
 
-import "github.com/stapelberg/scan2drive/internal/page"
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+)
+
+// DuplexTimeout is how long the first pass of a manual duplex scan waits for
+// the second pass. Once it elapses, the first pass is ingested on its own.
+var DuplexTimeout = 5 * time.Minute
 
 type Ingester struct {
-	IngestCallback func(*Job) (string, error)
+	// Queue is the job queue into which jobs are ingested. Pages are staged in
+	// the queue as they arrive (see jobqueue.Staging), so that jobs of any size
+	// can be ingested with bounded memory usage.
+	Queue *jobqueue.Queue
+
+	// IngestCallback is called once the job was committed to Queue, e.g. to
+	// schedule processing the job.
+	IngestCallback func(*jobqueue.Job) error
+
+	// Profile is the processing profile of jobs created by this ingester.
+	Profile string
+
+	// ManualDuplex turns jobs created by this ingester into one pass of a
+	// manual duplex scan, for scanners which can only scan one side of the
+	// pages in their feeder: the user scans the front sides, flips the stack
+	// and scans the back sides. See Job.Ingest.
+	ManualDuplex bool
+
+	// Thresholders returns the Thresholder with which jobs of the specified
+	// processing profile are binarized, for scanners which binarize pages
+	// while scanning (see package fss500). If nil, pages are binarized using
+	// page.DefaultThresholder.
+	Thresholders func(profile string) page.Thresholder
 }
 
 type Job struct {
 	ingester *Ingester
-	Pages    []*page.Any
+	staging  *jobqueue.Staging
+
+	// Source is the id of the scan source (see scan2drive.ScanSourceMetadata)
+	// which produced the job.
+	Source string
+
+	// Profile is the processing profile with which the job will be processed.
+	Profile string
+
+	// duplex is set for passes of a manual duplex scan.
+	duplex bool
 }
 
 func (i *Ingester) NewJob() (*Job, error) {
-	return &Job{ingester: i}, nil
+	staging, err := i.Queue.NewStaging()
+	if err != nil {
+		return nil, err
+	}
+	return &Job{
+		ingester: i,
+		staging:  staging,
+		Profile:  i.Profile,
+		duplex:   i.ManualDuplex,
+	}, nil
 }
 
+// AddPage writes the page to the job’s staging directory, so that the caller
+// can release the page’s memory.
 func (j *Job) AddPage(page *page.Any) error {
-	// NOTE: For large jobs, we’d need to spill pages to disk to not exhaust
-	// memory. For now, we just assume small-enough jobs, and/or enough RAM.
-	j.Pages = append(j.Pages, page)
-	return nil
+	return j.staging.AddPage(page)
 }
 
-func (j *Job) ReversePages() {
-	var reversed []*page.Any
-	for i := len(j.Pages) - 1; i >= 0; i-- {
-		reversed = append(reversed, j.Pages[i])
+// Thresholder returns the Thresholder with which scanners should binarize the
+// pages of the job, see Ingester.Thresholders.
+func (j *Job) Thresholder() page.Thresholder {
+	if j.ingester.Thresholders == nil {
+		return page.DefaultThresholder
 	}
-	j.Pages = reversed
+	return j.ingester.Thresholders(j.Profile)
+}
+
+// Len returns the number of pages added so far.
+func (j *Job) Len() int {
+	return j.staging.Len()
+}
+
+func (j *Job) ReversePages() {
+	j.staging.Reverse()
+}
+
+// Discard removes the pages of a job which will not be ingested, e.g. because
+// scanning failed.
+func (j *Job) Discard() error {
+	return j.staging.Discard()
 }
 
+// Ingest commits the job to the queue and returns its id.
+//
+// For the first pass of a manual duplex scan (see Ingester.ManualDuplex),
+// Ingest holds on to the pages and returns an empty id. Once the second pass
+// is ingested into the same queue within DuplexTimeout, its pages are
+// reversed (the stack was flipped) and interleaved with those of the first
+// pass into a single job, whose id Ingest returns. If the second pass does
+// not arrive in time, the first pass is ingested on its own. If the passes
+// differ in their number of pages, the back sides are ingested after the
+// front sides and Ingest returns an error.
+//
+// The first pass is held in memory only: when scan2drive restarts before the
+// second pass arrives, the first pass is not ingested. Its pages remain in the
+// (logged) staging directory until it is removed as abandoned.
 func (j *Job) Ingest() (string, error) {
-	return j.ingester.IngestCallback(j)
+	if !j.duplex {
+		return j.ingest()
+	}
+	fronts := takeFirstPass(j.ingester.Queue)
+	if fronts == nil {
+		holdFirstPass(j)
+		return "", nil
+	}
+	j.staging.Reverse()
+	if n, m := fronts.Len(), j.Len(); n != m {
+		// Do not guess which pages belong together, but do not lose any
+		// pages, either.
+		if err := fronts.staging.Append(j.staging); err != nil {
+			return "", err
+		}
+		id, err := fronts.ingest()
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("manual duplex: first pass has %d pages, second pass has %d pages: ingested job %s with the back sides after the front sides", n, m, id)
+	}
+	if err := fronts.staging.Interleave(j.staging); err != nil {
+		return "", err
+	}
+	return fronts.ingest()
+}
+
+func (j *Job) ingest() (string, error) {
+	j.staging.Source = j.Source
+	j.staging.Profile = j.Profile
+	job, err := j.staging.Commit()
+	if err != nil {
+		// The error contains the directory in which the staged pages were
+		// kept, which callers might not log.
+		log.Printf("ingesting job: %v", err)
+		return "", err
+	}
+	if cb := j.ingester.IngestCallback; cb != nil {
+		if err := cb(job); err != nil {
+			return "", err
+		}
+	}
+	return job.Id(), nil
+}
+
+type firstPass struct {
+	job   *Job
+	timer *time.Timer
+}
+
+var duplex struct {
+	sync.Mutex
+	pending map[string]*firstPass // by queue directory
+}
+
+// holdFirstPass keeps the job until the second pass arrives, or until
+// DuplexTimeout elapses.
+func holdFirstPass(j *Job) {
+	duplex.Lock()
+	defer duplex.Unlock()
+	if duplex.pending == nil {
+		duplex.pending = make(map[string]*firstPass)
+	}
+	dir := j.ingester.Queue.Dir
+	fp := &firstPass{job: j}
+	fp.timer = time.AfterFunc(DuplexTimeout, func() {
+		duplex.Lock()
+		if duplex.pending[dir] != fp {
+			duplex.Unlock()
+			return // second pass arrived
+		}
+		delete(duplex.pending, dir)
+		duplex.Unlock()
+		log.Printf("manual duplex: second pass did not arrive within %v, ingesting first pass (%d pages) on its own", DuplexTimeout, j.Len())
+		if _, err := j.ingest(); err != nil {
+			log.Printf("manual duplex: ingesting first pass: %v", err)
+		}
+	})
+	duplex.pending[dir] = fp
+	log.Printf("manual duplex: holding first pass (%d pages, staged in %s) for up to %v until the second pass arrives", j.Len(), j.staging.Dir(), DuplexTimeout)
+}
+
+// takeFirstPass returns the first pass which waits for its second pass in q,
+// or nil if there is none.
+func takeFirstPass(q *jobqueue.Queue) *Job {
+	duplex.Lock()
+	defer duplex.Unlock()
+	fp, ok := duplex.pending[q.Dir]
+	if !ok {
+		return nil
+	}
+	delete(duplex.pending, q.Dir)
+	fp.timer.Stop() // the timer function returns early if it already fired
+	return fp.job
+}
+
+// AwaitingSecondPass returns whether the first pass of a manual duplex scan
+// waits for its second pass in q.
+func AwaitingSecondPass(q *jobqueue.Queue) bool {
+	duplex.Lock()
+	defer duplex.Unlock()
+	_, ok := duplex.pending[q.Dir]
+	return ok
 }
@@ -0,0 +1,144 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scaningest_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/scaningest"
+)
+
+// scanPass ingests a job consisting of the specified pages.
+func scanPass(t *testing.T, ingester *scaningest.Ingester, pages ...string) (string, error) {
+	job, err := ingester.NewJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Source = "airscan!test"
+	for _, p := range pages {
+		if err := job.AddPage(page.JPEGPageFromBytes([]byte(p))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return job.Ingest()
+}
+
+func pageContents(t *testing.T, j *jobqueue.Job) []string {
+	var contents []string
+	for _, pg := range j.Pages() {
+		b, err := pg.JPEGBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func testIngester(t *testing.T) (*scaningest.Ingester, chan *jobqueue.Job) {
+	ingested := make(chan *jobqueue.Job, 1)
+	return &scaningest.Ingester{
+		Queue: &jobqueue.Queue{Dir: t.TempDir()},
+		IngestCallback: func(j *jobqueue.Job) error {
+			ingested <- j
+			return nil
+		},
+		Profile:      "duplex",
+		ManualDuplex: true,
+	}, ingested
+}
+
+func TestManualDuplex(t *testing.T) {
+	ingester, ingested := testIngester(t)
+
+	id, err := scanPass(t, ingester, "front 1", "front 2", "front 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		t.Errorf("first pass ingested as job %q, want it to wait for the second pass", id)
+	}
+	if !scaningest.AwaitingSecondPass(ingester.Queue) {
+		t.Errorf("AwaitingSecondPass = false, want true")
+	}
+
+	// The stack was flipped, so the back sides arrive last page first.
+	id, err = scanPass(t, ingester, "back 3", "back 2", "back 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := <-ingested
+	if got, want := job.Id(), id; got != want {
+		t.Errorf("unexpected job id: got %q, want %q", got, want)
+	}
+	if scaningest.AwaitingSecondPass(ingester.Queue) {
+		t.Errorf("AwaitingSecondPass = true after second pass, want false")
+	}
+	want := []string{"front 1", "back 1", "front 2", "back 2", "front 3", "back 3"}
+	if got := pageContents(t, job); !slices.Equal(got, want) {
+		t.Errorf("unexpected pages: got %q, want %q", got, want)
+	}
+	if job.Source != "airscan!test" || job.Profile != "duplex" {
+		t.Errorf("unexpected source/profile: got %q/%q", job.Source, job.Profile)
+	}
+}
+
+func TestManualDuplexMismatch(t *testing.T) {
+	ingester, ingested := testIngester(t)
+
+	if _, err := scanPass(t, ingester, "front 1", "front 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanPass(t, ingester, "back 2"); err == nil {
+		t.Errorf("Ingest unexpectedly succeeded for passes with different numbers of pages")
+	}
+	// No pages are lost.
+	job := <-ingested
+	want := []string{"front 1", "front 2", "back 2"}
+	if got := pageContents(t, job); !slices.Equal(got, want) {
+		t.Errorf("unexpected pages: got %q, want %q", got, want)
+	}
+}
+
+func TestManualDuplexTimeout(t *testing.T) {
+	defer func(d time.Duration) { scaningest.DuplexTimeout = d }(scaningest.DuplexTimeout)
+	scaningest.DuplexTimeout = 10 * time.Millisecond
+	ingester, ingested := testIngester(t)
+
+	if _, err := scanPass(t, ingester, "front 1", "front 2"); err != nil {
+		t.Fatal(err)
+	}
+	// The first pass is ingested on its own once the timeout elapses.
+	var job *jobqueue.Job
+	select {
+	case job = <-ingested:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("first pass not ingested after timeout")
+	}
+	want := []string{"front 1", "front 2"}
+	if got := pageContents(t, job); !slices.Equal(got, want) {
+		t.Errorf("unexpected pages: got %q, want %q", got, want)
+	}
+	if scaningest.AwaitingSecondPass(ingester.Queue) {
+		t.Errorf("AwaitingSecondPass = true after timeout, want false")
+	}
+	if got, want := job.State(), jobqueue.InProgress; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+}
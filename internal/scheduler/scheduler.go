@@ -0,0 +1,389 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scheduler distributes the jobs of all users onto a bounded number of
+// workers, taking turns between users so that one user’s slow uploads (or
+// large backlog) do not delay everyone else’s scans.
+//
+// Jobs which fail are retried with exponential backoff, until they failed
+// MaxAttempts times or with a permanent error (see Permanent). Such jobs are
+// parked in state jobqueue.Failed until they are retried manually.
+//
+// Cancel removes a job from the queue, or interrupts its processing.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/oauth2"
+)
+
+// Defaults for the retry policy of a Scheduler returned by New.
+const (
+	DefaultMaxAttempts = 10
+	DefaultBackoff     = 1 * time.Minute
+	DefaultMaxBackoff  = 4 * time.Hour
+)
+
+// ProcessFunc processes one job.
+type ProcessFunc func(ctx context.Context, u *user.Account, j *jobqueue.Job) error
+
+type entry struct {
+	user *user.Account
+	job  *jobqueue.Job
+}
+
+// running is a job which a worker is processing.
+type running struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the worker is done with the job
+}
+
+// Scheduler implements per-user job queues which are served round-robin.
+type Scheduler struct {
+	// MaxAttempts is the number of failed attempts after which a job is
+	// parked in state jobqueue.Failed.
+	MaxAttempts int
+
+	// Backoff is the delay before retrying a job which failed once. The delay
+	// doubles with each further failure, up to MaxBackoff, and is randomized
+	// by up to half so that jobs which failed together do not retry together.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	workers int
+	process ProcessFunc
+
+	// wake is signaled when jobs were enqueued.
+	wake chan struct{}
+
+	mu     sync.Mutex
+	queues map[string][]entry // by user sub
+	order  []string           // subs of users with queued jobs, in turn order
+	next   int                // index into order
+	// pending contains the keys of all queued, running or waiting (to be
+	// retried) jobs.
+	pending map[string]bool
+	running map[string]*running    // by key
+	waiting map[string]*time.Timer // by key
+}
+
+// New returns a Scheduler which runs process on up to workers jobs at a time.
+func New(workers int, process ProcessFunc) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scheduler{
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+
+		workers: workers,
+		process: process,
+		wake:    make(chan struct{}, 1),
+		queues:  make(map[string][]entry),
+		pending: make(map[string]bool),
+		running: make(map[string]*running),
+		waiting: make(map[string]*time.Timer),
+	}
+}
+
+func key(u *user.Account, jobId string) string {
+	return u.Sub + "/" + jobId
+}
+
+// Enqueue adds the job to the user’s queue and returns true, unless the job is
+// already queued, running or waiting to be retried, or the job failed or was
+// canceled, in which case it returns false. Jobs whose next attempt (see
+// jobqueue.Job.NextAttempt) lies in the future are added to the queue once it
+// is due. Enqueue never blocks.
+func (s *Scheduler) Enqueue(u *user.Account, j *jobqueue.Job) bool {
+	if st := j.State(); st == jobqueue.Failed || st == jobqueue.Canceled {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(u, j.Id())
+	if s.pending[k] {
+		return false
+	}
+	s.pending[k] = true
+	if wait := time.Until(j.NextAttempt()); wait > 0 {
+		s.waiting[k] = time.AfterFunc(wait, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if _, ok := s.waiting[k]; !ok {
+				return // canceled
+			}
+			delete(s.waiting, k)
+			s.push(entry{user: u, job: j})
+		})
+		return true
+	}
+	s.push(entry{user: u, job: j})
+	return true
+}
+
+// push adds the job to the user’s queue. s.mu must be held.
+func (s *Scheduler) push(e entry) {
+	u := e.user
+	if len(s.queues[u.Sub]) == 0 {
+		// Insert the user right before the user whose turn is next, i.e. the
+		// new user’s turn comes last.
+		s.order = append(s.order[:s.next], append([]string{u.Sub}, s.order[s.next:]...)...)
+		s.next++
+	}
+	s.queues[u.Sub] = append(s.queues[u.Sub], e)
+	s.signal()
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// a wake-up is already pending
+	}
+}
+
+// Len returns the number of queued, running or waiting jobs.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// remove removes the job from the user’s queue. s.mu must be held.
+func (s *Scheduler) remove(sub, jobId string) {
+	q := s.queues[sub]
+	for idx, e := range q {
+		if e.job.Id() == jobId {
+			q = append(q[:idx:idx], q[idx+1:]...)
+			break
+		}
+	}
+	if len(q) > 0 {
+		s.queues[sub] = q
+		return
+	}
+	delete(s.queues, sub)
+	for idx, o := range s.order {
+		if o != sub {
+			continue
+		}
+		s.order = append(s.order[:idx], s.order[idx+1:]...)
+		if idx < s.next {
+			s.next--
+		}
+		break
+	}
+}
+
+// Cancel removes the job from the queue or, if the job is being processed,
+// interrupts processing and waits until the worker is done with the job.
+// Cancel returns false if the job was neither queued, running nor waiting.
+//
+// To prevent the job from being enqueued again, move it into state
+// jobqueue.Canceled after Cancel returns.
+func (s *Scheduler) Cancel(u *user.Account, jobId string) bool {
+	s.mu.Lock()
+	k := key(u, jobId)
+	if !s.pending[k] {
+		s.mu.Unlock()
+		return false
+	}
+	if r, ok := s.running[k]; ok {
+		s.mu.Unlock()
+		r.cancel()
+		<-r.done
+		return true
+	}
+	defer s.mu.Unlock()
+	if t, ok := s.waiting[k]; ok {
+		t.Stop()
+		delete(s.waiting, k)
+	} else {
+		s.remove(u.Sub, jobId)
+	}
+	delete(s.pending, k)
+	return true
+}
+
+// dequeue returns the next job of the user whose turn it is, which the caller
+// needs to process using the returned context.
+func (s *Scheduler) dequeue(ctx context.Context) (context.Context, entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.order) == 0 {
+		return nil, entry{}, false
+	}
+	if s.next >= len(s.order) {
+		s.next = 0
+	}
+	sub := s.order[s.next]
+	e := s.queues[sub][0]
+	s.queues[sub] = s.queues[sub][1:]
+	if len(s.queues[sub]) == 0 {
+		delete(s.queues, sub)
+		s.order = append(s.order[:s.next], s.order[s.next+1:]...)
+	} else {
+		s.next++
+	}
+	if len(s.order) > 0 {
+		// Let another idle worker pick up the remaining jobs.
+		s.signal()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.running[key(e.user, e.job.Id())] = &running{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	return ctx, e, true
+}
+
+func (s *Scheduler) done(e entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(e.user, e.job.Id())
+	r := s.running[k]
+	r.cancel()
+	close(r.done)
+	delete(s.running, k)
+	delete(s.pending, k)
+}
+
+func (s *Scheduler) worker(ctx context.Context) {
+	for {
+		jobCtx, e, ok := s.dequeue(ctx)
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		var retry bool
+		if err := s.process(jobCtx, e.user, e.job); err != nil {
+			if jobCtx.Err() != nil {
+				// Processing was interrupted (by Cancel or because ctx was
+				// canceled), not failed.
+				log.Printf("job %v interrupted: %v", e.job.Id(), err)
+			} else {
+				retry = s.failed(e.job, err)
+			}
+		}
+		s.done(e)
+		if ctx.Err() != nil {
+			return
+		}
+		if retry {
+			s.Enqueue(e.user, e.job)
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt after the specified number
+// of failed attempts.
+func (s *Scheduler) backoff(attempts int) time.Duration {
+	d := s.Backoff
+	for i := 1; i < attempts && d < s.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, s.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// failed records the failed attempt in the job and returns whether the job
+// should be retried.
+func (s *Scheduler) failed(j *jobqueue.Job, err error) bool {
+	attempts := j.Attempts() + 1
+	if IsPermanent(err) || attempts >= s.MaxAttempts {
+		log.Printf("job %v failed permanently (attempt %d of %d): %v", j.Id(), attempts, s.MaxAttempts, err)
+		if err := j.MarkFailed(err); err != nil {
+			log.Printf("job %v: %v", j.Id(), err)
+		}
+		return false
+	}
+	delay := s.backoff(attempts)
+	log.Printf("job %v failed (attempt %d of %d), retrying in %v: %v", j.Id(), attempts, s.MaxAttempts, delay.Round(time.Second), err)
+	if err := j.RecordFailure(err, time.Now().Add(delay)); err != nil {
+		log.Printf("job %v: %v", j.Id(), err)
+	}
+	return true
+}
+
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string { return p.err.Error() }
+func (p *permanentError) Unwrap() error { return p.err }
+
+// Permanent marks err as permanent, i.e. retrying the job will not help until
+// the user intervenes (e.g. by fixing the configuration).
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns whether err (or any error it wraps) was marked using
+// Permanent, or is known to be permanent: corrupt images, and OAuth tokens
+// which were revoked or expired.
+func IsPermanent(err error) bool {
+	var (
+		permanent   *permanentError
+		format      jpeg.FormatError
+		unsupported jpeg.UnsupportedError
+		retrieve    *oauth2.RetrieveError
+	)
+	switch {
+	case errors.As(err, &permanent),
+		errors.As(err, &format),
+		errors.As(err, &unsupported),
+		errors.Is(err, image.ErrFormat):
+		return true
+	case errors.As(err, &retrieve):
+		return retrieve.ErrorCode == "invalid_grant"
+	}
+	return false
+}
+
+// Run starts the workers and returns once ctx is canceled and all workers
+// finished processing their current job.
+func (s *Scheduler) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,283 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/scheduler"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/oauth2"
+)
+
+func testJob(t *testing.T, q *jobqueue.Queue, id string) *jobqueue.Job {
+	if err := os.MkdirAll(filepath.Join(q.Dir, id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	j, err := q.JobById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CommitMarker("scan"); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestRoundRobin(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	users := map[string]*user.Account{
+		"a": {Sub: "a"},
+		"b": {Sub: "b"},
+		"c": {Sub: "c"},
+	}
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	ctx, canc := context.WithCancel(context.Background())
+	defer canc()
+	s := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, j.Id())
+		return nil
+	})
+	for _, id := range []string{"a1", "a2", "a3", "b1", "c1"} {
+		if !s.Enqueue(users[id[:1]], testJob(t, q, id)) {
+			t.Fatalf("Enqueue(%s) = false, want true", id)
+		}
+	}
+	if s.Enqueue(users["a"], testJob(t, q, "a2")) {
+		t.Errorf("Enqueue of already queued job a2 = true, want false")
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	for s.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	canc()
+	<-done
+
+	// a’s backlog does not delay b’s and c’s jobs.
+	if want := []string{"a1", "b1", "c1", "a2", "a3"}; !slices.Equal(order, want) {
+		t.Errorf("unexpected processing order: got %q, want %q", order, want)
+	}
+}
+
+func TestBoundedWorkers(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	var (
+		mu            sync.Mutex
+		running, peak int
+	)
+	ctx, canc := context.WithCancel(context.Background())
+	defer canc()
+	s := scheduler.New(2, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		s.Enqueue(&user.Account{Sub: id}, testJob(t, q, id))
+	}
+	for s.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	canc()
+	<-done
+
+	if got, want := peak, 2; got != want {
+		t.Errorf("unexpected number of concurrently processed jobs: got %d, want %d", got, want)
+	}
+}
+
+// run processes all enqueued jobs, including their retries.
+func run(t *testing.T, s *scheduler.Scheduler) {
+	ctx, canc := context.WithCancel(context.Background())
+	defer canc()
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	for s.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	canc()
+	<-done
+}
+
+func TestRetryBackoff(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	var (
+		mu    sync.Mutex
+		calls []time.Time
+	)
+	s := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, time.Now())
+		if len(calls) < 3 {
+			return fmt.Errorf("connection reset")
+		}
+		return nil
+	})
+	s.Backoff = 20 * time.Millisecond
+	j := testJob(t, q, "a")
+	s.Enqueue(&user.Account{Sub: "a"}, j)
+	run(t, s)
+
+	if got, want := len(calls), 3; got != want {
+		t.Fatalf("unexpected number of attempts: got %d, want %d", got, want)
+	}
+	// The delay doubles with each attempt, with up to half of it randomized.
+	for i, min := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+		if got := calls[i+1].Sub(calls[i]); got < min {
+			t.Errorf("retry %d after %v, want at least %v", i+1, got, min)
+		}
+	}
+	if got, want := j.Attempts(), 2; got != want {
+		t.Errorf("unexpected number of failed attempts: got %d, want %d", got, want)
+	}
+	if got, want := j.State(), jobqueue.InProgress; got != want {
+		t.Errorf("unexpected job state: got %v, want %v", got, want)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"MaxAttempts", fmt.Errorf("connection reset"), 3},
+		{"Permanent", scheduler.Permanent(fmt.Errorf("profile not found")), 1},
+		{"CorruptJPEG", fmt.Errorf("stage %q: %w", "convert", jpeg.FormatError("missing SOI marker")), 1},
+		{"RevokedToken", fmt.Errorf("stage %q: %w", "sink.drive", &oauth2.RetrieveError{ErrorCode: "invalid_grant"}), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &jobqueue.Queue{Dir: t.TempDir()}
+			var (
+				mu    sync.Mutex
+				calls int
+			)
+			s := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				return tt.err
+			})
+			s.MaxAttempts = 3
+			s.Backoff = time.Millisecond
+			u := &user.Account{Sub: "a"}
+			j := testJob(t, q, "a")
+			s.Enqueue(u, j)
+			run(t, s)
+
+			if calls != tt.wantCalls {
+				t.Errorf("unexpected number of attempts: got %d, want %d", calls, tt.wantCalls)
+			}
+			// Failed jobs are parked until they are retried manually, also
+			// after a restart.
+			j, err := q.JobById(j.Id())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := j.State(), jobqueue.Failed; got != want {
+				t.Fatalf("unexpected job state: got %v, want %v", got, want)
+			}
+			if s.Enqueue(u, j) {
+				t.Errorf("Enqueue of failed job = true, want false")
+			}
+			if err := j.Retry(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := j.State(), jobqueue.InProgress; got != want {
+				t.Errorf("unexpected job state after Retry: got %v, want %v", got, want)
+			}
+			if !s.Enqueue(u, j) {
+				t.Errorf("Enqueue of retried job = false, want true")
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	started := make(chan string)
+	s := scheduler.New(1, func(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+		started <- j.Id()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	u := &user.Account{Sub: "a"}
+	running := testJob(t, q, "a1")
+	queued := testJob(t, q, "a2")
+	s.Enqueue(u, running)
+	s.Enqueue(u, queued)
+
+	ctx, canc := context.WithCancel(context.Background())
+	defer canc()
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	if got, want := <-started, "a1"; got != want {
+		t.Fatalf("unexpected job started: got %q, want %q", got, want)
+	}
+
+	// A queued job is removed from the queue.
+	if !s.Cancel(u, "a2") {
+		t.Errorf("Cancel(a2) = false, want true")
+	}
+	// A running job is interrupted, and Cancel waits until it is.
+	if !s.Cancel(u, "a1") {
+		t.Errorf("Cancel(a1) = false, want true")
+	}
+	if got, want := s.Len(), 0; got != want {
+		t.Errorf("unexpected number of jobs after Cancel: got %d, want %d", got, want)
+	}
+	if s.Cancel(u, "a1") {
+		t.Errorf("Cancel of canceled job a1 = true, want false")
+	}
+	// The interruption is not counted as a failed attempt.
+	if got, want := running.Attempts(), 0; got != want {
+		t.Errorf("unexpected number of failed attempts: got %d, want %d", got, want)
+	}
+
+	if err := queued.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Enqueue(u, queued) {
+		t.Errorf("Enqueue of canceled job = true, want false")
+	}
+	canc()
+	<-done
+}
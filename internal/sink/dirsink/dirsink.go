@@ -0,0 +1,315 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dirsink implements a sink to copy scans into a directory tree on
+// local or mounted (e.g. NAS) storage.
+package dirsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/atomicfile"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Config is the type-specific configuration of a dir sink in sinks.json.
+type Config struct {
+	// Root is the directory under which scans are placed in
+	// <root>/<user>/<year>/<month>/<job>.pdf
+	Root string `json:"root"`
+
+	// User defaults to the user’s sub.
+	User string `json:"user"`
+
+	// Originals enables copying page*.jpg into <job>/ next to the PDF.
+	Originals bool `json:"originals"`
+}
+
+func init() {
+	sink.Register("dir", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var c Config
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		if c.User == "" {
+			c.User = u.Sub
+		}
+		return New(cfg.Id, c)
+	})
+}
+
+// Sink implements scan2drive.Sink.
+type Sink struct {
+	id  string
+	cfg Config
+}
+
+// New returns a dir sink with the specified id, as used for its completion
+// marker.
+func New(id string, cfg Config) (*Sink, error) {
+	if !filepath.IsAbs(cfg.Root) {
+		return nil, fmt.Errorf("root %q is not an absolute path", cfg.Root)
+	}
+	if cfg.User == "" || strings.ContainsAny(cfg.User, `/\`) || cfg.User == "." || cfg.User == ".." {
+		return nil, fmt.Errorf("invalid user directory name %q", cfg.User)
+	}
+	return &Sink{id: id, cfg: cfg}, nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *Sink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{
+		Originals: s.cfg.Originals,
+		PDF:       true,
+	}
+}
+
+// Dir returns the directory into which the job is copied.
+func (s *Sink) Dir(j *jobqueue.Job) string {
+	created := j.Created()
+	return filepath.Join(
+		s.cfg.Root,
+		s.cfg.User,
+		fmt.Sprintf("%04d", created.Year()),
+		fmt.Sprintf("%02d", created.Month()))
+}
+
+// dest returns the destination of the job’s file, or false if the file is not
+// delivered.
+func (s *Sink) dest(j *jobqueue.Job, filename string) (string, bool) {
+	switch name := filepath.Base(filename); {
+	case name == "scan.pdf":
+		return filepath.Join(s.Dir(j), j.DeliveryId()+".pdf"), true
+	case s.cfg.Originals && filepath.Ext(name) == ".jpg":
+		return filepath.Join(s.Dir(j), j.DeliveryId(), name), true
+	}
+	return "", false
+}
+
+// state is persisted in sink-<id>.dir.json in the job directory, so that the
+// files of reprocessed jobs replace the files which were delivered before,
+// instead of being copied next to them (see copyFile).
+type state struct {
+	// Files maps the names of the job’s files to where they were delivered.
+	Files map[string]string `json:"files"`
+}
+
+func (s *Sink) stateFilename() string {
+	return "sink-" + s.id + ".dir.json"
+}
+
+func (s *Sink) readState(j *jobqueue.Job) (*state, error) {
+	st := &state{Files: make(map[string]string)}
+	b, err := j.ReadDerivedFile(s.stateFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]string)
+	}
+	return st, nil
+}
+
+// delivered returns where the file was delivered before, or false if it was
+// not delivered to dest (or a name copyFile picks for dest), e.g. because
+// the configuration changed since.
+func (st *state) delivered(filename, dest string) (string, bool) {
+	prev, ok := st.Files[filepath.Base(filename)]
+	if !ok || filepath.Dir(prev) != filepath.Dir(dest) {
+		return "", false
+	}
+	if prev == dest {
+		return prev, true
+	}
+	ext := filepath.Ext(dest)
+	num, ok := strings.CutPrefix(strings.TrimSuffix(prev, ext), strings.TrimSuffix(dest, ext)+"-")
+	if !ok || !strings.HasSuffix(prev, ext) {
+		return "", false
+	}
+	if _, err := strconv.Atoi(num); err != nil {
+		return "", false
+	}
+	return prev, true
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	st, err := s.readState(j)
+	if err != nil {
+		return err
+	}
+	filenames, err := j.Filenames()
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		dest, ok := s.dest(j, filename)
+		if !ok {
+			continue
+		}
+		var written string
+		if prev, ok := st.delivered(filename, dest); ok {
+			// Replace the file delivered before, e.g. when reprocessing.
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			if err := atomicfile.WriteFile(prev, b, 0644); err != nil {
+				return err
+			}
+			written = prev
+		} else {
+			written, err = copyFile(filename, dest)
+			if err != nil {
+				return err
+			}
+		}
+		tr.LazyPrintf("copied %s to %s", filepath.Base(filename), written)
+		if st.Files[filepath.Base(filename)] == written {
+			continue
+		}
+		st.Files[filepath.Base(filename)] = written
+		b, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		if err := j.AddDerivedFile(s.stateFilename(), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// implements scan2drive.SinkDeleter
+//
+// Only files which were delivered for the job (see state) or whose contents
+// match the job’s files are deleted, as files of the same name can belong to
+// other scans (see copyFile). Delivered files are deleted even if the job’s
+// files were removed (see jobqueue.Job.PruneOriginals).
+func (s *Sink) Delete(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	st, err := s.readState(j)
+	if err != nil {
+		return err
+	}
+	for _, prev := range st.Files {
+		if err := os.Remove(prev); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		tr.LazyPrintf("deleted %s", prev)
+	}
+	// Jobs delivered by earlier versions of scan2drive have no state.
+	filenames, err := j.Filenames()
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		dest, ok := s.dest(j, filename)
+		if !ok {
+			continue
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(dest)
+		candidates, err := filepath.Glob(strings.TrimSuffix(dest, ext) + "-*" + ext)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range append([]string{dest}, candidates...) {
+			existing, err := os.ReadFile(candidate)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			if !bytes.Equal(existing, b) {
+				continue
+			}
+			if err := os.Remove(candidate); err != nil {
+				return err
+			}
+			tr.LazyPrintf("deleted %s", candidate)
+		}
+	}
+	// Remove the originals directory, unless other files remain.
+	if err := os.Remove(filepath.Join(s.Dir(j), j.DeliveryId())); err != nil && !os.IsNotExist(err) {
+		tr.LazyPrintf("not removing originals directory: %v", err)
+	}
+	return nil
+}
+
+// copyFile atomically copies src to dest. If dest already exists with
+// different contents, copyFile picks a new name by appending a number. If dest
+// already exists with identical contents (e.g. because a previous delivery
+// attempt did not get to commit its marker), copyFile does nothing.
+//
+// copyFile returns the name of the destination file.
+func copyFile(src, dest string) (string, error) {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for i := 0; ; i++ {
+		candidate := dest
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		existing, err := os.ReadFile(candidate)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+			if err := atomicfile.WriteFile(candidate, b, 0644); err != nil {
+				return "", err
+			}
+			return candidate, nil
+		}
+		if bytes.Equal(existing, b) {
+			return candidate, nil
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dirsink_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/sink/dirsink"
+	"golang.org/x/net/trace"
+)
+
+func TestDeliver(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes([]byte("page one"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	s, err := dirsink.New("nas", dirsink.Config{
+		Root:      root,
+		User:      "michael",
+		Originals: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+
+	dir := s.Dir(job)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a file of the same name from a different scan:
+	if err := os.WriteFile(filepath.Join(dir, job.Id()+".pdf"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivering twice must be idempotent.
+	for i := 0; i < 2; i++ {
+		if err := s.Deliver(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		fn   string
+		want string
+	}{
+		{job.Id() + ".pdf", "other"},
+		{job.Id() + "-1.pdf", "%PDF-1.0"},
+		{filepath.Join(job.Id(), "page1.jpg"), "page one"},
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, tt.fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.fn, got, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, job.Id()+"-2.pdf")); !os.IsNotExist(err) {
+		t.Errorf("repeated delivery created a duplicate PDF (stat err = %v)", err)
+	}
+
+	// Deleting removes the copies of this scan only.
+	if err := s.Delete(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, job.Id()+".pdf")); err != nil || string(b) != "other" {
+		t.Errorf("file of a different scan deleted: %q, %v", b, err)
+	}
+	for _, fn := range []string{job.Id() + "-1.pdf", job.Id()} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted (stat err = %v)", fn, err)
+		}
+	}
+}
+
+func TestDeliverReprocessed(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes([]byte("page one"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0 first version")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := dirsink.New("nas", dirsink.Config{
+		Root: t.TempDir(),
+		User: "michael",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+
+	dir := s.Dir(job)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a file of the same name from a different scan:
+	if err := os.WriteFile(filepath.Join(dir, job.Id()+".pdf"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reprocessed PDF replaces the PDF delivered before.
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0 second version")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	for fn, want := range map[string]string{
+		job.Id() + ".pdf":   "other",
+		job.Id() + "-1.pdf": "%PDF-1.0 second version",
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("%s: got %q, want %q", fn, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, job.Id()+"-2.pdf")); !os.IsNotExist(err) {
+		t.Errorf("reprocessed PDF delivered next to the PDF delivered before (stat err = %v)", err)
+	}
+}
+
+func TestDeletePruned(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes([]byte("page one"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := dirsink.New("nas", dirsink.Config{
+		Root:      t.TempDir(),
+		User:      "michael",
+		Originals: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copies are deleted even after the job’s files were pruned.
+	if err := job.CommitMarker("done"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.PruneOriginals(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.PruneFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	dir := s.Dir(job)
+	for _, fn := range []string{job.Id() + ".pdf", job.Id()} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted (stat err = %v)", fn, err)
+		}
+	}
+}
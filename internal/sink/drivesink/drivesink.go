@@ -17,13 +17,21 @@ package drivesink
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/stapelberg/scan2drive"
 	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
 	"github.com/stapelberg/scan2drive/internal/user"
 	"golang.org/x/net/trace"
 	"golang.org/x/sync/errgroup"
@@ -31,7 +39,220 @@ import (
 	"google.golang.org/api/googleapi"
 )
 
+func init() {
+	sink.Register("driveoriginals", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		return &originalsSink{id: cfg.Id, u: u}, nil
+	})
+	sink.Register("drive", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		return &pdfSink{id: cfg.Id, u: u}, nil
+	})
+}
+
+// originalsSink uploads the originals into a folder named after the job.
+type originalsSink struct {
+	id string
+	u  *user.Account
+}
+
+// implements scan2drive.Sink
+func (s *originalsSink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *originalsSink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{Originals: true}
+}
+
+// implements scan2drive.Sink
+func (s *originalsSink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	return UploadOriginals(ctx, s.u, j)
+}
+
+// implements scan2drive.SinkDeleter
+func (s *originalsSink) Delete(ctx context.Context, j *jobqueue.Job) error {
+	return TrashOriginals(ctx, s.u, j)
+}
+
+// pdfSink uploads the converted PDF, which Google Drive will then OCR.
+type pdfSink struct {
+	id string
+	u  *user.Account
+}
+
+// implements scan2drive.Sink
+func (s *pdfSink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *pdfSink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{PDF: true}
+}
+
+// implements scan2drive.Sink
+func (s *pdfSink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	return UploadPDF(ctx, s.u, j)
+}
+
+// implements scan2drive.SinkDeleter
+func (s *pdfSink) Delete(ctx context.Context, j *jobqueue.Job) error {
+	return TrashPDF(ctx, s.u, j)
+}
+
+// Files and folders uploaded by scan2drive carry appProperties (which are
+// private to the scan2drive OAuth client) identifying the job they belong to,
+// so that retries find earlier uploads instead of creating duplicates, e.g.
+// when the process died after an upload, but before the job marker was
+// committed.
+const (
+	propJob  = "scan2drive_job"
+	propRole = "scan2drive_role"
+
+	rolePDF       = "pdf"
+	roleOriginals = "originals" // folder
+	roleOriginal  = "original"  // page within the originals folder
+)
+
+func appProperties(j *jobqueue.Job, role string) map[string]string {
+	return map[string]string{
+		propJob:  j.DeliveryId(),
+		propRole: role,
+	}
+}
+
+const fileFields = "id, name, md5Checksum"
+
+// listFiles returns all (non-trashed) files matching query.
+func listFiles(ctx context.Context, driveSrv *drive.Service, query string) ([]*drive.File, error) {
+	var files []*drive.File
+	err := driveSrv.Files.List().
+		Q(query+" and trashed=false").
+		Fields("nextPageToken, files("+fileFields+")").
+		Pages(ctx, func(r *drive.FileList) error {
+			files = append(files, r.Files...)
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("Files.List(%q): %w", query, err)
+	}
+	return files, nil
+}
+
+// findTagged returns all files which were uploaded for the job in the
+// specified role.
+func findTagged(ctx context.Context, driveSrv *drive.Service, j *jobqueue.Job, role string) ([]*drive.File, error) {
+	query := fmt.Sprintf("appProperties has { key='%s' and value='%s' } and appProperties has { key='%s' and value='%s' }",
+		propJob, j.DeliveryId(),
+		propRole, role)
+	return listFiles(ctx, driveSrv, query)
+}
+
+// trash moves the specified files into the trash.
+func trash(ctx context.Context, driveSrv *drive.Service, files []*drive.File) error {
+	for _, file := range files {
+		log.Printf("Trashing %q (id %q)", file.Name, file.Id)
+		if _, err := driveSrv.Files.Update(file.Id, &drive.File{
+			Trashed: true,
+		}).Context(ctx).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pick returns the file whose contents match md5sum (if any), the file whose
+// contents should be replaced otherwise (if any), and all other files, which
+// are duplicates.
+func pick(files []*drive.File, md5sum string) (match, replace *drive.File, dups []*drive.File) {
+	for _, file := range files {
+		if match == nil && file.Md5Checksum == md5sum {
+			match = file
+		}
+	}
+	if match == nil && len(files) > 0 {
+		replace = files[0]
+	}
+	for _, file := range files {
+		if file != match && file != replace {
+			dups = append(dups, file)
+		}
+	}
+	return match, replace, dups
+}
+
+func fileMD5(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type upload struct {
+	filename    string
+	md5sum      string // of filename
+	contentType string
+	ocrLanguage string
+
+	// metadata is used when creating a new file.
+	metadata *drive.File
+
+	// replace, if non-nil, is the existing file whose contents are replaced
+	// instead of creating a new file.
+	replace *drive.File
+}
+
+// do uploads the file and verifies that the contents Google Drive stored
+// match the local file. Should they not match, the next attempt replaces the
+// contents of the uploaded file.
+func (up *upload) do(ctx context.Context, driveSrv *drive.Service) (*drive.File, error) {
+	f, err := os.Open(up.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r *drive.File
+	if up.replace == nil {
+		call := driveSrv.Files.Create(up.metadata).
+			Media(f, googleapi.ContentType(up.contentType)).
+			Fields(fileFields).
+			Context(ctx)
+		if up.ocrLanguage != "" {
+			call.OcrLanguage(up.ocrLanguage)
+		}
+		r, err = call.Do()
+	} else {
+		// Tag files uploaded by earlier versions of scan2drive, too.
+		call := driveSrv.Files.Update(up.replace.Id, &drive.File{
+			AppProperties: up.metadata.AppProperties,
+		}).
+			Media(f, googleapi.ContentType(up.contentType)).
+			Fields(fileFields).
+			Context(ctx)
+		if up.ocrLanguage != "" {
+			call.OcrLanguage(up.ocrLanguage)
+		}
+		r, err = call.Do()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Md5Checksum != up.md5sum {
+		return nil, fmt.Errorf("verifying upload of %s (id %q): Google Drive has MD5 %q, local file has MD5 %q", up.filename, r.Id, r.Md5Checksum, up.md5sum)
+	}
+	return r, nil
+}
+
+// parentMu serializes getCurrentParentDir so that sinks running concurrently
+// do not both create a folder for the current year.
+var parentMu sync.Mutex
+
 func getCurrentParentDir(u *user.Account) (string, error) {
+	parentMu.Lock()
+	defer parentMu.Unlock()
 	year := fmt.Sprintf("%d", time.Now().Year())
 	query := fmt.Sprintf("'%s' in parents and name = '%s' and trashed=false", u.Folder().Id, year)
 	r, err := u.Drive.Files.List().Q(query).PageSize(1).Fields("files(id, name)").Do()
@@ -56,47 +277,77 @@ func getCurrentParentDir(u *user.Account) (string, error) {
 	return rc.Id, nil
 }
 
+// originalsFolder returns the id of the folder into which the originals of
+// the job are uploaded, creating it if necessary.
+func originalsFolder(ctx context.Context, u *user.Account, j *jobqueue.Job) (string, error) {
+	driveSrv := u.Drive
+	folders, err := findTagged(ctx, driveSrv, j, roleOriginals)
+	if err != nil {
+		return "", err
+	}
+	if len(folders) > 0 {
+		// Keep uploading into the first folder. Files from any further
+		// folders are not merged; the folders are trashed in their entirety.
+		if err := trash(ctx, driveSrv, folders[1:]); err != nil {
+			return "", err
+		}
+		return folders[0].Id, nil
+	}
+
+	parentId, err := getCurrentParentDir(u)
+	if err != nil {
+		return "", err
+	}
+
+	// Trash any folders which have the same name from earlier partial uploads
+	// by versions of scan2drive which did not tag their uploads.
+	query := fmt.Sprintf("'%s' in parents and name = '%s'", parentId, j.DeliveryId())
+	old, err := listFiles(ctx, driveSrv, query)
+	if err != nil {
+		return "", err
+	}
+	if err := trash(ctx, driveSrv, old); err != nil {
+		return "", err
+	}
+
+	rc, err := driveSrv.Files.Create(&drive.File{
+		MimeType:      "application/vnd.google-apps.folder",
+		Name:          j.DeliveryId(),
+		Parents:       []string{parentId},
+		AppProperties: appProperties(j, roleOriginals),
+	}).Fields("id").Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return rc.Id, nil
+}
+
+// UploadOriginals uploads the originals of the job into a folder named after
+// the job. Pages which were already uploaded by an earlier attempt (and whose
+// contents match the local file) are skipped.
 func UploadOriginals(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
 	tr, _ := trace.FromContext(ctx)
 
-	dir := j.Id()
-
 	filenames, err := j.Filenames()
 	if err != nil {
 		return err
 	}
 
 	driveSrv := u.Drive
-	parentId, err := getCurrentParentDir(u)
+	originalsId, err := originalsFolder(ctx, u, j)
 	if err != nil {
 		return err
 	}
 
-	// Trash any folders which have the same name from earlier partial uploads.
-	query := fmt.Sprintf("'%s' in parents and name = '%s' and trashed=false", parentId, dir)
-	r, err := driveSrv.Files.List().Q(query).PageSize(1).Fields("files(id, name)").Do()
+	existing, err := listFiles(ctx, driveSrv, fmt.Sprintf("'%s' in parents", originalsId))
 	if err != nil {
 		return err
 	}
-
-	for _, file := range r.Files {
-		log.Printf("Trashing old folder %q\n", file.Id)
-		if _, err := driveSrv.Files.Update(file.Id, &drive.File{
-			Trashed: true,
-		}).Do(); err != nil {
-			return err
-		}
+	byName := make(map[string][]*drive.File)
+	for _, file := range existing {
+		byName[file.Name] = append(byName[file.Name], file)
 	}
 
-	rc, err := driveSrv.Files.Create(&drive.File{
-		MimeType: "application/vnd.google-apps.folder",
-		Name:     dir,
-		Parents:  []string{parentId},
-	}).Fields("id").Do()
-	if err != nil {
-		return err
-	}
-	originalsId := rc.Id
 	var eg errgroup.Group
 	for _, filename := range filenames {
 		filename := filename // copy
@@ -106,16 +357,30 @@ func UploadOriginals(ctx context.Context, u *user.Account, j *jobqueue.Job) erro
 		}
 
 		eg.Go(func() error {
-			f, err := os.Open(filename)
+			md5sum, err := fileMD5(filename)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-
-			ru, err := driveSrv.Files.Create(&drive.File{
-				Name:    name,
-				Parents: []string{originalsId},
-			}).Media(f, googleapi.ContentType("image/jpeg")).Do()
+			match, replace, dups := pick(byName[name], md5sum)
+			if err := trash(ctx, driveSrv, dups); err != nil {
+				return err
+			}
+			if match != nil {
+				tr.LazyPrintf("%q already uploaded to Google Drive as id %q", name, match.Id)
+				return nil
+			}
+			up := upload{
+				filename:    filename,
+				md5sum:      md5sum,
+				contentType: "image/jpeg",
+				metadata: &drive.File{
+					Name:          name,
+					Parents:       []string{originalsId},
+					AppProperties: appProperties(j, roleOriginal),
+				},
+				replace: replace,
+			}
+			ru, err := up.do(ctx, driveSrv)
 			if err != nil {
 				return err
 			}
@@ -126,15 +391,14 @@ func UploadOriginals(ctx context.Context, u *user.Account, j *jobqueue.Job) erro
 	return eg.Wait()
 }
 
+// UploadPDF uploads the converted PDF of the job and records its Google Drive
+// id in the job. If an earlier attempt already uploaded the PDF, the uploaded
+// file is re-used (or its contents are replaced, should they differ).
 func UploadPDF(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
 	tr, _ := trace.FromContext(ctx)
 
 	// TODO: make OcrLanguage configurable
 	driveSrv := u.Drive
-	parentId, err := getCurrentParentDir(u)
-	if err != nil {
-		return err
-	}
 
 	filenames, err := j.Filenames()
 	if err != nil {
@@ -145,26 +409,133 @@ func UploadPDF(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
 			continue
 		}
 
-		rd, err := os.Open(filename)
+		md5sum, err := fileMD5(filename)
 		if err != nil {
 			return err
 		}
-		defer rd.Close()
-
-		r, err := driveSrv.Files.Create(&drive.File{
-			Name:    j.Id() + ".pdf",
-			Parents: []string{parentId},
-		}).Media(rd, googleapi.ContentType("application/pdf")).OcrLanguage("de").Do()
+		existing, err := findTagged(ctx, driveSrv, j, rolePDF)
 		if err != nil {
 			return err
 		}
-		tr.LazyPrintf("Uploaded file to Google Drive as id %q", r.Id)
-
-		if err := j.WritePDFDriveID(r.Id); err != nil {
+		if len(existing) == 0 && j.PDFDriveId != "" {
+			// Versions of scan2drive which did not tag their uploads only
+			// recorded the id of the uploaded file.
+			r, err := driveSrv.Files.Get(j.PDFDriveId).Fields(fileFields + ", trashed").Context(ctx).Do()
+			if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+				// The file was deleted, upload the PDF anew.
+			} else if err != nil {
+				return err
+			} else if !r.Trashed {
+				existing = append(existing, r)
+			}
+		}
+		match, replace, dups := pick(existing, md5sum)
+		if err := trash(ctx, driveSrv, dups); err != nil {
 			return err
 		}
+		r := match
+		if r != nil {
+			tr.LazyPrintf("PDF already uploaded to Google Drive as id %q", r.Id)
+		} else {
+			up := upload{
+				filename:    filename,
+				md5sum:      md5sum,
+				contentType: "application/pdf",
+				ocrLanguage: "de",
+				metadata: &drive.File{
+					Name:          j.DeliveryId() + ".pdf",
+					AppProperties: appProperties(j, rolePDF),
+				},
+				replace: replace,
+			}
+			if replace == nil {
+				parentId, err := getCurrentParentDir(u)
+				if err != nil {
+					return err
+				}
+				up.metadata.Parents = []string{parentId}
+			}
+			r, err = up.do(ctx, driveSrv)
+			if err != nil {
+				return err
+			}
+			tr.LazyPrintf("Uploaded file to Google Drive as id %q", r.Id)
+		}
+
+		if r.Id != j.PDFDriveId {
+			if err := j.WritePDFDriveID(r.Id); err != nil {
+				return err
+			}
+		}
 
 		break
 	}
 	return nil
 }
+
+// TrashOriginals moves the folder(s) into which the originals of the job were
+// uploaded into the trash.
+func TrashOriginals(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+	driveSrv := u.Drive
+	folders, err := findTagged(ctx, driveSrv, j, roleOriginals)
+	if err != nil {
+		return err
+	}
+	// Versions of scan2drive which did not tag their uploads created the
+	// folder under the same name, in the folder of the year of the upload
+	// (see getCurrentParentDir). Folders of the same name elsewhere in Google
+	// Drive are none of scan2drive’s business.
+	query := fmt.Sprintf("'%s' in parents and mimeType = 'application/vnd.google-apps.folder'", u.Folder().Id)
+	years, err := listFiles(ctx, driveSrv, query)
+	if err != nil {
+		return err
+	}
+	var parents []string
+	for _, year := range years {
+		parents = append(parents, fmt.Sprintf("'%s' in parents", year.Id))
+	}
+	if len(parents) == 0 {
+		return trash(ctx, driveSrv, folders)
+	}
+	query = fmt.Sprintf("name = '%s' and mimeType = 'application/vnd.google-apps.folder' and (%s)", j.DeliveryId(), strings.Join(parents, " or "))
+	untagged, err := listFiles(ctx, driveSrv, query)
+	if err != nil {
+		return err
+	}
+	return trash(ctx, driveSrv, union(folders, untagged))
+}
+
+// TrashPDF moves the PDF which was uploaded for the job into the trash.
+func TrashPDF(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+	driveSrv := u.Drive
+	files, err := findTagged(ctx, driveSrv, j, rolePDF)
+	if err != nil {
+		return err
+	}
+	if j.PDFDriveId != "" {
+		r, err := driveSrv.Files.Get(j.PDFDriveId).Fields(fileFields + ", trashed").Context(ctx).Do()
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+			// Already deleted.
+		} else if err != nil {
+			return err
+		} else if !r.Trashed {
+			files = union(files, []*drive.File{r})
+		}
+	}
+	return trash(ctx, driveSrv, files)
+}
+
+// union returns the files of a and b, skipping files of b with the same id as
+// a file of a.
+func union(a, b []*drive.File) []*drive.File {
+	ids := make(map[string]bool)
+	for _, file := range a {
+		ids[file.Id] = true
+	}
+	for _, file := range b {
+		if !ids[file.Id] {
+			a = append(a, file)
+		}
+	}
+	return a
+}
@@ -0,0 +1,375 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drivesink_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/sink/drivesink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+type fakeFile struct {
+	drive.File
+	content []byte
+}
+
+// fakeDrive implements the subset of the Google Drive API which drivesink
+// uses, including just enough of the query language.
+type fakeDrive struct {
+	mu      sync.Mutex
+	files   map[string]*fakeFile
+	nextId  int
+	uploads map[string]int // by file name
+
+	// corrupt lists file names whose next upload is stored corrupted.
+	corrupt map[string]bool
+}
+
+var (
+	propRe   = regexp.MustCompile(`appProperties has \{ key='([^']*)' and value='([^']*)' \}`)
+	parentRe = regexp.MustCompile(`'([^']*)' in parents`)
+	nameRe   = regexp.MustCompile(`name = '([^']*)'`)
+	mimeRe   = regexp.MustCompile(`mimeType = '([^']*)'`)
+)
+
+func (d *fakeDrive) matches(f *fakeFile, q string) bool {
+	if strings.Contains(q, "trashed=false") && f.Trashed {
+		return false
+	}
+	for _, m := range propRe.FindAllStringSubmatch(q, -1) {
+		if f.AppProperties[m[1]] != m[2] {
+			return false
+		}
+	}
+	// Multiple parents are only used in disjunctions.
+	if ms := parentRe.FindAllStringSubmatch(q, -1); ms != nil {
+		if len(f.Parents) == 0 || !slices.ContainsFunc(ms, func(m []string) bool {
+			return f.Parents[0] == m[1]
+		}) {
+			return false
+		}
+	}
+	if m := nameRe.FindStringSubmatch(q); m != nil && f.Name != m[1] {
+		return false
+	}
+	if m := mimeRe.FindStringSubmatch(q); m != nil && f.MimeType != m[1] {
+		return false
+	}
+	return true
+}
+
+// readBody returns the file metadata and (for uploads) media of r.
+func readBody(r *http.Request) (*drive.File, []byte, error) {
+	var meta drive.File
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if mediaType != "multipart/related" {
+		return &meta, nil, json.NewDecoder(r.Body).Decode(&meta)
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	p, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.NewDecoder(p).Decode(&meta); err != nil {
+		return nil, nil, err
+	}
+	p, err = mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	media, err := io.ReadAll(p)
+	return &meta, media, err
+}
+
+func (d *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/upload/drive/v3")
+	id := strings.TrimPrefix(path, "/files/")
+	var f *fakeFile
+	switch {
+	case r.Method == "GET" && path == "/files":
+		var list drive.FileList
+		for _, f := range d.files {
+			if d.matches(f, r.FormValue("q")) {
+				list.Files = append(list.Files, &f.File)
+			}
+		}
+		json.NewEncoder(w).Encode(&list)
+		return
+
+	case r.Method == "GET":
+		f = d.files[id]
+		if f == nil {
+			http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+			return
+		}
+
+	case r.Method == "POST" && path == "/files":
+		meta, media, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.nextId++
+		f = &fakeFile{File: *meta}
+		f.Id = fmt.Sprintf("id%d", d.nextId)
+		d.files[f.Id] = f
+		if media != nil {
+			d.store(f, media)
+		}
+
+	case r.Method == "PATCH":
+		f = d.files[id]
+		meta, media, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if meta.Trashed {
+			f.Trashed = true
+		}
+		if meta.AppProperties != nil {
+			f.AppProperties = meta.AppProperties
+		}
+		if media != nil {
+			d.store(f, media)
+		}
+
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	json.NewEncoder(w).Encode(&f.File)
+}
+
+func (d *fakeDrive) store(f *fakeFile, media []byte) {
+	d.uploads[f.Name]++
+	if d.corrupt[f.Name] {
+		delete(d.corrupt, f.Name)
+		media = media[:len(media)/2]
+	}
+	f.content = media
+	h := md5.Sum(media)
+	f.Md5Checksum = hex.EncodeToString(h[:])
+}
+
+// live returns the names of all non-trashed files.
+func (d *fakeDrive) live() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make(map[string]int)
+	for _, f := range d.files {
+		if !f.Trashed {
+			names[f.Name]++
+		}
+	}
+	return names
+}
+
+func setup(t *testing.T) (*fakeDrive, *user.Account, *jobqueue.Job) {
+	d := &fakeDrive{
+		files:   make(map[string]*fakeFile),
+		uploads: make(map[string]int),
+		corrupt: make(map[string]bool),
+	}
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	for fn, content := range map[string]string{
+		"token.json":        "{}",
+		"drive_folder.json": `{"Id": "root"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := user.LoadFromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Drive, err = drive.NewService(context.Background(),
+		option.WithEndpoint(srv.URL+"/"),
+		option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	j, err := q.AddJob([]*page.Any{
+		page.JPEGPageFromBytes([]byte("first page")),
+		page.JPEGPageFromBytes([]byte("second page")),
+		page.JPEGPageFromBytes([]byte("third page")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AddDerivedFile("scan.pdf", []byte("%PDF-1.4 first version")); err != nil {
+		t.Fatal(err)
+	}
+	return d, u, j
+}
+
+func testContext(t *testing.T) context.Context {
+	tr := trace.New("test", t.Name())
+	t.Cleanup(tr.Finish)
+	return trace.NewContext(context.Background(), tr)
+}
+
+func TestUploadPDFIdempotent(t *testing.T) {
+	d, u, j := setup(t)
+	ctx := testContext(t)
+	pdfName := j.Id() + ".pdf"
+
+	if err := drivesink.UploadPDF(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	id := j.PDFDriveId
+	if id == "" {
+		t.Fatalf("PDF Drive id not recorded")
+	}
+
+	// A retry (e.g. after a crash before the marker was committed) re-uses
+	// the uploaded file.
+	if err := drivesink.UploadPDF(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.uploads[pdfName], 1; got != want {
+		t.Errorf("unexpected number of PDF uploads: got %d, want %d", got, want)
+	}
+
+	// Changed contents replace the contents of the uploaded file.
+	if err := j.AddDerivedFile("scan.pdf", []byte("%PDF-1.4 second version")); err != nil {
+		t.Fatal(err)
+	}
+	if err := drivesink.UploadPDF(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := j.PDFDriveId, id; got != want {
+		t.Errorf("unexpected PDF Drive id: got %q, want %q", got, want)
+	}
+	if got, want := string(d.files[id].content), "%PDF-1.4 second version"; got != want {
+		t.Errorf("unexpected PDF contents in Drive: got %q, want %q", got, want)
+	}
+	if got, want := d.live()[pdfName], 1; got != want {
+		t.Errorf("unexpected number of PDFs in Drive: got %d, want %d", got, want)
+	}
+}
+
+func TestUploadOriginalsResume(t *testing.T) {
+	d, u, j := setup(t)
+	ctx := testContext(t)
+
+	d.corrupt["page2.jpg"] = true
+	if err := drivesink.UploadOriginals(ctx, u, j); err == nil {
+		t.Fatalf("UploadOriginals unexpectedly succeeded despite corrupted upload")
+	}
+
+	if err := drivesink.UploadOriginals(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{
+		"page1.jpg": 1,
+		"page2.jpg": 2, // corrupted, then replaced
+		"page3.jpg": 1,
+	} {
+		if got := d.uploads[name]; got != want {
+			t.Errorf("unexpected number of uploads of %s: got %d, want %d", name, got, want)
+		}
+	}
+	live := d.live()
+	for _, name := range []string{j.Id(), "page1.jpg", "page2.jpg", "page3.jpg"} {
+		if got, want := live[name], 1; got != want {
+			t.Errorf("unexpected number of %q in Drive: got %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	d, u, j := setup(t)
+	ctx := testContext(t)
+
+	if err := drivesink.UploadOriginals(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	if err := drivesink.UploadPDF(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	if err := drivesink.TrashOriginals(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	if err := drivesink.TrashPDF(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	live := d.live()
+	for _, name := range []string{j.Id(), j.Id() + ".pdf"} {
+		if live[name] > 0 {
+			t.Errorf("%q not trashed", name)
+		}
+	}
+}
+
+func TestTrashUntagged(t *testing.T) {
+	d, u, j := setup(t)
+	ctx := testContext(t)
+
+	// Versions of scan2drive which did not tag their uploads created the
+	// originals folder within the folder of the year, but a folder of the
+	// same name elsewhere in Google Drive belongs to somebody else.
+	folder := "application/vnd.google-apps.folder"
+	for id, f := range map[string]drive.File{
+		"year":      {Name: "2016", MimeType: folder, Parents: []string{"root"}},
+		"legacy":    {Name: j.Id(), MimeType: folder, Parents: []string{"year"}},
+		"unrelated": {Name: j.Id(), MimeType: folder, Parents: []string{"elsewhere"}},
+	} {
+		f.Id = id
+		d.files[id] = &fakeFile{File: f}
+	}
+	if err := drivesink.TrashOriginals(ctx, u, j); err != nil {
+		t.Fatal(err)
+	}
+	if !d.files["legacy"].Trashed {
+		t.Errorf("untagged originals folder not trashed")
+	}
+	if d.files["unrelated"].Trashed {
+		t.Errorf("folder outside of the scan2drive folder unexpectedly trashed")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package execsink implements a sink which runs an external program for each
+// job, for integrations which do not warrant a sink implementation in Go.
+//
+// # Contract
+//
+// The program is started with the job directory as working directory and
+// receives the following environment variables (in addition to the
+// environment of scan2drive):
+//
+//	SCAN2DRIVE_SINK_ID   id of the sink, as configured in sinks.json
+//	SCAN2DRIVE_USER      sub of the user who owns the job
+//	SCAN2DRIVE_JOB_ID    id of the job, e.g. 2021-11-14T09-21-53.000Z-1a2b3c4d
+//	SCAN2DRIVE_JOB_DIR   absolute path of the job directory
+//	SCAN2DRIVE_ATTEMPT   1 for the first attempt, incremented on retries
+//
+// On stdin, the program receives a JSON document (see Request) which contains
+// the same information plus the list of files the sink is configured to
+// deliver.
+//
+// Exit status 0 means the job was delivered. Any other exit status (or
+// exceeding the timeout) means the delivery failed and will be retried later,
+// so programs need to tolerate being run more than once for the same job.
+//
+// The exit status and stderr output of the most recent attempt are recorded in
+// sink-<id>.exec.json in the job directory.
+package execsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Config is the type-specific configuration of an exec sink in sinks.json.
+type Config struct {
+	// Command is the program and its arguments, e.g.
+	// ["/perm/bin/archive-scan", "--verbose"]
+	Command []string `json:"command"`
+
+	// Timeout is a time.ParseDuration string and defaults to 10m.
+	Timeout string `json:"timeout"`
+
+	// Originals, PDF and Thumbnail select which files are passed to the
+	// program. PDF defaults to true.
+	Originals bool  `json:"originals"`
+	PDF       *bool `json:"pdf"`
+	Thumbnail bool  `json:"thumbnail"`
+}
+
+// Request is the JSON document the program receives on stdin.
+type Request struct {
+	Version int      `json:"version"` // currently 1
+	SinkId  string   `json:"sink_id"`
+	User    string   `json:"user"`
+	JobId   string   `json:"job_id"`
+	JobDir  string   `json:"job_dir"`
+	Source  string   `json:"source,omitempty"`
+	Attempt int      `json:"attempt"`
+	Files   []string `json:"files"` // absolute paths
+}
+
+// Status is recorded in sink-<id>.exec.json in the job directory.
+type Status struct {
+	Attempts int       `json:"attempts"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	ExitCode int       `json:"exit_code"` // -1 if the program was killed
+	Error    string    `json:"error,omitempty"`
+	Stderr   string    `json:"stderr"`
+}
+
+// maxStderr bounds how much stderr output is recorded.
+const maxStderr = 64 * 1024
+
+func init() {
+	sink.Register("exec", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var c Config
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		return New(cfg.Id, u.Sub, c)
+	})
+}
+
+// Sink implements scan2drive.Sink.
+type Sink struct {
+	id      string
+	user    string
+	cfg     Config
+	needs   scan2drive.SinkNeeds
+	timeout time.Duration
+}
+
+// New returns an exec sink with the specified id, as used for its completion
+// marker.
+func New(id, userSub string, cfg Config) (*Sink, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("command not configured")
+	}
+	if !filepath.IsAbs(cfg.Command[0]) {
+		return nil, fmt.Errorf("command %q is not an absolute path", cfg.Command[0])
+	}
+	timeout := 10 * time.Minute
+	if cfg.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Sink{
+		id:   id,
+		user: userSub,
+		cfg:  cfg,
+		needs: scan2drive.SinkNeeds{
+			Originals: cfg.Originals,
+			PDF:       cfg.PDF == nil || *cfg.PDF,
+			Thumbnail: cfg.Thumbnail,
+		},
+		timeout: timeout,
+	}, nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *Sink) Needs() scan2drive.SinkNeeds { return s.needs }
+
+func (s *Sink) statusFilename() string {
+	return "sink-" + s.id + ".exec.json"
+}
+
+// boundedBuffer retains the first max bytes written to it.
+type boundedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.buf.Write(p[:remaining])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	var status Status
+	if b, err := j.ReadDerivedFile(s.statusFilename()); err == nil {
+		if err := json.Unmarshal(b, &status); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	status.Attempts++
+
+	filenames, err := j.Filenames()
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(j.Dir())
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, filename := range filenames {
+		switch name := filepath.Base(filename); {
+		case name == "scan.pdf" && s.needs.PDF,
+			name == "thumb.png" && s.needs.Thumbnail,
+			filepath.Ext(name) == ".jpg" && s.needs.Originals:
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	req := Request{
+		Version: 1,
+		SinkId:  s.id,
+		User:    s.user,
+		JobId:   j.DeliveryId(),
+		JobDir:  dir,
+		Source:  j.Source,
+		Attempt: status.Attempts,
+		Files:   files,
+	}
+	stdin, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	ctx, canc := context.WithTimeout(ctx, s.timeout)
+	defer canc()
+	cmd := exec.CommandContext(ctx, s.cfg.Command[0], s.cfg.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"SCAN2DRIVE_SINK_ID="+s.id,
+		"SCAN2DRIVE_USER="+s.user,
+		"SCAN2DRIVE_JOB_ID="+j.DeliveryId(),
+		"SCAN2DRIVE_JOB_DIR="+dir,
+		"SCAN2DRIVE_ATTEMPT="+strconv.Itoa(status.Attempts))
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	stderr := &boundedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	// Do not wait forever for grandchildren which keep stderr open after the
+	// program was killed.
+	cmd.WaitDelay = 5 * time.Second
+
+	status.Started = time.Now()
+	tr.LazyPrintf("running %q (attempt %d)", cmd.Args, status.Attempts)
+	runErr := cmd.Run()
+	status.Duration = time.Since(status.Started).String()
+	status.ExitCode = cmd.ProcessState.ExitCode()
+	status.Stderr = stderr.buf.String()
+	status.Error = ""
+	if runErr != nil {
+		status.Error = runErr.Error()
+		if ctx.Err() == context.DeadlineExceeded {
+			status.Error = fmt.Sprintf("timeout (%v) exceeded: %v", s.timeout, runErr)
+		}
+	}
+	b, err := json.MarshalIndent(&status, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := j.AddDerivedFile(s.statusFilename(), b); err != nil {
+		return err
+	}
+	if runErr != nil {
+		return fmt.Errorf("%v: %s (stderr: %q)", cmd.Args, status.Error, lastLine(status.Stderr))
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of s, which usually contains the
+// most relevant error message.
+func lastLine(s string) string {
+	lines := bytes.Split(bytes.TrimSpace([]byte(s)), []byte("\n"))
+	return string(lines[len(lines)-1])
+}
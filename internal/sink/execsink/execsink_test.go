@@ -0,0 +1,145 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execsink_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/sink/execsink"
+	"golang.org/x/net/trace"
+)
+
+// script fails on the first attempt and copies its stdin to request.json on
+// the second attempt.
+const script = `#!/bin/sh
+set -e
+if [ "$SCAN2DRIVE_ATTEMPT" = "1" ]; then
+	echo "archive unreachable" >&2
+	exit 3
+fi
+cat > "$OUT/request.json"
+echo "$SCAN2DRIVE_USER $SCAN2DRIVE_JOB_ID" > "$OUT/env"
+`
+
+func TestDeliver(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+	out := t.TempDir()
+	t.Setenv("OUT", out)
+	prog := filepath.Join(out, "archive.sh")
+	if err := os.WriteFile(prog, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes([]byte("page one"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := execsink.New("archive", "michael", execsink.Config{
+		Command: []string{prog},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+
+	readStatus := func() execsink.Status {
+		t.Helper()
+		b, err := job.ReadDerivedFile("sink-archive.exec.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status execsink.Status
+		if err := json.Unmarshal(b, &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if err := s.Deliver(ctx, job); err == nil || !strings.Contains(err.Error(), "archive unreachable") {
+		t.Fatalf("Deliver: got err %v, want archive unreachable error", err)
+	}
+	if got := readStatus(); got.ExitCode != 3 || got.Attempts != 1 || got.Stderr != "archive unreachable\n" {
+		t.Errorf("unexpected status after first attempt: %+v", got)
+	}
+
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStatus(); got.ExitCode != 0 || got.Attempts != 2 || got.Error != "" {
+		t.Errorf("unexpected status after second attempt: %+v", got)
+	}
+
+	b, err := os.ReadFile(filepath.Join(out, "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req execsink.Request
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.Files, []string{filepath.Join(req.JobDir, "scan.pdf")}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("unexpected files: got %q, want %q", got, want)
+	}
+	if req.Version != 1 || req.JobId != job.Id() || req.Attempt != 2 {
+		t.Errorf("unexpected request: %+v", req)
+	}
+	env, err := os.ReadFile(filepath.Join(out, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(env), "michael "+job.Id()+"\n"; got != want {
+		t.Errorf("unexpected environment: got %q, want %q", got, want)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := execsink.New("slow", "michael", execsink.Config{
+		Command: []string{"/bin/sleep", "10"},
+		Timeout: "50ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("/bin/sleep"); err != nil {
+		t.Skip("/bin/sleep not available")
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+	if err := s.Deliver(ctx, job); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Deliver: got err %v, want timeout error", err)
+	}
+}
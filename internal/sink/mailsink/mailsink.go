@@ -0,0 +1,540 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mailsink implements a sink to send scans by email via SMTP.
+//
+// Scans whose PDF exceeds the configured size limit are either split into
+// multiple mails (each containing a PDF of a range of pages) or replaced by a
+// link, e.g. to a copy stored by another sink.
+package mailsink
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/legacyconvert"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/pipeline"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Config is the type-specific configuration of a mail sink in sinks.json.
+type Config struct {
+	// Server is the host:port of the SMTP server, e.g. smtp.example.net:587
+	Server string `json:"server"`
+
+	// TLS is one of starttls (default), tls (implicit TLS, usually port 465)
+	// or none.
+	TLS string `json:"tls"`
+
+	From string   `json:"from"`
+	To   []string `json:"to"`
+
+	// ProfileTo maps processing profile names to the recipients of jobs
+	// processed with that profile, overriding To.
+	ProfileTo map[string][]string `json:"profile_to"`
+
+	// Thumbnail enables displaying the thumbnail of the first page inline.
+	Thumbnail bool `json:"thumbnail"`
+
+	// MaxSize is the maximum PDF size in bytes per mail and defaults to 10 MiB.
+	// Keep in mind that base64 encoding adds a third on top.
+	MaxSize int `json:"max_size"`
+
+	// Oversize is one of split (default) or link and determines how scans
+	// exceeding MaxSize are sent.
+	Oversize string `json:"oversize"`
+
+	// LinkURL is the link sent instead of the PDF with Oversize link. The
+	// placeholders {job}, {year}, {month} and {drive_id} are replaced, e.g.
+	// https://drive.google.com/file/d/{drive_id}/view
+	LinkURL string `json:"link_url"`
+}
+
+// Credentials are optionally read from sink-<id>.json in the user’s state
+// directory.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func init() {
+	sink.Register("mail", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var c Config
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		var creds Credentials
+		if err := sink.ReadCredentials(u, cfg.Id, &creds); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		s, err := New(cfg.Id, c, creds)
+		if err != nil {
+			return nil, err
+		}
+		s.PDF = func(ctx context.Context, j *jobqueue.Job, nums []int) ([]byte, error) {
+			return pipeline.PDF(ctx, u, j, nums)
+		}
+		return s, nil
+	})
+}
+
+// Sink implements scan2drive.Sink.
+type Sink struct {
+	id    string
+	cfg   Config
+	creds Credentials
+	host  string
+
+	// TLSConfig is used for STARTTLS and implicit TLS. If nil, the server
+	// certificate is verified against the host name of Config.Server.
+	TLSConfig *tls.Config
+
+	// PDF returns a PDF of the original pages nums (starting at 1) of the
+	// job, converted like scan.pdf, for splitting scans which exceed MaxSize.
+	// If nil, the pages are converted using the default settings.
+	PDF func(ctx context.Context, j *jobqueue.Job, nums []int) ([]byte, error)
+}
+
+// New returns a mail sink with the specified id, as used for its completion
+// marker.
+func New(id string, cfg Config, creds Credentials) (*Sink, error) {
+	host, _, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("server %q: %v", cfg.Server, err)
+	}
+	switch cfg.TLS {
+	case "":
+		cfg.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("tls %q: must be starttls, tls or none", cfg.TLS)
+	}
+	switch cfg.Oversize {
+	case "":
+		cfg.Oversize = "split"
+	case "split":
+	case "link":
+		if cfg.LinkURL == "" {
+			return nil, fmt.Errorf("oversize link requires link_url")
+		}
+	default:
+		return nil, fmt.Errorf("oversize %q: must be split or link", cfg.Oversize)
+	}
+	if cfg.From == "" {
+		return nil, fmt.Errorf("from not configured")
+	}
+	if len(cfg.To) == 0 {
+		return nil, fmt.Errorf("to not configured")
+	}
+	for profile, to := range cfg.ProfileTo {
+		if len(to) == 0 {
+			return nil, fmt.Errorf("profile_to: no recipients configured for profile %q", profile)
+		}
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 10 * 1024 * 1024
+	}
+	return &Sink{
+		id:    id,
+		cfg:   cfg,
+		creds: creds,
+		host:  host,
+	}, nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *Sink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{
+		PDF:       true,
+		Thumbnail: s.cfg.Thumbnail,
+	}
+}
+
+// state is persisted in sink-<id>.mail.json in the job directory so that
+// retries do not send parts of a split scan twice.
+type state struct {
+	// PDF is the SHA-256 checksum of the scan.pdf whose parts were sent: a
+	// reprocessed scan is sent again.
+	PDF   string `json:"pdf"`
+	Parts int    `json:"parts"`
+	Sent  []int  `json:"sent"`
+}
+
+func (s *Sink) stateFilename() string {
+	return "sink-" + s.id + ".mail.json"
+}
+
+// part is the content of one mail.
+type part struct {
+	pdf  []byte
+	link string
+}
+
+// pdf returns a PDF of the original pages nums (starting at 1) of j.
+func (s *Sink) pdf(ctx context.Context, j *jobqueue.Job, nums []int) ([]byte, error) {
+	if s.PDF != nil {
+		return s.PDF(ctx, j, nums)
+	}
+	tr, _ := trace.FromContext(ctx)
+	pages := j.Pages()
+	subset := make([]*page.Any, len(nums))
+	for idx, num := range nums {
+		subset[idx] = pages[num-1]
+	}
+	pdf, _, err := legacyconvert.ConvertLogic(tr, subset, legacyconvert.Options{})
+	return pdf, err
+}
+
+// split returns PDFs of consecutive page ranges, using as few parts as
+// possible while staying within MaxSize. Conversion is deterministic, so a
+// retry results in the same parts.
+func (s *Sink) split(ctx context.Context, j *jobqueue.Job, size int) ([]part, error) {
+	pages := len(j.Pages())
+	for n := (size + s.cfg.MaxSize - 1) / s.cfg.MaxSize; n <= pages; n++ {
+		perPart := (pages + n - 1) / n
+		var parts []part
+		fits := true
+		for start := 1; start <= pages; start += perPart {
+			var nums []int
+			for num := start; num < min(start+perPart, pages+1); num++ {
+				nums = append(nums, num)
+			}
+			pdf, err := s.pdf(ctx, j, nums)
+			if err != nil {
+				return nil, err
+			}
+			if len(pdf) > s.cfg.MaxSize {
+				fits = false
+				break
+			}
+			parts = append(parts, part{pdf: pdf})
+		}
+		if fits {
+			return parts, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot split scan into parts of at most %d bytes", s.cfg.MaxSize)
+}
+
+func (s *Sink) link(j *jobqueue.Job) (string, error) {
+	if strings.Contains(s.cfg.LinkURL, "{drive_id}") && j.PDFDriveId == "" {
+		return "", fmt.Errorf("link_url refers to {drive_id}, but scan was not uploaded to Google Drive (yet)")
+	}
+	created := j.Created()
+	return strings.NewReplacer(
+		"{job}", j.DeliveryId(),
+		"{year}", fmt.Sprintf("%d", created.Year()),
+		"{month}", fmt.Sprintf("%02d", created.Month()),
+		"{drive_id}", j.PDFDriveId,
+	).Replace(s.cfg.LinkURL), nil
+}
+
+// recipients returns the recipients for jobs of the profile of j.
+func (s *Sink) recipients(j *jobqueue.Job) []string {
+	if to, ok := s.cfg.ProfileTo[j.Profile]; ok {
+		return to
+	}
+	return s.cfg.To
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	pdf, err := os.ReadFile(filepath.Join(j.Dir(), "scan.pdf"))
+	if err != nil {
+		return err
+	}
+	var thumb []byte
+	if s.cfg.Thumbnail {
+		thumb, err = os.ReadFile(filepath.Join(j.Dir(), "thumb.png"))
+		if err != nil && !os.IsNotExist(err) { // all pages blank
+			return err
+		}
+	}
+
+	parts := []part{{pdf: pdf}}
+	if len(pdf) > s.cfg.MaxSize {
+		tr.LazyPrintf("PDF size %d exceeds max_size %d, oversize = %s", len(pdf), s.cfg.MaxSize, s.cfg.Oversize)
+		if s.cfg.Oversize == "split" {
+			parts, err = s.split(ctx, j, len(pdf))
+		} else {
+			var link string
+			link, err = s.link(j)
+			parts = []part{{link: link}}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var st state
+	if b, err := j.ReadDerivedFile(s.stateFilename()); err == nil {
+		if err := json.Unmarshal(b, &st); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	sum := sha256.Sum256(pdf)
+	if checksum := hex.EncodeToString(sum[:]); st.PDF != checksum || st.Parts != len(parts) {
+		st = state{PDF: checksum, Parts: len(parts)}
+	}
+
+	title := j.DeliveryId()
+	if j.NewName != "" {
+		title = j.NewName
+	}
+	for idx, p := range parts {
+		if slices.Contains(st.Sent, idx) {
+			tr.LazyPrintf("part %d/%d already sent, skipping", idx+1, len(parts))
+			continue
+		}
+		subject := "Scan " + title
+		if len(parts) > 1 {
+			subject += fmt.Sprintf(" (part %d/%d)", idx+1, len(parts))
+		}
+		msg, err := s.message(j, st.PDF, idx, len(parts), subject, p, thumb)
+		if err != nil {
+			return err
+		}
+		if err := s.send(ctx, s.recipients(j), msg); err != nil {
+			return err
+		}
+		tr.LazyPrintf("Sent %q (%d bytes) to %q", subject, len(msg), s.recipients(j))
+		st.Sent = append(st.Sent, idx)
+		b, err := json.Marshal(&st)
+		if err != nil {
+			return err
+		}
+		if err := j.AddDerivedFile(s.stateFilename(), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// base64Lines wraps base64-encoded data at 76 characters per line, as
+// required by RFC 2045.
+type base64Lines struct {
+	w   *bytes.Buffer
+	col int
+}
+
+func (l *base64Lines) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if l.col == 76 {
+			l.w.WriteString("\r\n")
+			l.col = 0
+		}
+		l.w.WriteByte(c)
+		l.col++
+	}
+	return len(p), nil
+}
+
+func writeBase64(mw *multipart.Writer, hdr textproto.MIMEHeader, content []byte) error {
+	hdr.Set("Content-Transfer-Encoding", "base64")
+	pw, err := mw.CreatePart(hdr)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &base64Lines{w: &buf})
+	enc.Write(content)
+	enc.Close()
+	buf.WriteString("\r\n")
+	_, err = pw.Write(buf.Bytes())
+	return err
+}
+
+// message returns the RFC 5322 message for the specified part. The Message-ID
+// is derived from the job and the checksum of its PDF (see state), so that mail
+// clients can detect duplicates resulting from a retry after a lost SMTP
+// response, but do not discard the mails of a reprocessed scan.
+func (s *Sink) message(j *jobqueue.Job, checksum string, idx, numParts int, subject string, p part, thumb []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "scan2drive"
+	}
+	msgId := fmt.Sprintf("<%s.%s.%d.%s@%s>",
+		strings.NewReplacer(":", "", "+", "").Replace(j.DeliveryId()), checksum[:12], idx, s.id, hostname)
+	hdr := []string{
+		"From: " + s.cfg.From,
+		"To: " + strings.Join(s.recipients(j), ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + msgId,
+		"MIME-Version: 1.0",
+	}
+
+	mw := multipart.NewWriter(&buf)
+	for _, h := range hdr {
+		buf.WriteString(h + "\r\n")
+	}
+	buf.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+
+	text := "Scan " + j.DeliveryId() + " is attached."
+	if p.link != "" {
+		text = "Scan " + j.DeliveryId() + " is too large to be attached, find it at " + p.link
+	}
+
+	if thumb != nil {
+		var related bytes.Buffer
+		rw := multipart.NewWriter(&related)
+		htmlText := html.EscapeString(text)
+		if p.link != "" {
+			htmlText = fmt.Sprintf(`Scan %s is too large to be attached, find it at <a href="%s">%s</a>`,
+				html.EscapeString(j.DeliveryId()), html.EscapeString(p.link), html.EscapeString(p.link))
+		}
+		hw, err := rw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"text/html; charset=utf-8"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hw, "<p>%s</p>\r\n<p><img src=\"cid:thumb.png\" alt=\"first page\"></p>\r\n", htmlText)
+		if err := writeBase64(rw, textproto.MIMEHeader{
+			"Content-Type":        {"image/png"},
+			"Content-ID":          {"<thumb.png>"},
+			"Content-Disposition": {`inline; filename="thumb.png"`},
+		}, thumb); err != nil {
+			return nil, err
+		}
+		if err := rw.Close(); err != nil {
+			return nil, err
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/related; boundary=" + rw.Boundary()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(related.Bytes()); err != nil {
+			return nil, err
+		}
+	} else {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"text/plain; charset=utf-8"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(pw, "%s\r\n", text)
+	}
+
+	if p.pdf != nil {
+		name := j.DeliveryId() + ".pdf"
+		if numParts > 1 {
+			name = fmt.Sprintf("%s-part%d.pdf", j.DeliveryId(), idx+1)
+		}
+		if err := writeBase64(mw, textproto.MIMEHeader{
+			"Content-Type":        {"application/pdf"},
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		}, p.pdf); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Sink) send(ctx context.Context, to []string, msg []byte) error {
+	tlsConfig := s.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: s.host}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.cfg.Server)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	}
+	if s.cfg.TLS == "tls" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if s.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", s.cfg.Server)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.creds.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.creds.Username, s.creds.Password, s.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,418 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailsink_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/legacyconvert"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/sink/mailsink"
+	"golang.org/x/net/trace"
+)
+
+// fakeSMTP is a minimal SMTP server which requires AUTH PLAIN and records all
+// messages it accepts.
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu         sync.Mutex
+	messages   [][]byte
+	rcpts      [][]string
+	numData    int
+	rejectData int // reject the DATA command with this (1-based) number
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeSMTP{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost fake ESMTP")
+	var (
+		authenticated bool
+		rcpts         []string
+	)
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tc.PrintfLine("250-localhost")
+			tc.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			if arg != "PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00scanner\x00secret")) {
+				tc.PrintfLine("535 authentication failed")
+				continue
+			}
+			authenticated = true
+			tc.PrintfLine("235 ok")
+		case "MAIL":
+			if !authenticated {
+				tc.PrintfLine("530 authentication required")
+				continue
+			}
+			rcpts = nil
+			tc.PrintfLine("250 ok")
+		case "RCPT":
+			rcpts = append(rcpts, arg)
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			f.mu.Lock()
+			f.numData++
+			fail := f.numData == f.rejectData
+			f.mu.Unlock()
+			if fail {
+				tc.PrintfLine("451 try again later")
+				continue
+			}
+			tc.PrintfLine("354 go ahead")
+			b, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, b)
+			f.rcpts = append(f.rcpts, rcpts)
+			f.mu.Unlock()
+			tc.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tc.PrintfLine("250 ok")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// noisyPage returns a JPEG page which is not detected as blank.
+func noisyPage(t *testing.T, seed int) *page.Any {
+	img := image.NewGray(image.Rect(0, 0, 400, 560))
+	for y := 0; y < 560; y++ {
+		for x := 0; x < 400; x++ {
+			if (x*7+y*13+seed*31)%5 == 0 {
+				img.SetGray(x, y, color.Gray{0})
+			} else {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return page.JPEGPageFromBytes(buf.Bytes())
+}
+
+func newJob(t *testing.T, numPages int) (*jobqueue.Job, []byte) {
+	var pages []*page.Any
+	for i := 0; i < numPages; i++ {
+		pages = append(pages, noisyPage(t, i))
+	}
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob(pages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	pdf, thumb, err := legacyconvert.ConvertLogic(tr, job.Pages(), legacyconvert.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", pdf); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("thumb.png", thumb); err != nil {
+		t.Fatal(err)
+	}
+	return job, pdf
+}
+
+func testContext(t *testing.T) context.Context {
+	tr := trace.New("test", t.Name())
+	t.Cleanup(tr.Finish)
+	return trace.NewContext(context.Background(), tr)
+}
+
+// parts returns the content types and decoded bodies of all leaf parts of msg.
+func parts(t *testing.T, msg []byte) (*mail.Message, map[string][]byte) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string][]byte)
+	var walk func(contentType string, r io.Reader, encoding string)
+	walk = func(contentType string, r io.Reader, encoding string) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(r, params["boundary"])
+			for {
+				p, err := mr.NextRawPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				walk(p.Header.Get("Content-Type"), p, p.Header.Get("Content-Transfer-Encoding"))
+			}
+			return
+		}
+		if encoding == "base64" {
+			r = base64.NewDecoder(base64.StdEncoding, r)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[mediaType] = b
+	}
+	walk(m.Header.Get("Content-Type"), m.Body, "")
+	return m, result
+}
+
+func TestDeliver(t *testing.T) {
+	srv := newFakeSMTP(t)
+	job, pdf := newJob(t, 1)
+
+	s, err := mailsink.New("mail", mailsink.Config{
+		Server:    srv.ln.Addr().String(),
+		TLS:       "none",
+		From:      "scan2drive@example.net",
+		To:        []string{"michael@example.net", "archive@example.net"},
+		Thumbnail: true,
+	}, mailsink.Credentials{Username: "scanner", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(srv.messages), 1; got != want {
+		t.Fatalf("unexpected number of messages: got %d, want %d", got, want)
+	}
+	if got, want := len(srv.rcpts[0]), 2; got != want {
+		t.Errorf("unexpected number of recipients: got %d, want %d", got, want)
+	}
+	m, p := parts(t, srv.messages[0])
+	if got, want := m.Header.Get("Subject"), "Scan "+job.Id(); got != want {
+		t.Errorf("unexpected subject: got %q, want %q", got, want)
+	}
+	if !bytes.Equal(p["application/pdf"], pdf) {
+		t.Errorf("attached PDF differs from scan.pdf")
+	}
+	if _, ok := p["image/png"]; !ok {
+		t.Errorf("inline thumbnail missing")
+	}
+	if !bytes.Contains(p["text/html"], []byte("cid:thumb.png")) {
+		t.Errorf("HTML part does not reference the thumbnail: %q", p["text/html"])
+	}
+}
+
+func TestDeliverReprocessed(t *testing.T) {
+	srv := newFakeSMTP(t)
+	job, _ := newJob(t, 1)
+	s, err := mailsink.New("mail", mailsink.Config{
+		Server: srv.ln.Addr().String(),
+		TLS:    "none",
+		From:   "scan2drive@example.net",
+		To:     []string{"michael@example.net"},
+	}, mailsink.Credentials{Username: "scanner", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	// A reprocessed scan is sent again.
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0 reprocessed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(srv.messages), 2; got != want {
+		t.Fatalf("unexpected number of messages: got %d, want %d", got, want)
+	}
+	first, _ := parts(t, srv.messages[0])
+	second, p := parts(t, srv.messages[1])
+	if string(p["application/pdf"]) != "%PDF-1.0 reprocessed" {
+		t.Errorf("reprocessed PDF not sent")
+	}
+	// Mail clients would discard the mail as a duplicate otherwise.
+	if id := first.Header.Get("Message-ID"); id == second.Header.Get("Message-ID") {
+		t.Errorf("reprocessed PDF sent with the same Message-ID %q", id)
+	}
+}
+
+func TestDeliverSplit(t *testing.T) {
+	srv := newFakeSMTP(t)
+	// Reject the second part on the first attempt.
+	srv.rejectData = 2
+	job, pdf := newJob(t, 3)
+
+	s, err := mailsink.New("mail", mailsink.Config{
+		Server:  srv.ln.Addr().String(),
+		TLS:     "none",
+		From:    "scan2drive@example.net",
+		To:      []string{"michael@example.net"},
+		MaxSize: len(pdf) - 1,
+	}, mailsink.Credentials{Username: "scanner", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Parts are converted like scan.pdf (see pipeline.PDF).
+	var converted [][]int
+	s.PDF = func(ctx context.Context, j *jobqueue.Job, nums []int) ([]byte, error) {
+		converted = append(converted, nums)
+		tr, _ := trace.FromContext(ctx)
+		var pages []*page.Any
+		for _, num := range nums {
+			pages = append(pages, j.Pages()[num-1])
+		}
+		pdf, _, err := legacyconvert.ConvertLogic(tr, pages, legacyconvert.Options{})
+		return pdf, err
+	}
+	ctx := testContext(t)
+	if err := s.Deliver(ctx, job); err == nil {
+		t.Fatalf("Deliver unexpectedly succeeded")
+	}
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := converted[:2], [][]int{{1, 2}, {3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected pages of parts: got %v, want %v", got, want)
+	}
+
+	// The first part must not have been sent again.
+	if got, want := len(srv.messages), 2; got != want {
+		t.Fatalf("unexpected number of messages: got %d, want %d", got, want)
+	}
+	for idx, msg := range srv.messages {
+		m, p := parts(t, msg)
+		if got, want := m.Header.Get("Subject"), fmt.Sprintf("Scan %s (part %d/2)", job.Id(), idx+1); got != want {
+			t.Errorf("message %d: unexpected subject: got %q, want %q", idx, got, want)
+		}
+		if got := len(p["application/pdf"]); got == 0 || got > len(pdf)-1 {
+			t.Errorf("message %d: unexpected PDF size %d", idx, got)
+		}
+	}
+}
+
+func TestDeliverLink(t *testing.T) {
+	srv := newFakeSMTP(t)
+	job, _ := newJob(t, 1)
+	if err := job.WritePDFDriveID("abc123"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := mailsink.New("mail", mailsink.Config{
+		Server:   srv.ln.Addr().String(),
+		TLS:      "none",
+		From:     "scan2drive@example.net",
+		To:       []string{"michael@example.net"},
+		MaxSize:  1,
+		Oversize: "link",
+		LinkURL:  "https://drive.google.com/file/d/{drive_id}/view",
+	}, mailsink.Credentials{Username: "scanner", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(srv.messages), 1; got != want {
+		t.Fatalf("unexpected number of messages: got %d, want %d", got, want)
+	}
+	_, p := parts(t, srv.messages[0])
+	if _, ok := p["application/pdf"]; ok {
+		t.Errorf("oversized PDF unexpectedly attached")
+	}
+	if want := "https://drive.google.com/file/d/abc123/view"; !bytes.Contains(p["text/plain"], []byte(want)) {
+		t.Errorf("text part %q does not contain link %q", p["text/plain"], want)
+	}
+}
+
+func TestDeliverProfileRecipients(t *testing.T) {
+	srv := newFakeSMTP(t)
+	job, _ := newJob(t, 1)
+	if err := job.SetProfile("receipts"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := mailsink.New("mail", mailsink.Config{
+		Server: srv.ln.Addr().String(),
+		TLS:    "none",
+		From:   "scan2drive@example.net",
+		To:     []string{"michael@example.net"},
+		ProfileTo: map[string][]string{
+			"receipts": {"accounting@example.net"},
+		},
+	}, mailsink.Credentials{Username: "scanner", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(testContext(t), job); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(srv.rcpts), "[[TO:<accounting@example.net>]]"; got != want {
+		t.Errorf("unexpected recipients: got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package paperlesssink implements a sink to hand scans to Paperless-ngx via
+// its document consumption API.
+package paperlesssink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Config is the type-specific configuration of a paperless sink in sinks.json.
+type Config struct {
+	// URL is the base URL of the Paperless-ngx instance, e.g.
+	// https://paperless.lan
+	URL string `json:"url"`
+
+	// Tags contains the ids of tags to assign to each document.
+	Tags []int `json:"tags"`
+
+	// Correspondent is the id of the correspondent to assign, if non-zero.
+	Correspondent int `json:"correspondent"`
+
+	// PollTimeout is a time.ParseDuration string and defaults to 5m. If
+	// Paperless did not finish consuming the document within PollTimeout,
+	// polling resumes on the next attempt.
+	PollTimeout string `json:"poll_timeout"`
+}
+
+// Credentials are read from sink-<id>.json in the user’s state directory. Find
+// your token in the Paperless-ngx profile settings.
+type Credentials struct {
+	Token string `json:"token"`
+}
+
+func init() {
+	sink.Register("paperless", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var c Config
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		var creds Credentials
+		if err := sink.ReadCredentials(u, cfg.Id, &creds); err != nil {
+			return nil, err
+		}
+		return New(cfg.Id, c, creds)
+	})
+}
+
+// Sink implements scan2drive.Sink.
+type Sink struct {
+	id          string
+	cfg         Config
+	creds       Credentials
+	base        *url.URL
+	pollTimeout time.Duration
+
+	// Client is used for all requests and defaults to http.DefaultClient.
+	Client *http.Client
+
+	// PollInterval is the time between two task status requests.
+	PollInterval time.Duration
+}
+
+// New returns a paperless sink with the specified id, as used for its
+// completion marker.
+func New(id string, cfg Config, creds Credentials) (*Sink, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("url %q: scheme must be http or https", cfg.URL)
+	}
+	if creds.Token == "" {
+		return nil, fmt.Errorf("token not configured")
+	}
+	pollTimeout := 5 * time.Minute
+	if cfg.PollTimeout != "" {
+		pollTimeout, err = time.ParseDuration(cfg.PollTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Sink{
+		id:           id,
+		cfg:          cfg,
+		creds:        creds,
+		base:         base,
+		pollTimeout:  pollTimeout,
+		Client:       http.DefaultClient,
+		PollInterval: 2 * time.Second,
+	}, nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *Sink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{PDF: true}
+}
+
+// taskFilename stores the id of the consumption task in the job directory, so
+// that a retry resumes polling instead of uploading the document again.
+func (s *Sink) taskFilename() string {
+	return "sink-" + s.id + ".task_id"
+}
+
+// forgetTask removes the task id once the document was consumed, so that a
+// reprocessed scan is uploaded again. Should scan2drive crash before the
+// delivery is committed, Paperless reports the upload of the next attempt as
+// a duplicate.
+func (s *Sink) forgetTask(j *jobqueue.Job) error {
+	if err := os.Remove(filepath.Join(j.Dir(), s.taskFilename())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Sink) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("Authorization", "Token "+s.creds.Token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("%s %s: unexpected HTTP status: %v (body: %q)", req.Method, req.URL.Path, resp.Status, string(b))
+	}
+	return b, nil
+}
+
+func (s *Sink) postDocument(ctx context.Context, j *jobqueue.Job, filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	title := j.DeliveryId()
+	if j.NewName != "" {
+		title = j.NewName
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("document", j.DeliveryId()+".pdf")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(fw, f); err != nil {
+		return "", err
+	}
+	fields := [][2]string{
+		{"title", title},
+		{"created", j.Created().Format("2006-01-02")},
+	}
+	for _, tag := range s.cfg.Tags {
+		fields = append(fields, [2]string{"tags", strconv.Itoa(tag)})
+	}
+	if s.cfg.Correspondent != 0 {
+		fields = append(fields, [2]string{"correspondent", strconv.Itoa(s.cfg.Correspondent)})
+	}
+	for _, field := range fields {
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.base.String()+"/api/documents/post_document/", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	b, err := s.do(req)
+	if err != nil {
+		return "", err
+	}
+	// The response is the task id as a JSON string.
+	var taskId string
+	if err := json.Unmarshal(b, &taskId); err != nil {
+		return "", fmt.Errorf("unexpected post_document response %q: %v", string(b), err)
+	}
+	return taskId, nil
+}
+
+type task struct {
+	TaskId          string `json:"task_id"`
+	Status          string `json:"status"`
+	Result          string `json:"result"`
+	RelatedDocument string `json:"related_document"`
+}
+
+func (s *Sink) taskStatus(ctx context.Context, taskId string) (*task, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.base.String()+"/api/tasks/?task_id="+url.QueryEscape(taskId), nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []task
+	if err := json.Unmarshal(b, &tasks); err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		// Paperless might not have registered the task yet.
+		return &task{TaskId: taskId, Status: "PENDING"}, nil
+	}
+	return &tasks[0], nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	var taskId string
+	if b, err := j.ReadDerivedFile(s.taskFilename()); err == nil {
+		taskId = string(b)
+		tr.LazyPrintf("resuming to poll Paperless task %s", taskId)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if taskId == "" {
+		var err error
+		taskId, err = s.postDocument(ctx, j, filepath.Join(j.Dir(), "scan.pdf"))
+		if err != nil {
+			return err
+		}
+		tr.LazyPrintf("posted document to Paperless, task id %s", taskId)
+		if err := j.AddDerivedFile(s.taskFilename(), []byte(taskId)); err != nil {
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(s.pollTimeout)
+	for {
+		t, err := s.taskStatus(ctx, taskId)
+		if err != nil {
+			return err
+		}
+		switch t.Status {
+		case "SUCCESS":
+			tr.LazyPrintf("Paperless consumed document: %s (document %s)", t.Result, t.RelatedDocument)
+			return s.forgetTask(j)
+
+		case "FAILURE", "REVOKED":
+			if strings.Contains(t.Result, "duplicate") {
+				// An earlier attempt succeeded, e.g. before its task id was
+				// persisted.
+				tr.LazyPrintf("Paperless reports duplicate, considering delivered: %s", t.Result)
+				return s.forgetTask(j)
+			}
+			// Upload the document again on the next attempt.
+			if err := j.AddDerivedFile(s.taskFilename(), nil); err != nil {
+				return err
+			}
+			return fmt.Errorf("Paperless task %s failed: %s", taskId, t.Result)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Paperless task %s still in status %s after %v", taskId, t.Status, s.pollTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package paperlesssink_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink/paperlesssink"
+	"golang.org/x/net/trace"
+)
+
+type fakePaperless struct {
+	mu        sync.Mutex
+	posts     int
+	form      map[string][]string
+	document  []byte
+	polls     int
+	succeedAt int // task succeeds on this poll
+}
+
+func (f *fakePaperless) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/documents/post_document/":
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("document")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.document, _ = io.ReadAll(file)
+		f.form = r.MultipartForm.Value
+		f.posts++
+		fmt.Fprintf(w, `"task-%d"`, f.posts)
+
+	case "/api/tasks/":
+		f.polls++
+		status := "STARTED"
+		if f.polls >= f.succeedAt {
+			status = "SUCCESS"
+		}
+		json.NewEncoder(w).Encode([]map[string]string{{
+			"task_id":          r.FormValue("task_id"),
+			"status":           status,
+			"result":           "Success. New document id 42 created",
+			"related_document": "42",
+		}})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	fake := &fakePaperless{succeedAt: 3}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := paperlesssink.New("paperless", paperlesssink.Config{
+		URL:           srv.URL,
+		Tags:          []int{3, 7},
+		Correspondent: 5,
+		PollTimeout:   "1ms",
+	}, paperlesssink.Credentials{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PollInterval = time.Millisecond
+
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+
+	// The first attempt gives up polling before the task finishes.
+	if err := s.Deliver(ctx, job); err == nil {
+		t.Fatalf("Deliver unexpectedly succeeded")
+	}
+	// Retries must resume polling without posting the document again.
+	for {
+		if err := s.Deliver(ctx, job); err == nil {
+			break
+		}
+	}
+	if got, want := fake.posts, 1; got != want {
+		t.Errorf("unexpected number of posted documents: got %d, want %d", got, want)
+	}
+	if got, want := string(fake.document), "%PDF-1.0"; got != want {
+		t.Errorf("unexpected document: got %q, want %q", got, want)
+	}
+	for k, want := range map[string][]string{
+		"title":         {job.Id()},
+		"created":       {job.Created().Format("2006-01-02")},
+		"tags":          {"3", "7"},
+		"correspondent": {"5"},
+	} {
+		if got := fake.form[k]; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("form field %s: got %q, want %q", k, got, want)
+		}
+	}
+	// A reprocessed scan is posted again.
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0 reprocessed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.posts, 2; got != want {
+		t.Errorf("reprocessed scan not posted: got %d posted documents, want %d", got, want)
+	}
+	if got, want := string(fake.document), "%PDF-1.0 reprocessed"; got != want {
+		t.Errorf("unexpected document: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3sink implements a sink to upload scans to S3-compatible object
+// storage, e.g. Amazon S3 or MinIO.
+package s3sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Config is the type-specific configuration of an s3 sink in sinks.json.
+type Config struct {
+	// Endpoint is the base URL of the S3 API, e.g.
+	// https://s3.eu-central-1.amazonaws.com or http://minio.lan:9000
+	Endpoint string `json:"endpoint"`
+
+	// Region defaults to us-east-1, which is also what MinIO expects by
+	// default.
+	Region string `json:"region"`
+
+	Bucket string `json:"bucket"`
+
+	// Prefix defaults to “<sub>/”. Scans are placed in
+	// <prefix><year>/<job>.pdf
+	Prefix string `json:"prefix"`
+
+	// Originals enables uploading page*.jpg to <prefix><year>/<job>/.
+	Originals bool `json:"originals"`
+}
+
+// Credentials are read from sink-<id>.json in the user’s state directory.
+type Credentials struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+func init() {
+	sink.Register("s3", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var c Config
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		if c.Prefix == "" {
+			c.Prefix = u.Sub + "/"
+		}
+		var creds Credentials
+		if err := sink.ReadCredentials(u, cfg.Id, &creds); err != nil {
+			return nil, err
+		}
+		return New(cfg.Id, u.Sub, c, creds)
+	})
+}
+
+// Sink implements scan2drive.Sink.
+type Sink struct {
+	id       string
+	user     string
+	cfg      Config
+	endpoint *url.URL
+	signer   *signer
+
+	// Client is used for all requests and defaults to http.DefaultClient.
+	Client *http.Client
+
+	// PartSize is the size of the parts in which originals are uploaded. S3
+	// requires at least 5 MiB. Originals which are not larger than PartSize are
+	// uploaded using a single PUT request.
+	PartSize int64
+}
+
+// New returns an s3 sink with the specified id, as used for its completion
+// marker. userName is stored in the object metadata.
+func New(id, userName string, cfg Config, creds Credentials) (*Sink, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %q: scheme must be http or https", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket not configured")
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("credentials not configured")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &Sink{
+		id:       id,
+		user:     userName,
+		cfg:      cfg,
+		endpoint: endpoint,
+		signer: &signer{
+			accessKeyId:     creds.AccessKeyId,
+			secretAccessKey: creds.SecretAccessKey,
+			region:          cfg.Region,
+		},
+		Client:   http.DefaultClient,
+		PartSize: 8 * 1024 * 1024,
+	}, nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *Sink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{
+		Originals: s.cfg.Originals,
+		PDF:       true,
+	}
+}
+
+// s3Error is the error response body of the S3 API.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 error: HTTP %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// do sends a signed request for the object key (path-style, i.e. the bucket is
+// the first path component) and returns the response body, or an *s3Error.
+func (s *Sink) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+	u := *s.endpoint
+	objectPath := "/" + s.cfg.Bucket + "/" + key
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + uriEncode(objectPath, false)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.signer.sign(req, sha256Hex(body), time.Now())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &s3Error{StatusCode: resp.StatusCode}
+		if err := xml.Unmarshal(b, e); err != nil || e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+			e.Message = string(b)
+		}
+		return resp, nil, e
+	}
+	return resp, b, nil
+}
+
+func (s *Sink) metadata(j *jobqueue.Job, pages int, contentType string) http.Header {
+	h := make(http.Header)
+	h.Set("Content-Type", contentType)
+	h.Set("x-amz-meta-user", s.user)
+	if j.Source != "" {
+		h.Set("x-amz-meta-source", j.Source)
+	}
+	h.Set("x-amz-meta-pages", strconv.Itoa(pages))
+	return h
+}
+
+func (s *Sink) putObject(ctx context.Context, key, filename string, header http.Header) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.do(ctx, "PUT", key, nil, header, b)
+	return err
+}
+
+// uploadState is persisted in the job directory so that retries skip the
+// objects which were uploaded already, and interrupted multipart uploads
+// resume with the next missing part.
+type uploadState struct {
+	// Uploads maps object keys to in-progress multipart uploads.
+	Uploads map[string]*multipartUpload
+
+	// Completed maps object keys to the MD5 checksum (hex) of the file which
+	// was uploaded. Files which changed since (e.g. a reprocessed PDF) are
+	// uploaded again.
+	Completed map[string]string `json:",omitempty"`
+}
+
+type multipartUpload struct {
+	UploadId string
+	ETags    []string // indexed by part number - 1
+}
+
+func (s *Sink) stateFilename() string {
+	return "sink-" + s.id + ".multipart.json"
+}
+
+func (s *Sink) readState(j *jobqueue.Job) (*uploadState, error) {
+	state := &uploadState{
+		Uploads:   make(map[string]*multipartUpload),
+		Completed: make(map[string]string),
+	}
+	b, err := j.ReadDerivedFile(s.stateFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	if state.Uploads == nil {
+		state.Uploads = make(map[string]*multipartUpload)
+	}
+	if state.Completed == nil {
+		state.Completed = make(map[string]string)
+	}
+	return state, nil
+}
+
+func (s *Sink) writeState(j *jobqueue.Job, state *uploadState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return j.AddDerivedFile(s.stateFilename(), b)
+}
+
+func (s *Sink) putMultipart(ctx context.Context, j *jobqueue.Job, state *uploadState, key, filename string, header http.Header) error {
+	tr, _ := trace.FromContext(ctx)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	upload, ok := state.Uploads[key]
+	if !ok {
+		_, b, err := s.do(ctx, "POST", key, url.Values{"uploads": []string{""}}, header, nil)
+		if err != nil {
+			return err
+		}
+		var initiated struct {
+			UploadId string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(b, &initiated); err != nil {
+			return err
+		}
+		upload = &multipartUpload{UploadId: initiated.UploadId}
+		state.Uploads[key] = upload
+		if err := s.writeState(j, state); err != nil {
+			return err
+		}
+	} else {
+		tr.LazyPrintf("resuming upload of %s after %d parts", key, len(upload.ETags))
+	}
+
+	forget := func() error {
+		delete(state.Uploads, key)
+		return s.writeState(j, state)
+	}
+
+	parts := int((st.Size() + s.PartSize - 1) / s.PartSize)
+	buf := make([]byte, s.PartSize)
+	for part := len(upload.ETags) + 1; part <= parts; part++ {
+		n, err := f.ReadAt(buf, int64(part-1)*s.PartSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		resp, _, err := s.do(ctx, "PUT", key, url.Values{
+			"partNumber": []string{strconv.Itoa(part)},
+			"uploadId":   []string{upload.UploadId},
+		}, nil, buf[:n])
+		if err != nil {
+			if e, ok := err.(*s3Error); ok && e.Code == "NoSuchUpload" {
+				// The upload was aborted or expired, start over next time.
+				if err := forget(); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+		upload.ETags = append(upload.ETags, resp.Header.Get("ETag"))
+		if err := s.writeState(j, state); err != nil {
+			return err
+		}
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for idx, etag := range upload.ETags {
+		complete.Parts = append(complete.Parts, completedPart{
+			PartNumber: idx + 1,
+			ETag:       etag,
+		})
+	}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.do(ctx, "POST", key, url.Values{"uploadId": []string{upload.UploadId}}, nil, body); err != nil {
+		e, ok := err.(*s3Error)
+		if !ok || e.Code != "NoSuchUpload" {
+			return err
+		}
+		// Either the upload expired, or a previous attempt completed it but
+		// did not get to update the state file.
+		if err := forget(); err != nil {
+			return err
+		}
+		resp, _, err := s.do(ctx, "HEAD", key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength != st.Size() {
+			return fmt.Errorf("multipart upload of %s vanished, retrying", key)
+		}
+	}
+	tr.LazyPrintf("completed multipart upload of %s (%d parts)", key, parts)
+	return forget()
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	filenames, err := j.Filenames()
+	if err != nil {
+		return err
+	}
+	var originals []string
+	var pdf string
+	for _, filename := range filenames {
+		switch name := filepath.Base(filename); {
+		case name == "scan.pdf":
+			pdf = filename
+		case filepath.Ext(name) == ".jpg":
+			originals = append(originals, filename)
+		}
+	}
+
+	prefix := fmt.Sprintf("%s%d/%s", s.cfg.Prefix, j.Created().Year(), j.DeliveryId())
+
+	state, err := s.readState(j)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Originals {
+		for _, filename := range originals {
+			key := prefix + "/" + filepath.Base(filename)
+			if err := s.put(ctx, j, state, key, filename, s.metadata(j, len(originals), "image/jpeg")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if pdf != "" {
+		key := prefix + ".pdf"
+		if err := s.put(ctx, j, state, key, pdf, s.metadata(j, len(originals), "application/pdf")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put uploads the file as the object key, unless the same file was uploaded
+// before (see uploadState.Completed).
+func (s *Sink) put(ctx context.Context, j *jobqueue.Job, state *uploadState, key, filename string, header http.Header) error {
+	tr, _ := trace.FromContext(ctx)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if state.Completed[key] == sum {
+		tr.LazyPrintf("%s already uploaded, skipping", key)
+		return nil
+	}
+	if size <= s.PartSize {
+		err = s.putObject(ctx, key, filename, header)
+	} else {
+		err = s.putMultipart(ctx, j, state, key, filename, header)
+	}
+	if err != nil {
+		return err
+	}
+	tr.LazyPrintf("Uploaded %q to S3 as %s", filepath.Base(filename), key)
+	state.Completed[key] = sum
+	return s.writeState(j, state)
+}
+
+// implements scan2drive.SinkDeleter
+func (s *Sink) Delete(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	filenames, err := j.Filenames()
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("%s%d/%s", s.cfg.Prefix, j.Created().Year(), j.DeliveryId())
+	keys := []string{prefix + ".pdf"}
+	// The originals might have been removed from the job directory (see
+	// jobqueue.Job.PruneOriginals), but the manifest records their number.
+	for num := 1; num <= j.Manifest().Pages; num++ {
+		keys = append(keys, fmt.Sprintf("%s/page%d.jpg", prefix, num))
+	}
+	for _, filename := range filenames {
+		if key := prefix + "/" + filepath.Base(filename); filepath.Ext(filename) == ".jpg" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	// Abort multipart uploads which did not complete, so that their parts do
+	// not linger (and incur storage costs).
+	state, err := s.readState(j)
+	if err != nil {
+		return err
+	}
+	for key, upload := range state.Uploads {
+		query := url.Values{"uploadId": []string{upload.UploadId}}
+		if _, _, err := s.do(ctx, "DELETE", key, query, nil, nil); err != nil {
+			var e *s3Error
+			if !errors.As(err, &e) || e.StatusCode != http.StatusNotFound {
+				return err
+			}
+		}
+		tr.LazyPrintf("aborted multipart upload of %s", key)
+	}
+
+	for _, key := range keys {
+		// Deleting objects which do not exist succeeds.
+		if _, _, err := s.do(ctx, "DELETE", key, nil, nil, nil); err != nil {
+			return err
+		}
+		tr.LazyPrintf("deleted %s", key)
+	}
+	// Upload everything again should the job be delivered again.
+	return s.writeState(j, &uploadState{})
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sink implements a registry of sink types, from which the sinks of
+// each user are constructed.
+//
+// Sink implementations register themselves in their init function, so they
+// need to be imported (for side effects) by the main package.
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/user"
+)
+
+// A Factory constructs a sink for the specified user. cfg.Id is always set.
+type Factory func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a sink type available for use in sinks.json.
+func Register(typ string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[typ]; ok {
+		panic(fmt.Sprintf("sink type %q registered twice", typ))
+	}
+	registry[typ] = f
+}
+
+// DefaultConfigs are used for users without a sinks.json file: both the
+// originals and the PDF are uploaded to Google Drive.
+var DefaultConfigs = []scan2drive.SinkConfig{
+	{Type: "driveoriginals"},
+	{Type: "drive"},
+}
+
+// ForUser constructs all sinks configured for the specified user.
+func ForUser(u *user.Account) ([]scan2drive.Sink, error) {
+	cfgs := u.SinkConfigs
+	if len(cfgs) == 0 {
+		cfgs = DefaultConfigs
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	sinks := make([]scan2drive.Sink, 0, len(cfgs))
+	ids := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if cfg.Id == "" {
+			cfg.Id = cfg.Type
+		}
+		if err := validId(cfg.Id); err != nil {
+			return nil, err
+		}
+		if ids[cfg.Id] {
+			return nil, fmt.Errorf("sink id %q used more than once", cfg.Id)
+		}
+		ids[cfg.Id] = true
+		factory, ok := registry[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("sink %q: unknown type %q", cfg.Id, cfg.Type)
+		}
+		s, err := factory(u, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %v", cfg.Id, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// validId returns an error unless id consists of lowercase letters, digits,
+// dashes and underscores only. Sink ids are used in file names, e.g. of the
+// completion marker (COMPLETE.sink.<id>) and of the credentials
+// (sink-<id>.json), so they must not leave the directory.
+func validId(id string) error {
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return fmt.Errorf("sink id %q: only a-z, 0-9, - and _ are allowed", id)
+		}
+	}
+	return nil
+}
+
+// Delete removes the job from all sinks of the user which support it (see
+// scan2drive.SinkDeleter). Other sinks are skipped.
+func Delete(ctx context.Context, u *user.Account, j *jobqueue.Job) error {
+	sinks, err := ForUser(u)
+	if err != nil {
+		return err
+	}
+	for _, s := range sinks {
+		d, ok := s.(scan2drive.SinkDeleter)
+		if !ok {
+			continue
+		}
+		if err := d.Delete(ctx, j); err != nil {
+			return fmt.Errorf("deleting from sink %q: %v", s.Id(), err)
+		}
+	}
+	return nil
+}
+
+// ReadCredentials unmarshals the credentials of the sink with the specified id
+// from sink-<id>.json in the user’s state directory into v. Credentials are
+// kept out of sinks.json so that the configuration can be shared without
+// leaking them.
+func ReadCredentials(u *user.Account, sinkId string, v interface{}) error {
+	b, err := os.ReadFile(filepath.Join(u.Dir, "sink-"+sinkId+".json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("sink-%s.json: %v", sinkId, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+)
+
+type nopSink struct{ id string }
+
+func (s *nopSink) Id() string                                         { return s.id }
+func (s *nopSink) Needs() scan2drive.SinkNeeds                        { return scan2drive.SinkNeeds{} }
+func (s *nopSink) Deliver(ctx context.Context, j *jobqueue.Job) error { return nil }
+
+func init() {
+	sink.Register("nop", func(_ *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		return &nopSink{id: cfg.Id}, nil
+	})
+}
+
+func TestForUserIds(t *testing.T) {
+	for _, tt := range []struct {
+		ids     []string
+		wantErr string
+	}{
+		{ids: []string{"nop", "nas-2", "archive_old"}},
+		{ids: []string{"nas", "nas"}, wantErr: "more than once"},
+		{ids: []string{"../x"}, wantErr: "only a-z"},
+		{ids: []string{"a/b"}, wantErr: "only a-z"},
+		{ids: []string{"NAS"}, wantErr: "only a-z"},
+	} {
+		u := &user.Account{}
+		for _, id := range tt.ids {
+			u.SinkConfigs = append(u.SinkConfigs, scan2drive.SinkConfig{Type: "nop", Id: id})
+		}
+		_, err := sink.ForUser(u)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("ForUser(%q): %v", tt.ids, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ForUser(%q): got error %v, want it to contain %q", tt.ids, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webdavsink implements a sink to upload scans to a WebDAV server,
+// e.g. Nextcloud or ownCloud.
+package webdavsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stapelberg/scan2drive"
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/sink"
+	"github.com/stapelberg/scan2drive/internal/user"
+	"golang.org/x/net/trace"
+)
+
+// Config is the type-specific configuration of a webdav sink in sinks.json.
+type Config struct {
+	// URL is the collection under which scans are placed in
+	// <url>/<year>/<job>.pdf, e.g.
+	// https://cloud.example.net/remote.php/dav/files/michael/Scans
+	URL string `json:"url"`
+
+	// Originals enables uploading page*.jpg into <url>/<year>/<job>/.
+	Originals bool `json:"originals"`
+}
+
+// Credentials are read from sink-<id>.json in the user’s state directory. For
+// Nextcloud, create an app password in Settings → Security.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func init() {
+	sink.Register("webdav", func(u *user.Account, cfg *scan2drive.SinkConfig) (scan2drive.Sink, error) {
+		var c Config
+		if len(cfg.Config) > 0 {
+			if err := json.Unmarshal(cfg.Config, &c); err != nil {
+				return nil, err
+			}
+		}
+		var creds Credentials
+		if err := sink.ReadCredentials(u, cfg.Id, &creds); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return New(cfg.Id, c, creds)
+	})
+}
+
+// Sink implements scan2drive.Sink.
+type Sink struct {
+	id    string
+	cfg   Config
+	creds Credentials
+	base  *url.URL
+
+	// Client is used for all requests and defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// New returns a webdav sink with the specified id, as used for its completion
+// marker. Requests are not authenticated if creds.Username is empty.
+func New(id string, cfg Config, creds Credentials) (*Sink, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("url %q: scheme must be http or https", cfg.URL)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &Sink{
+		id:     id,
+		cfg:    cfg,
+		creds:  creds,
+		base:   base,
+		Client: http.DefaultClient,
+	}, nil
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Id() string { return s.id }
+
+// implements scan2drive.Sink
+func (s *Sink) Needs() scan2drive.SinkNeeds {
+	return scan2drive.SinkNeeds{
+		Originals: s.cfg.Originals,
+		PDF:       true,
+	}
+}
+
+// resolve returns the URL of the specified path components below the
+// configured base collection.
+func (s *Sink) resolve(components ...string) string {
+	u := *s.base
+	for _, c := range components {
+		u.Path += c
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+func (s *Sink) do(ctx context.Context, method, u string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.creds.Username != "" {
+		req.SetBasicAuth(s.creds.Username, s.creds.Password)
+	}
+	return s.Client.Do(req)
+}
+
+// mkcol creates the collection at u unless it already exists.
+func (s *Sink) mkcol(ctx context.Context, u string) error {
+	resp, err := s.do(ctx, "MKCOL", u, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusMethodNotAllowed:
+		// As per RFC 4918 section 9.3.1, MKCOL on an existing resource fails
+		// with 405 Method Not Allowed.
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("MKCOL %s: unexpected HTTP status: %v (body: %q)", u, resp.Status, string(b))
+}
+
+// put uploads the file to u. The request carries a Content-Length header:
+// Nextcloud and ownCloud (behind php-fpm or some nginx configurations) store
+// requests with chunked transfer encoding as empty files.
+func (s *Sink) put(ctx context.Context, u, filename, contentType string) error {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "PUT", u, bytes.NewReader(contents), contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("PUT %s: unexpected HTTP status: %v (body: %q)", u, resp.Status, string(b))
+}
+
+// implements scan2drive.Sink
+func (s *Sink) Deliver(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	filenames, err := j.Filenames()
+	if err != nil {
+		return err
+	}
+
+	// Like the Google Drive sink, place scans into a folder per year.
+	year := fmt.Sprintf("%d/", j.Created().Year())
+	if err := s.mkcol(ctx, s.resolve(year)); err != nil {
+		return err
+	}
+
+	if s.cfg.Originals {
+		if err := s.mkcol(ctx, s.resolve(year, j.DeliveryId()+"/")); err != nil {
+			return err
+		}
+		for _, filename := range filenames {
+			name := filepath.Base(filename)
+			if filepath.Ext(name) != ".jpg" {
+				continue
+			}
+			if err := s.put(ctx, s.resolve(year, j.DeliveryId()+"/", name), filename, "image/jpeg"); err != nil {
+				return err
+			}
+			tr.LazyPrintf("Uploaded %q to WebDAV", name)
+		}
+	}
+
+	for _, filename := range filenames {
+		if filepath.Base(filename) != "scan.pdf" {
+			continue
+		}
+		u := s.resolve(year, j.DeliveryId()+".pdf")
+		if err := s.put(ctx, u, filename, "application/pdf"); err != nil {
+			return err
+		}
+		tr.LazyPrintf("Uploaded PDF to WebDAV as %s", u)
+	}
+	return nil
+}
+
+// implements scan2drive.SinkDeleter
+func (s *Sink) Delete(ctx context.Context, j *jobqueue.Job) error {
+	tr, _ := trace.FromContext(ctx)
+
+	year := fmt.Sprintf("%d/", j.Created().Year())
+	urls := []string{s.resolve(year, j.DeliveryId()+".pdf")}
+	if s.cfg.Originals {
+		// As per RFC 4918 section 9.6.1, DELETE on a collection deletes all
+		// of its members.
+		urls = append(urls, s.resolve(year, j.DeliveryId()+"/"))
+	}
+	for _, u := range urls {
+		resp, err := s.do(ctx, "DELETE", u, nil, "")
+		if err != nil {
+			return err
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			return fmt.Errorf("DELETE %s: unexpected HTTP status: %v (body: %q)", u, resp.Status, string(b))
+		}
+		tr.LazyPrintf("deleted %s", u)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Michael Stapelberg and contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webdavsink_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/page"
+	"github.com/stapelberg/scan2drive/internal/sink/webdavsink"
+	"golang.org/x/net/trace"
+	"golang.org/x/net/webdav"
+)
+
+func TestDeliver(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "Scans"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dav := &webdav.Handler{
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "michael" || pass != "app-password" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// Like Nextcloud behind php-fpm, which stores chunked request
+		// bodies as empty files.
+		if r.Method == "PUT" && r.ContentLength < 0 {
+			http.Error(w, "Content-Length required", http.StatusLengthRequired)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	q := &jobqueue.Queue{Dir: t.TempDir()}
+	job, err := q.AddJob([]*page.Any{page.JPEGPageFromBytes([]byte("page one"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddDerivedFile("scan.pdf", []byte("%PDF-1.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := trace.New("test", t.Name())
+	defer tr.Finish()
+	ctx := trace.NewContext(context.Background(), tr)
+
+	wrong, err := webdavsink.New("dav", webdavsink.Config{URL: srv.URL + "/Scans"}, webdavsink.Credentials{
+		Username: "michael",
+		Password: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrong.Deliver(ctx, job); err == nil {
+		t.Fatalf("Deliver unexpectedly succeeded with wrong credentials")
+	}
+
+	s, err := webdavsink.New("dav", webdavsink.Config{
+		URL:       srv.URL + "/Scans",
+		Originals: true,
+	}, webdavsink.Credentials{
+		Username: "michael",
+		Password: "app-password",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delivering twice must succeed: the collections already exist the second
+	// time around.
+	for i := 0; i < 2; i++ {
+		if err := s.Deliver(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	year := fmt.Sprint(job.Created().Year())
+	for _, tt := range []struct {
+		fn   string
+		want string
+	}{
+		{filepath.Join("Scans", year, job.Id()+".pdf"), "%PDF-1.0"},
+		{filepath.Join("Scans", year, job.Id(), "page1.jpg"), "page one"},
+	} {
+		b, err := os.ReadFile(filepath.Join(root, tt.fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.fn, got, tt.want)
+		}
+	}
+
+	// Deleting succeeds, also when repeated.
+	for i := 0; i < 2; i++ {
+		if err := s.Delete(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "Scans", year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("files not deleted: %v", entries)
+	}
+}
@@ -55,9 +55,10 @@ func (a *AirscanSource) Transport() http.RoundTripper {
 // implements scan2drive.ScanSource
 func (a *AirscanSource) Metadata() scan2drive.ScanSourceMetadata {
 	return scan2drive.ScanSourceMetadata{
-		Id:      "airscan!" + a.host,
-		Name:    a.name,
-		IconURL: a.iconURL,
+		Id:           "airscan!" + a.host,
+		Name:         a.name,
+		IconURL:      a.iconURL,
+		ManualDuplex: true,
 	}
 }
 
@@ -81,7 +82,7 @@ func (a *AirscanSource) ScanTo(ingester *scaningest.Ingester) (string, error) {
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	return scan1(tr, a.client, ingester)
+	return scan1(tr, a.client, ingester, a.Metadata().Id)
 }
 
 // NOTE: We currently call out to the generic ProcessScan() implementation,
@@ -92,7 +93,7 @@ func (a *AirscanSource) ScanTo(ingester *scaningest.Ingester) (string, error) {
 // We should investigate whether similar speed-ups are required/achievable
 // with the Raspberry Pi 4 and AirScan.
 
-func scan1(tr trace.Trace, cl *airscan.Client, ingester *scaningest.Ingester) (string, error) {
+func scan1(tr trace.Trace, cl *airscan.Client, ingester *scaningest.Ingester, sourceId string) (string, error) {
 	status, err := cl.ScannerStatus()
 	if err != nil {
 		return "", err
@@ -113,6 +114,11 @@ func scan1(tr trace.Trace, cl *airscan.Client, ingester *scaningest.Ingester) (s
 	// For the ADF, the ScanSnap is better.
 	// We use the Brother for its flatbed scan only.
 	settings.InputSource = "Platen"
+	if ingester.ManualDuplex {
+		// Manual duplex scans need to flip the whole stack, which only
+		// works with the feeder.
+		settings.InputSource = "Feeder"
+	}
 	scan, err := cl.Scan(settings)
 	if err != nil {
 		return "", err
@@ -129,17 +135,23 @@ func scan1(tr trace.Trace, cl *airscan.Client, ingester *scaningest.Ingester) (s
 	if err != nil {
 		return "", err
 	}
+	ingestJob.Source = sourceId
 
 	for scan.ScanPage() {
 		b, err := io.ReadAll(scan.CurrentPage())
 		if err != nil {
+			ingestJob.Discard()
 			return "", err
 		}
-		if err := ingestJob.AddPage(page.JPEGPageFromBytes(b)); err != nil {
+		pg := page.JPEGPageFromBytes(b)
+		pg.DPI = settings.XResolution
+		if err := ingestJob.AddPage(pg); err != nil {
+			ingestJob.Discard()
 			return "", err
 		}
 	}
 	if err := scan.Err(); err != nil {
+		ingestJob.Discard()
 		return "", err
 	}
 
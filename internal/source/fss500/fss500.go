@@ -151,6 +151,9 @@ func (f *FSS500Source) CanProcess(r *scan2drive.ScanRequest) error {
 	if r.Source != "usb" {
 		return fmt.Errorf("requested source is not usb")
 	}
+	if r.ManualDuplex {
+		return fmt.Errorf("manual duplex requested, but the ScanSnap scans duplex")
+	}
 	return nil // any!
 }
 
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"image"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/stapelberg/scan2drive/internal/fss500"
@@ -29,15 +30,14 @@ import (
 	"golang.org/x/net/trace"
 )
 
-// binarizeRotated is a copy of binarize, processing chunks of a 4960x7016 pixel
-// array in RGB format (as returned by the Fujitsu ScanSnap iX500). Assumes the
-// input is rotated by 180 degrees.
-func binarizeRotated(chunk []byte, height int, bin *image.Gray, offset int) int {
-	var white int
+// luminance stores the luminance of a chunk of a 4960x7016 pixel array in RGB
+// format (as returned by the Fujitsu ScanSnap iX500) in rows [offset,
+// offset+height) of gray, for binarizing the page row by row as it is scanned
+// (see page.Binarizer).
+func luminance(chunk []byte, height int, gray *image.Gray, offset int) {
 	const channels = 3
 	var r, g, b uint32
-	var i, o int
-	var a uint32
+	var i int
 	for y := 0; y < height; y++ {
 		for x := 0; x < 4960; x++ {
 			i = channels*4960*y + channels*x
@@ -49,17 +49,9 @@ func binarizeRotated(chunk []byte, height int, bin *image.Gray, offset int) int
 			b = uint32(chunk[i+2])
 			b |= b << 8
 
-			a = (19595*r + 38470*g + 7471*b + 1<<15) >> 24
-			o = (7016-1-(offset+y))*4960 + (4960 - 1 - x)
-			if uint8(a) > 127 {
-				bin.Pix[o] = 0xff // white
-				white++
-			} else {
-				bin.Pix[o] = 0x00 // black
-			}
+			gray.Pix[(offset+y)*4960+x] = uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
 		}
 	}
-	return white
 }
 
 func scan(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device) (_ string, err error) {
@@ -74,8 +66,10 @@ func scan(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device) (_ str
 	if err != nil {
 		return "", err
 	}
+	ingestJob.Source = "fss500!usb"
 
 	if err := scan1(tr, ingester, dev, ingestJob); err != nil {
+		ingestJob.Discard()
 		return "", err
 	}
 
@@ -144,6 +138,7 @@ func scan1(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device, inges
 	}
 
 	var cnt int
+	th := ingestJob.Thresholder()
 
 	type numberedPage struct {
 		cnt        int
@@ -182,9 +177,9 @@ func scan1(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device, inges
 			ch   chan []byte
 			done chan struct{}
 
-			bin     *image.Gray // binarized and rotated full page
-			offset  int
-			whitePx int // number of white pixels in binarized page
+			bin       *image.Gray // binarized full page
+			binarizer page.Binarizer
+			offset    int
 		}
 		var state [2]*pageState
 
@@ -205,6 +200,7 @@ func scan1(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device, inges
 				done: make(chan struct{}),
 				bin:  image.NewGray(image.Rect(0, 0, 4960, 7016)),
 			}
+			ps.binarizer = th.NewBinarizer(ps.bin)
 			go func() {
 				for chunk := range ps.ch {
 					height := len(chunk) / 3 / 4960
@@ -212,9 +208,9 @@ func scan1(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device, inges
 						chunk = append(chunk, make([]byte, padding*3*4960)...)
 					}
 					ps.enc.EncodePixels(chunk, height)
-					white := binarizeRotated(chunk, height, ps.bin, ps.offset)
+					luminance(chunk, height, ps.bin, ps.offset)
 					ps.offset += height
-					ps.whitePx += white
+					ps.binarizer.Advance(ps.offset)
 				}
 				ps.done <- struct{}{}
 			}()
@@ -257,6 +253,16 @@ func scan1(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device, inges
 			} // for side
 		} // for
 
+		// The skew of the paper helps to deskew the pages (see package
+		// pipeline), but is not required.
+		var skew *float64
+		if hwStatus, err := fss500.GetHardwareStatus(dev); err != nil {
+			log.Printf("GetHardwareStatus: %v", err)
+		} else {
+			angle := hwStatus.SkewAngle()
+			skew = &angle
+		}
+
 		for side := range []int{front, back} {
 			ps := state[side]
 			ps.ch <- ps.rest
@@ -266,8 +272,22 @@ func scan1(tr trace.Trace, ingester *scaningest.Ingester, dev *usb.Device, inges
 				return err
 			}
 
-			whitePct := float64(ps.whitePx) / float64(4960*7016)
+			whitePct := float64(ps.binarizer.Finish()) / float64(4960*7016)
+			// The input is rotated by 180 degrees.
+			slices.Reverse(ps.bin.Pix)
 			pg := page.Binarized(ps.buf.Bytes(), ps.bin, whitePct)
+			pg.DPI = 600 // see fss500.Preread
+			if skew != nil {
+				hint := *skew
+				if side == back {
+					// Seen from the back side, the paper is skewed the
+					// other way.
+					hint = -hint
+				}
+				pg.SkewHint = &hint
+			}
+			// AddPage writes the page to disk, so that the buffers of this
+			// piece of paper can be garbage-collected.
 			if err := ingestJob.AddPage(pg); err != nil {
 				return err
 			}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
@@ -37,6 +38,22 @@ type Account struct {
 	Queue *jobqueue.Queue
 	Sub   string
 
+	// Dir is the user’s state directory, in which sinks can store credentials.
+	Dir string
+
+	// SinkConfigs is read from sinks.json. If empty, the default sinks are
+	// used (see package sink).
+	SinkConfigs []scan2drive.SinkConfig
+
+	// Profiles is read from profiles.json and maps profile names to their
+	// processing graph. If it does not contain a “default” profile, the
+	// default processing graph is used (see package pipeline).
+	Profiles map[string]scan2drive.ProfileConfig
+
+	// Retention is read from retention.json. If absent, local copies of jobs
+	// are kept forever.
+	Retention scan2drive.RetentionConfig
+
 	// old attributes below:
 
 	Token   *oauth2.Token
@@ -60,7 +77,7 @@ func (a *Account) LoggedIn() bool {
 }
 
 func LoadFromDir(dir string) (*Account, error) {
-	var account Account
+	account := Account{Dir: dir}
 
 	{
 		bytes, err := os.ReadFile(filepath.Join(dir, "token.json"))
@@ -85,6 +102,45 @@ func LoadFromDir(dir string) (*Account, error) {
 		}
 	}
 
+	{
+		// Try to read sinks.json if it exists.
+		bytes, err := os.ReadFile(filepath.Join(dir, "sinks.json"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(bytes, &account.SinkConfigs); err != nil {
+				return nil, fmt.Errorf("sinks.json: %v", err)
+			}
+		}
+	}
+
+	{
+		// Try to read profiles.json if it exists.
+		bytes, err := os.ReadFile(filepath.Join(dir, "profiles.json"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(bytes, &account.Profiles); err != nil {
+				return nil, fmt.Errorf("profiles.json: %v", err)
+			}
+		}
+	}
+
+	{
+		// Try to read retention.json if it exists.
+		bytes, err := os.ReadFile(filepath.Join(dir, "retention.json"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(bytes, &account.Retention); err != nil {
+				return nil, fmt.Errorf("retention.json: %v", err)
+			}
+		}
+	}
+
 	{
 		if _, err := os.Stat(filepath.Join(dir, "is_default")); err == nil {
 			account.Default = true
@@ -95,6 +151,9 @@ func LoadFromDir(dir string) (*Account, error) {
 }
 
 type Locked struct {
+	// update serializes UpdateFromDir.
+	update sync.Mutex
+
 	mu    sync.Mutex
 	users map[string]*Account
 }
@@ -126,7 +185,13 @@ func (l *Locked) UserByName(name string) *Account {
 	return nil
 }
 
+// UpdateFromDir loads all logged-in users from stateDir. The job directories
+// of users which were not loaded before (at startup, or when they log in) are
+// migrated (see jobqueue.Queue.Migrate) before any of their jobs are
+// processed.
 func (l *Locked) UpdateFromDir(stateDir, scansDir string, oauthConfig *oauth2.Config) error {
+	l.update.Lock()
+	defer l.update.Unlock()
 	newUsers := make(map[string]*Account)
 	usersPath := filepath.Join(stateDir, "users")
 	entries, err := ioutil.ReadDir(usersPath)
@@ -192,7 +257,12 @@ func (l *Locked) UpdateFromDir(stateDir, scansDir string, oauthConfig *oauth2.Co
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return fmt.Errorf("creating local scans directory for %q: %v", sub, err)
 		}
-		account.Queue = &jobqueue.Queue{Dir: dir}
+		account.Queue = &jobqueue.Queue{Dir: dir, User: sub}
+		if l.User(sub) == nil {
+			if err := account.Queue.Migrate(); err != nil {
+				log.Printf("user %s: %v", sub, err)
+			}
+		}
 
 		newUsers[sub] = account
 	}
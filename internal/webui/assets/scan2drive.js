@@ -158,7 +158,7 @@ function renameScan(name, newSuffix) {
     });
 }
 
-function scan(srcId) {
+function scan(srcId, manualDuplex) {
     // Only one scan can be in progress at a time.
     $('.fixed-action-btn i').text('hourglass_empty');
     $('.fixed-action-btn a').addClass('disabled');
@@ -166,8 +166,15 @@ function scan(srcId) {
 
     $.ajax({
         type: 'POST',
-        url: '/startscan/' + srcId,
+        url: '/startscan/' + srcId + (manualDuplex ? '?manual_duplex=true' : ''),
         success: function(data, textStatus, jqXHR) {
+            if (data.AwaitingSecondPass) {
+                $('#scan-dialog').modal('close');
+                $('.fixed-action-btn i').text('scanner');
+                $('.fixed-action-btn a').removeClass('disabled');
+                Materialize.toast('front sides scanned: flip the stack and scan the back sides', 10000);
+                return;
+            }
             $('#scan-dialog paper-input[name="name"] div[prefix]').text(data.Name + '-');
             var renameButton = $('#scan-form paper-button');
             renameButton.click(function(ev) {
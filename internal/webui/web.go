@@ -30,13 +30,18 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/securecookie"
 	"github.com/stapelberg/scan2drive"
 	"github.com/stapelberg/scan2drive/internal/httperr"
+	"github.com/stapelberg/scan2drive/internal/jobctl"
 	"github.com/stapelberg/scan2drive/internal/jobqueue"
+	"github.com/stapelberg/scan2drive/internal/retention"
+	"github.com/stapelberg/scan2drive/internal/scaningest"
 	"github.com/stapelberg/scan2drive/internal/source/airscan"
+	"github.com/stapelberg/scan2drive/internal/user"
 	"golang.org/x/oauth2"
 	oauth2api "google.golang.org/api/oauth2/v2"
 	"google.golang.org/api/option"
@@ -85,6 +90,9 @@ func (ui *UI) constantsHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// scansPerPage is the number of scans which the index page lists at once.
+const scansPerPage = 25
+
 func (ui *UI) indexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.Error(w, "not found", http.StatusNotFound)
@@ -96,7 +104,15 @@ func (ui *UI) indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var scans map[string]*jobqueue.Job
+	var (
+		scans     []jobqueue.Summary
+		total     int
+		reclaimed int64
+	)
+	pageNum, _ := strconv.Atoi(r.FormValue("page"))
+	if pageNum < 1 {
+		pageNum = 1
+	}
 	sub, _ := session.Values["sub"].(string)
 	account := ui.lockedUsers.User(sub)
 	accessToken := ""
@@ -106,18 +122,20 @@ func (ui *UI) indexHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		accessToken = account.Token.AccessToken
 		var err error
-		scans, err = account.Queue.Scans()
+		scans, total, err = account.Queue.List((pageNum-1)*scansPerPage, scansPerPage)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		reclaimed = account.Queue.Reclaimed()
 	}
-
-	var keys []string
-	for key := range scans {
-		keys = append(keys, key)
+	var prevPage, nextPage int
+	if pageNum > 1 {
+		prevPage = pageNum - 1
+	}
+	if pageNum*scansPerPage < total {
+		nextPage = pageNum + 1
 	}
-	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
 
 	type user struct {
 		Sub        string
@@ -166,13 +184,16 @@ func (ui *UI) indexHandler(w http.ResponseWriter, r *http.Request) {
 		"sub":         sub,
 		"user":        account,
 		"scans":       scans,
-		"keys":        keys,
+		"prevpage":    prevPage,
+		"nextpage":    nextPage,
 		"subs":        subs,
 		"users":       tusers,
 		"defaultsub":  defaultSub,
 		"scansources": scanSources,
 		"clientid":    oauthConfig.ClientID,
 		"accesstoken": accessToken,
+		"reclaimed":   retention.FormatBytes(reclaimed),
+		"duplex":      account != nil && scaningest.AwaitingSecondPass(account.Queue),
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -427,6 +448,112 @@ func (ui *UI) storeDefaultUser(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// jobHandler calls f with the job specified in the request, and redirects to
+// the index page once f succeeded.
+func (ui *UI) jobHandler(w http.ResponseWriter, r *http.Request, f func(account *user.Account, jobId string) error) error {
+	if r.Method != "POST" {
+		return httperr.Error(
+			http.StatusBadRequest,
+			fmt.Errorf("Bad Request"))
+	}
+
+	sub, err := ui.requireAuth(w, r)
+	if err != nil {
+		return nil // requireAuth handles the error
+	}
+	account := ui.lockedUsers.User(sub)
+	if account == nil {
+		return httperr.Error(
+			http.StatusNotFound,
+			fmt.Errorf("user %q not found", sub))
+	}
+
+	jobId := r.FormValue("job")
+	if _, err := account.Queue.JobById(jobId); err != nil {
+		return httperr.Error(
+			http.StatusNotFound,
+			fmt.Errorf("job %q: %v", jobId, err))
+	}
+	if err := f(account, jobId); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func (ui *UI) retryJobHandler(w http.ResponseWriter, r *http.Request) error {
+	return ui.jobHandler(w, r, ui.jobs.Retry)
+}
+
+func (ui *UI) cancelJobHandler(w http.ResponseWriter, r *http.Request) error {
+	return ui.jobHandler(w, r, ui.jobs.Cancel)
+}
+
+func (ui *UI) deleteJobHandler(w http.ResponseWriter, r *http.Request) error {
+	return ui.jobHandler(w, r, func(account *user.Account, jobId string) error {
+		return ui.jobs.Delete(r.Context(), account, jobId, r.FormValue("sinks") == "true")
+	})
+}
+
+func (ui *UI) reprocessJobHandler(w http.ResponseWriter, r *http.Request) error {
+	return ui.jobHandler(w, r, ui.jobs.Reprocess)
+}
+
+func (ui *UI) rotatePageHandler(w http.ResponseWriter, r *http.Request) error {
+	return ui.jobHandler(w, r, func(account *user.Account, jobId string) error {
+		num, err := strconv.Atoi(r.FormValue("page"))
+		if err != nil {
+			return httperr.Error(http.StatusBadRequest, fmt.Errorf("page: %v", err))
+		}
+		rotation, err := jobctl.ParseRotation(r.FormValue("rotation"))
+		if err != nil {
+			return httperr.Error(http.StatusBadRequest, fmt.Errorf("rotation: %v", err))
+		}
+		return ui.jobs.RotatePage(account, jobId, num, rotation)
+	})
+}
+
+func (ui *UI) restorePageHandler(w http.ResponseWriter, r *http.Request) error {
+	return ui.jobHandler(w, r, func(account *user.Account, jobId string) error {
+		num, err := strconv.Atoi(r.FormValue("page"))
+		if err != nil {
+			return httperr.Error(http.StatusBadRequest, fmt.Errorf("page: %v", err))
+		}
+		return ui.jobs.RestorePage(account, jobId, num)
+	})
+}
+
+func (ui *UI) reprocessJobsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httperr.Error(
+			http.StatusBadRequest,
+			fmt.Errorf("Bad Request"))
+	}
+
+	sub, err := ui.requireAuth(w, r)
+	if err != nil {
+		return nil // requireAuth handles the error
+	}
+	account := ui.lockedUsers.User(sub)
+	if account == nil {
+		return httperr.Error(
+			http.StatusNotFound,
+			fmt.Errorf("user %q not found", sub))
+	}
+
+	from, to, err := jobctl.ParseRange(r.FormValue("from"), r.FormValue("to"))
+	if err != nil {
+		return httperr.Error(http.StatusBadRequest, err)
+	}
+	ids, err := ui.jobs.ReprocessRange(account, from, to)
+	if err != nil {
+		return err
+	}
+	log.Printf("reprocessing %d jobs of user %s", len(ids), sub)
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
 func (ui *UI) startScanHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
 		return httperr.Error(
@@ -453,6 +580,8 @@ func (ui *UI) startScanHandler(w http.ResponseWriter, r *http.Request) error {
 			http.StatusNotFound,
 			fmt.Errorf("ingester for user %q not found", sub))
 	}
+	ingester.Profile = r.FormValue("profile")
+	ingester.ManualDuplex = r.FormValue("manual_duplex") == "true"
 	jobId, err := scanSource.ScanTo(ingester)
 	if err != nil {
 		return err
@@ -461,8 +590,12 @@ func (ui *UI) startScanHandler(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&struct {
 		Name string
+		// AwaitingSecondPass is set after the first pass of a manual duplex
+		// scan, which has no job (yet).
+		AwaitingSecondPass bool
 	}{
-		Name: jobId,
+		Name:               jobId,
+		AwaitingSecondPass: jobId == "" && ingester.ManualDuplex,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
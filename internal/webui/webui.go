@@ -32,6 +32,7 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/stapelberg/scan2drive"
 	"github.com/stapelberg/scan2drive/internal/httperr"
+	"github.com/stapelberg/scan2drive/internal/jobctl"
 	"github.com/stapelberg/scan2drive/internal/scaningest"
 	"github.com/stapelberg/scan2drive/internal/user"
 	"golang.org/x/net/trace"
@@ -115,6 +116,9 @@ type Config struct {
 	IngesterFor      func(uid string) *scaningest.Ingester
 	AllowedUsers     map[string]bool
 
+	// Jobs cancels, deletes and retries jobs on behalf of the user.
+	Jobs *jobctl.Controller
+
 	// ListenURLs contains the base URLs of all configured listeners,
 	// e.g. ["https://scan2drive.zekjur.net", "http://scan2drive.lan:7120"]
 	ListenURLs []string
@@ -140,6 +144,7 @@ func Init(cfg *Config) (http.Handler, *oauth2.Config, error) {
 		finders:      cfg.Finders,
 		ingesterFor:  cfg.IngesterFor,
 		allowedUsers: cfg.AllowedUsers,
+		jobs:         cfg.Jobs,
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/constants.js", httperr.Handle(ui.constantsHandler))
@@ -151,6 +156,13 @@ func Init(cfg *Config) (http.Handler, *oauth2.Config, error) {
 	mux.Handle("/storedrivefolder", httperr.Handle(ui.storeDriveFolder))
 	mux.Handle("/storedefaultuser", httperr.Handle(ui.storeDefaultUser))
 	mux.Handle("/startscan/", httperr.Handle(ui.startScanHandler))
+	mux.Handle("/retryjob", httperr.Handle(ui.retryJobHandler))
+	mux.Handle("/canceljob", httperr.Handle(ui.cancelJobHandler))
+	mux.Handle("/deletejob", httperr.Handle(ui.deleteJobHandler))
+	mux.Handle("/reprocessjob", httperr.Handle(ui.reprocessJobHandler))
+	mux.Handle("/reprocessjobs", httperr.Handle(ui.reprocessJobsHandler))
+	mux.Handle("/rotatepage", httperr.Handle(ui.rotatePageHandler))
+	mux.Handle("/restorepage", httperr.Handle(ui.restorePageHandler))
 	// def.HandleFunc("/scanstatus", scanStatusHandler)
 	mux.Handle("/scanicon/", http.StripPrefix("/scanicon/", httperr.Handle(ui.scanIconHandler)))
 	// def.HandleFunc("/renamescan", renameScanHandler)
@@ -194,6 +206,7 @@ type UI struct {
 	finders      []scan2drive.ScanSourceFinder
 	ingesterFor  func(uid string) *scaningest.Ingester
 	allowedUsers map[string]bool
+	jobs         *jobctl.Controller
 }
 
 func (ui *UI) updateUsers() error {
@@ -17,6 +17,10 @@
 package scan2drive
 
 import (
+	"context"
+	"encoding/json"
+
+	"github.com/stapelberg/scan2drive/internal/jobqueue"
 	"github.com/stapelberg/scan2drive/internal/scaningest"
 )
 
@@ -25,6 +29,37 @@ type ScanRequest struct {
 	User     string `json:"user"`
 	Source   string `json:"source"`
 	SourceId string `json:"source_id"`
+
+	// Profile selects the processing profile of the resulting job (see
+	// ProfileConfig). If empty, the user’s default profile is used.
+	Profile string `json:"profile"`
+
+	// ManualDuplex requests one pass of a manual duplex scan from the
+	// scanner’s feeder: the first request scans the front sides, the second
+	// request (after flipping the stack) the back sides, which are combined
+	// into a single job.
+	ManualDuplex bool `json:"manual_duplex"`
+}
+
+// A JobRequest is received via MQTT and cancels, deletes, retries,
+// reprocesses a job, or rotates or restores a page of a job.
+type JobRequest struct {
+	User string `json:"user"`
+	Job  string `json:"job"`
+
+	// Action is one of “cancel”, “delete”, “retry”, “reprocess”, “rotate” or
+	// “restore”.
+	Action string `json:"action"`
+
+	// Sinks, when deleting, selects whether to delete the job from all sinks
+	// which support it (see SinkDeleter), too.
+	Sinks bool `json:"sinks"`
+
+	// Page, when rotating or restoring, selects the page (starting at 1).
+	// Rotation, when rotating, is its rotation in degrees (clockwise: “0”,
+	// “90”, “180” or “270”, or “auto” to detect the page’s orientation).
+	Page     int    `json:"page,omitempty"`
+	Rotation string `json:"rotation,omitempty"`
 }
 
 type DriveFolder struct {
@@ -58,4 +93,92 @@ type ScanSourceMetadata struct {
 	Id      string
 	Name    string
 	IconURL string
+
+	// ManualDuplex is set for sources which can only scan one side of the
+	// pages in their feeder, which offer manual duplex scans instead.
+	ManualDuplex bool
+}
+
+// A Sink is a destination for processed scan jobs, e.g. Google Drive or a
+// directory on a NAS.
+type Sink interface {
+	// Id returns an identifier which is unique among the sinks of a user. The
+	// job queue records successful delivery in a COMPLETE.sink.<id> marker.
+	Id() string
+
+	// Needs returns which files of a job the sink delivers. Sinks which only
+	// need the originals are started while the job is still being converted.
+	Needs() SinkNeeds
+
+	// Deliver transfers the job to the sink. Deliver is retried until it
+	// succeeds, so it should be safe to call repeatedly for the same job.
+	Deliver(ctx context.Context, j *jobqueue.Job) error
+}
+
+// A SinkDeleter is a Sink which can remove a job it delivered, e.g. when the
+// user deletes the scan.
+type SinkDeleter interface {
+	Sink
+
+	// Delete removes the job from the sink. Delete must succeed for jobs which
+	// were only partially or not at all delivered.
+	Delete(ctx context.Context, j *jobqueue.Job) error
+}
+
+// SinkNeeds describes which files of a job a Sink delivers.
+type SinkNeeds struct {
+	Originals bool // page*.jpg
+	PDF       bool // scan.pdf
+	Thumbnail bool // thumb.png
+}
+
+// A SinkConfig configures one sink of a user. The list of sinks is read from
+// sinks.json in the user’s state directory.
+type SinkConfig struct {
+	// Type selects the sink implementation, e.g. “drive”.
+	Type string `json:"type"`
+
+	// Id defaults to Type and only needs to be set when using the same Type
+	// more than once.
+	Id string `json:"id,omitempty"`
+
+	// Config is passed to the sink implementation as-is.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// A StageConfig configures one stage of a processing profile.
+type StageConfig struct {
+	// Name identifies the stage within its profile and defaults to Type. The
+	// job queue records completion of the stage in a COMPLETE.<name> marker.
+	Name string `json:"name,omitempty"`
+
+	// Type selects the stage implementation, e.g. “binarize”.
+	Type string `json:"type"`
+
+	// After lists the names of the stages which need to complete before this
+	// stage can start.
+	After []string `json:"after,omitempty"`
+
+	// Config is passed to the stage implementation as-is.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// A ProfileConfig describes how jobs are processed, as a graph of stages. The
+// profiles of a user are read from profiles.json in the user’s state directory.
+type ProfileConfig struct {
+	Stages []StageConfig `json:"stages"`
+}
+
+// A RetentionConfig describes when the local copies of jobs are removed from
+// the scans directory. It is read from retention.json in the user’s state
+// directory. Only jobs which are done (i.e. which were delivered to all sinks)
+// are affected, and a value of zero keeps the files forever.
+type RetentionConfig struct {
+	// OriginalsDays is the number of days after which the original pages
+	// (page*.jpg) and intermediate files of processing stages are removed.
+	OriginalsDays int `json:"originals_days"`
+
+	// FilesDays is the number of days after which the PDF (scan.pdf) and the
+	// thumbnail (thumb.png) are removed.
+	FilesDays int `json:"files_days"`
 }